@@ -1,12 +1,36 @@
 package main
 
 import (
+	"log/slog"
+	"time"
+
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/version"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	macvtap_cni "github.com/kubevirt/macvtap-cni/pkg/cni"
 )
 
+// logged logs the outcome and duration of a command, once it has set up the
+// logger from its configuration.
+func logged(command string, cmd func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		start := time.Now()
+		err := cmd(args)
+		if err != nil {
+			slog.Error(command+" failed", "duration", time.Since(start), "error", err)
+		} else {
+			slog.Info(command+" succeeded", "duration", time.Since(start))
+		}
+		return err
+	}
+}
+
 func main() {
-	skel.PluginMain(macvtap_cni.CmdAdd, macvtap_cni.CmdCheck, macvtap_cni.CmdDel, version.All, bv.BuildString("macvtap"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    logged("ADD", macvtap_cni.CmdAdd),
+		Check:  logged("CHECK", macvtap_cni.CmdCheck),
+		Del:    logged("DEL", macvtap_cni.CmdDel),
+		GC:     logged("GC", macvtap_cni.CmdGC),
+		Status: logged("STATUS", macvtap_cni.CmdStatus),
+	}, version.All, bv.BuildString("macvtap"))
 }
@@ -2,16 +2,27 @@ package main
 
 import (
 	"flag"
+	"log/slog"
 	"os"
 
 	"github.com/golang/glog"
 	"github.com/kubevirt/device-plugin-manager/pkg/dpm"
 	macvtap "github.com/kubevirt/macvtap-cni/pkg/deviceplugin"
+	"github.com/kubevirt/macvtap-cni/pkg/logging"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 )
 
+var (
+	apiSocket    = flag.String("api-socket", macvtap.DefaultAPISocket, "unix socket the node API is served on, empty to disable it")
+	ipLearning   = flag.Bool("ip-learning", false, "learn the addresses of the macvtap consumers from the traffic of their lower devices")
+	learnedIPTTL = flag.Duration("learned-ip-ttl", macvtap.DefaultLearnedIPTTL, "how long a learned address is kept without being seen again")
+	podResources = flag.String("pod-resources-socket", macvtap.DefaultPodResourcesSocket, "socket of the kubelet pod resources API, telling which allocated macvtaps are still assigned to pods; empty to disable it")
+)
+
 func main() {
 	flag.Parse()
+	// The macvtaps recreated by the device plugin log their steps with slog.
+	slog.SetDefault(slog.New(&logging.GlogHandler{}))
 	// Device plugin operates with several goroutines that might be
 	// relocated among different OS threads with different namespaces.
 	// We capture the main namespace here and make sure that we do any
@@ -25,6 +36,22 @@ func main() {
 		glog.Exitf("%s environment variable must be set", macvtap.ConfigEnvironmentVariable)
 	}
 
+	if *podResources != "" {
+		go macvtap.NewAllocationTracker(*podResources).Run(make(chan struct{}))
+	}
+
+	var learner *macvtap.IPLearner
+	if *ipLearning {
+		learner = macvtap.NewIPLearner(*learnedIPTTL, mainNsPath)
+		go learner.Run(make(chan struct{}))
+	}
+
+	if *apiSocket != "" {
+		go func() {
+			glog.Exitf("Error serving the node API: %v", macvtap.ServeAPI(*apiSocket, mainNsPath, learner))
+		}()
+	}
+
 	manager := dpm.NewManager(macvtap.NewMacvtapLister(mainNsPath))
 	manager.Run()
 }
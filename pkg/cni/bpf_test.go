@@ -0,0 +1,142 @@
+package cni_test
+
+import (
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Helpers pinning the BPF objects the plugin is configured with, the way a
+// network policy agent would, and inspecting the maps it fills in.
+
+func sysBPF(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func pinBPFObject(fd int, path string) error {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(pathname))), BpfFd: uint32(fd)}
+
+	_, err = sysBPF(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	return err
+}
+
+func openBPFObject(path string) (int, error) {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	attr := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(pathname)))}
+
+	fd, err := sysBPF(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	return fd, err
+}
+
+// pinBPFMap pins a new hash map with the given key and value sizes at path.
+func pinBPFMap(path string, keySize uint32, valueSize uint32) error {
+	attr := struct {
+		MapType    uint32
+		KeySize    uint32
+		ValueSize  uint32
+		MaxEntries uint32
+		MapFlags   uint32
+	}{MapType: unix.BPF_MAP_TYPE_HASH, KeySize: keySize, ValueSize: valueSize, MaxEntries: 16}
+
+	fd, err := sysBPF(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return pinBPFObject(fd, path)
+}
+
+// pinBPFProgram pins at path a tc classifier returning TC_ACT_UNSPEC.
+func pinBPFProgram(path string) error {
+	insns := []uint64{
+		0xffffffff000000b7, // r0 = -1
+		0x0000000000000095, // exit
+	}
+	license, err := unix.BytePtrFromString("GPL")
+	if err != nil {
+		return err
+	}
+	attr := struct {
+		ProgType uint32
+		InsnCnt  uint32
+		Insns    uint64
+		License  uint64
+	}{
+		ProgType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(license))),
+	}
+
+	fd, err := sysBPF(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return pinBPFObject(fd, path)
+}
+
+type bpfMapElemAttr struct {
+	MapFd uint32
+	_     uint32
+	Key   uint64
+	Value uint64
+	Flags uint64
+}
+
+// lookupBPFMap returns the value of key in the map pinned at path.
+func lookupBPFMap(path string, key []byte, valueSize int) ([]byte, error) {
+	fd, err := openBPFObject(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	value := make([]byte, valueSize)
+	attr := bpfMapElemAttr{MapFd: uint32(fd), Key: uint64(uintptr(unsafe.Pointer(&key[0]))), Value: uint64(uintptr(unsafe.Pointer(&value[0])))}
+	_, err = sysBPF(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// updateBPFMap sets the value of key in the map pinned at path.
+func updateBPFMap(path string, key []byte, value []byte) error {
+	fd, err := openBPFObject(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	attr := bpfMapElemAttr{MapFd: uint32(fd), Key: uint64(uintptr(unsafe.Pointer(&key[0]))), Value: uint64(uintptr(unsafe.Pointer(&value[0])))}
+	_, err = sysBPF(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
@@ -1,13 +1,36 @@
 package cni_test
 
 import (
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// cniPath is where the IPAM plugins delegated to by the tests are built.
+var cniPath string
+
 func TestCni(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Cni Suite")
 }
+
+var _ = BeforeSuite(func() {
+	var err error
+	cniPath, err = os.MkdirTemp("", "cni-bin")
+	Expect(err).NotTo(HaveOccurred())
+
+	build := exec.Command("go", "build", "-o", filepath.Join(cniPath, "static"), "github.com/containernetworking/plugins/plugins/ipam/static")
+	output, err := build.CombinedOutput()
+	Expect(err).NotTo(HaveOccurred(), string(output))
+
+	// testutils runs the commands with CNI_PATH set to PATH
+	Expect(os.Setenv("PATH", cniPath+string(os.PathListSeparator)+os.Getenv("PATH"))).To(Succeed())
+})
+
+var _ = AfterSuite(func() {
+	os.RemoveAll(cniPath)
+})
@@ -15,19 +15,32 @@
 package cni
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kubevirt/macvtap-cni/pkg/logging"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 
+	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/vishvananda/netlink"
 )
 
 const (
@@ -35,20 +48,118 @@ const (
 	KubevirtQemuGID = 107
 )
 
+// ErrPluginNotAvailable is the error code defined by the CNI specification for
+// STATUS to report that the plugin is not able to service ADD requests.
+const ErrPluginNotAvailable uint = 50
+
+// ErrCheckFailed is the plugin specific error code returned when CHECK finds
+// the attachment no longer matches its configuration.
+const ErrCheckFailed uint = 100
+
+// ErrDuplicateMAC is the plugin specific error code returned when ADD is
+// requested a MAC already in use by another macvtap of the same lower device.
+const ErrDuplicateMAC uint = 101
+
+// DefaultAllocationGracePeriod is the time a macvtap allocated by the device
+// plugin is given by default to be claimed by an attachment, once the device
+// plugin no longer reports it as allocated, before GC considers it leaked.
+const DefaultAllocationGracePeriod = 10 * time.Minute
+
 // A NetConf structure represents a Multus network attachment definition configuration
 type NetConf struct {
 	types.NetConf
 	DeviceID      string `json:"deviceID"`
+	LowerDevice   string `json:"lowerDevice,omitempty"`
+	Master        string `json:"master,omitempty"`
+	Mode          string `json:"mode,omitempty"`
 	MTU           int    `json:"mtu,omitempty"`
 	IsPromiscuous bool   `json:"promiscMode,omitempty"`
-	Owner         int    `json:"owner,omitempty"`
-	Group         int    `json:"group,omitempty"`
+	// SourceMACs is the allowlist of source MACs of a macvtap in source
+	// mode, which only receives the frames sent from those addresses.
+	SourceMACs []string `json:"sourceMACs,omitempty"`
+	// Macvlan are the settings of the macvlan driver backing a macvtap
+	// created from the master.
+	Macvlan *util.MacvlanSettings `json:"macvlan,omitempty"`
+	Owner   int                   `json:"owner,omitempty"`
+	Group   int                   `json:"group,omitempty"`
+	// IPAMReportOnly makes the plugin report the addresses allocated by the
+	// IPAM plugin without configuring them on the interface, as is the case
+	// for VMs that configure the addresses themselves.
+	IPAMReportOnly bool          `json:"ipamReportOnly,omitempty"`
+	RuntimeConfig  RuntimeConfig `json:"runtimeConfig,omitempty"`
+	Tuning         *util.Tuning  `json:"tuning,omitempty"`
+	// TapAccess grants access to the tap device beyond Owner and Group.
+	TapAccess *util.TapAccessConfig `json:"tapAccess,omitempty"`
+	Bandwidth *util.BandwidthEntry  `json:"bandwidth,omitempty"`
+	// SpoofChk drops the frames sent from another MAC than the one of the
+	// macvtap, and IPSpoofChk the IP packets sent from addresses other than
+	// the allocated ones as well.
+	SpoofChk   bool `json:"spoofChk,omitempty"`
+	IPSpoofChk bool `json:"ipSpoofChk,omitempty"`
+	// Guards drop what the consumer of the macvtap sends acting as a DHCP
+	// server or an IPv6 router.
+	Guards []string `json:"guards,omitempty"`
+	// BPF names the BPF programs attached to the macvtap and the maps its
+	// addresses are added to, pinned in bpffs.
+	BPF *util.BPFConfig `json:"bpf,omitempty"`
+	// Mirror mirrors the traffic of the macvtap toward a host interface.
+	Mirror *util.Mirror `json:"mirror,omitempty"`
+	// DeviceInfoFile is the path of the device information file of the
+	// attachment, as set by Multus to report it in the network status.
+	DeviceInfoFile string `json:"CNIDeviceInfoFile,omitempty"`
+	// CacheDir is where attachments are recorded for DEL to clean them up.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// AllocationGracePeriod overrides DefaultAllocationGracePeriod, as a
+	// duration string.
+	AllocationGracePeriod string `json:"allocationGracePeriod,omitempty"`
+	// LogFile is the file the plugin logs to, rotated as it grows. Nothing is
+	// logged without it.
+	LogFile  string `json:"logFile,omitempty"`
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+// RuntimeConfig holds the values of the capabilities supported by the plugin,
+// as passed by the runtime.
+type RuntimeConfig struct {
+	Mac       string               `json:"mac,omitempty"`
+	MTU       int                  `json:"mtu,omitempty"`
+	IPs       []string             `json:"ips,omitempty"`
+	Bandwidth *util.BandwidthEntry `json:"bandwidth,omitempty"`
+	// MigrationTarget is the standby mode of the macvtap of the target of a
+	// live migration, empty for a regular attachment.
+	MigrationTarget string `json:"migrationTarget,omitempty"`
+	// TapAccess overrides the tapAccess settings for a pod. Unlike CNI_ARGS,
+	// which pods can set through Multus, it comes from the runtime only.
+	TapAccess *util.TapAccessConfig `json:"tapAccess,omitempty"`
 }
 
 // EnvArgs structure represents inputs sent from each VMI via environment variables
 type EnvArgs struct {
 	types.CommonArgs
 	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	// AllowDuplicateMAC lets the MAC be in use by another macvtap of the same
+	// lower device, as is the case of the source and target of a live
+	// migration.
+	AllowDuplicateMAC types.UnmarshallableBool `json:"allowDuplicateMAC,omitempty"`
+	// GuardExceptions are the comma separated guards not applied to a pod,
+	// e.g. ra for a VM that is a router.
+	GuardExceptions types.UnmarshallableString `json:"guardExceptions,omitempty"`
+	// MirrorDevice, MirrorDirection and MirrorSampleRate override the
+	// corresponding mirror settings for a pod. MirrorDevice alone is enough
+	// to mirror its traffic.
+	MirrorDevice     types.UnmarshallableString `json:"mirrorDevice,omitempty"`
+	MirrorDirection  types.UnmarshallableString `json:"mirrorDirection,omitempty"`
+	MirrorSampleRate types.UnmarshallableString `json:"mirrorSampleRate,omitempty"`
+	// MirrorFromLowerDevice mirrors the traffic of a pod from the lower
+	// device rather than through a monitoring macvlan.
+	MirrorFromLowerDevice types.UnmarshallableBool `json:"mirrorFromLowerDevice,omitempty"`
+	// K8S_POD_NAMESPACE and K8S_POD_NAME identify the pod, as set by the
+	// runtime, so that it gets the same MAC from a MAC pool when restarted.
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+	// MigrationTarget leaves the macvtap of the target of a live migration on
+	// standby until activated, in the given standby mode.
+	MigrationTarget types.UnmarshallableString `json:"migrationTarget,omitempty"`
 }
 
 func init() {
@@ -65,12 +176,46 @@ func loadConf(bytes []byte) (NetConf, string, error) {
 		Group: KubevirtQemuGID,
 	}
 	if err := json.Unmarshal(bytes, &n); err != nil {
-		return n, "", fmt.Errorf("failed to load netconf: %v", err)
+		return n, "", types.NewError(types.ErrDecodingFailure, "failed to load netconf", err.Error())
 	}
 
 	return n, n.CNIVersion, nil
 }
 
+// delegatedFields are the fields of the configuration whose content is
+// defined by the runtime or by other plugins, and that are not checked for
+// unknown fields.
+var delegatedFields = []string{"args", "capabilities", "dns", "ipam", "prevResult", "runtimeConfig"}
+
+// checkUnknownFields fails on fields of the configuration the plugin does not
+// know about, which are likely mistyped settings. Only ADD and CHECK refuse
+// them, as DEL and GC must still clean up after configurations written for
+// another version of the plugin.
+func checkUnknownFields(bytes []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		return err
+	}
+	for _, field := range delegatedFields {
+		delete(fields, field)
+	}
+
+	stripped, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(stripped)))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(&NetConf{})
+}
+
+// invalidConfig returns the error of an ADD refused because of its
+// configuration, which won't succeed if retried as is.
+func invalidConfig(msg string, err error) error {
+	return types.NewError(types.ErrInvalidNetworkConfig, msg, err.Error())
+}
+
 func getEnvArgs(envArgsString string) (EnvArgs, error) {
 	e := EnvArgs{}
 	err := types.LoadArgs(envArgsString, &e)
@@ -80,6 +225,368 @@ func getEnvArgs(envArgsString string) (EnvArgs, error) {
 	return e, nil
 }
 
+// getMAC returns the MAC address requested for the attachment, if any. The mac
+// capability takes precedence over CNI_ARGS.
+func getMAC(netConf NetConf, envArgs EnvArgs) (*net.HardwareAddr, error) {
+	macString := string(envArgs.MAC)
+	if netConf.RuntimeConfig.Mac != "" {
+		macString = netConf.RuntimeConfig.Mac
+	}
+	if macString == "" {
+		return nil, nil
+	}
+
+	mac, err := net.ParseMAC(macString)
+	if err != nil {
+		return nil, err
+	}
+	return &mac, nil
+}
+
+// getMTU returns the MTU requested for the attachment, zero if none. The mtu
+// capability takes precedence over the network configuration.
+func getMTU(netConf NetConf) int {
+	if netConf.RuntimeConfig.MTU != 0 {
+		return netConf.RuntimeConfig.MTU
+	}
+	return netConf.MTU
+}
+
+// setupLogging directs the logs of a command to the configured log file, with
+// the attachment identifiers added to every record. The records are discarded
+// if the logging configuration is invalid, which is returned as an error. ADD
+// and CHECK fail on that error; DEL, GC and STATUS ignore it, as an invalid
+// logging configuration must not get in the way of tearing down or reporting,
+// it only leaves the command unlogged.
+func setupLogging(command string, netConf NetConf, args *skel.CmdArgs) error {
+	err := logging.Setup(netConf.LogFile, netConf.LogLevel)
+	slog.SetDefault(slog.Default().With(
+		"command", command,
+		"network", netConf.Name,
+		"containerID", args.ContainerID,
+		"deviceID", netConf.DeviceID,
+		"ifname", args.IfName,
+	))
+	return err
+}
+
+// getAllocationGracePeriod returns the time an allocated macvtap is given to
+// be claimed by an attachment.
+func getAllocationGracePeriod(netConf NetConf) (time.Duration, error) {
+	if netConf.AllocationGracePeriod == "" {
+		return DefaultAllocationGracePeriod, nil
+	}
+	period, err := time.ParseDuration(netConf.AllocationGracePeriod)
+	if err != nil {
+		return 0, err
+	}
+	if period < 0 {
+		return 0, fmt.Errorf("allocation grace period %s is negative", period)
+	}
+	return period, nil
+}
+
+// getTapAccess returns how access to the tap device is granted, with the
+// tapAccess capability taking precedence over the network configuration.
+func getTapAccess(netConf NetConf) (*util.TapAccess, error) {
+	config := util.TapAccessConfig{}
+	if netConf.TapAccess != nil {
+		config = *netConf.TapAccess
+	}
+
+	// The names are still resolved against the configured accounts
+	if override := netConf.RuntimeConfig.TapAccess; override != nil {
+		if override.User != "" {
+			config.User = override.User
+		}
+		if override.Group != "" {
+			config.Group = override.Group
+		}
+		if override.Mode != "" {
+			config.Mode = override.Mode
+		}
+		if len(override.ACL) > 0 {
+			config.ACL = override.ACL
+		}
+		if override.SELinuxLabel != "" {
+			config.SELinuxLabel = override.SELinuxLabel
+		}
+	}
+
+	access, err := config.Resolve(netConf.Owner, netConf.Group)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tap access: %v", err)
+	}
+	return access, nil
+}
+
+// getBandwidth returns the bandwidth limits of the attachment, nil if none.
+// The bandwidth capability takes precedence over the network configuration.
+func getBandwidth(netConf NetConf) *util.BandwidthEntry {
+	if netConf.RuntimeConfig.Bandwidth != nil {
+		return netConf.RuntimeConfig.Bandwidth
+	}
+	return netConf.Bandwidth
+}
+
+// getGuards returns the guards of the attachment, those configured except the
+// ones CNI_ARGS make an exception of.
+func getGuards(netConf NetConf, envArgs EnvArgs) ([]string, error) {
+	if err := util.ValidateGuards(netConf.Guards); err != nil {
+		return nil, err
+	}
+	if envArgs.GuardExceptions == "" {
+		return netConf.Guards, nil
+	}
+
+	exceptions := strings.Split(string(envArgs.GuardExceptions), ",")
+	if err := util.ValidateGuards(exceptions); err != nil {
+		return nil, fmt.Errorf("invalid exception: %v", err)
+	}
+
+	var guards []string
+	for _, guard := range netConf.Guards {
+		excepted := false
+		for _, exception := range exceptions {
+			if guard == exception {
+				excepted = true
+				break
+			}
+		}
+		if !excepted {
+			guards = append(guards, guard)
+		}
+	}
+	return guards, nil
+}
+
+// getMirror returns how the traffic of the attachment is mirrored, nil if it
+// is not. The CNI_ARGS take precedence over the network configuration.
+func getMirror(netConf NetConf, envArgs EnvArgs) (*util.Mirror, error) {
+	if netConf.Mirror == nil && envArgs.MirrorDevice == "" {
+		return nil, nil
+	}
+
+	mirror := util.Mirror{}
+	if netConf.Mirror != nil {
+		mirror = *netConf.Mirror
+	}
+	if envArgs.MirrorDevice != "" {
+		mirror.Device = string(envArgs.MirrorDevice)
+	}
+	if envArgs.MirrorDirection != "" {
+		mirror.Direction = string(envArgs.MirrorDirection)
+	}
+	if envArgs.MirrorSampleRate != "" {
+		rate, err := strconv.ParseUint(string(envArgs.MirrorSampleRate), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample rate %q: %v", envArgs.MirrorSampleRate, err)
+		}
+		mirror.SampleRate = uint16(rate)
+	}
+	if envArgs.MirrorFromLowerDevice {
+		mirror.FromLowerDevice = true
+	}
+
+	if err := mirror.Validate(); err != nil {
+		return nil, err
+	}
+	return &mirror, nil
+}
+
+// getStandby returns the standby mode of the macvtap of the attachment, empty
+// if it is not the target of a live migration. The migrationTarget capability
+// takes precedence over CNI_ARGS.
+func getStandby(netConf NetConf, envArgs EnvArgs) (string, error) {
+	standby := string(envArgs.MigrationTarget)
+	if netConf.RuntimeConfig.MigrationTarget != "" {
+		standby = netConf.RuntimeConfig.MigrationTarget
+	}
+	if err := util.ValidateStandby(standby); err != nil {
+		return "", err
+	}
+	return standby, nil
+}
+
+// getStandbySourceMACs returns the allowlist a macvtap on standby in source
+// mode gets back on activation: the configured one, else the one of the
+// resource the device plugin created the macvtap with, else the one recorded
+// by a previous ADD.
+func getStandbySourceMACs(sourceMACs []net.HardwareAddr, tempIfaceName string, reconcile bool, args *skel.CmdArgs) ([]string, error) {
+	if len(sourceMACs) == 0 && tempIfaceName != "" && !reconcile {
+		var err error
+		sourceMACs, err = util.GetSourceMACs(tempIfaceName)
+		if err != nil {
+			return nil, invalidConfig("invalid migration target", err)
+		}
+	}
+
+	var macs []string
+	for _, mac := range sourceMACs {
+		macs = append(macs, mac.String())
+	}
+	if len(macs) == 0 && reconcile {
+		previous, err := util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			macs = previous.SourceMACs
+		}
+	}
+
+	if len(macs) == 0 {
+		return nil, invalidConfig("invalid migration target", fmt.Errorf("the %s standby mode requires source MACs to restore on activation", util.StandbySource))
+	}
+	return macs, nil
+}
+
+// macPoolKey returns the key the MAC of the attachment is allocated from a MAC
+// pool with: the pod interface, or the container interface when the runtime
+// does not tell the pod.
+func macPoolKey(args *skel.CmdArgs, envArgs EnvArgs) string {
+	if envArgs.K8S_POD_NAMESPACE != "" && envArgs.K8S_POD_NAME != "" {
+		return strings.Join([]string{string(envArgs.K8S_POD_NAMESPACE), string(envArgs.K8S_POD_NAME), args.IfName}, "/")
+	}
+	return strings.Join([]string{args.ContainerID, args.IfName}, "/")
+}
+
+// releasePoolMAC starts the grace period of the MAC allocated to the
+// attachment from the MAC pool of its device, if any.
+func releasePoolMAC(deviceID string, args *skel.CmdArgs, envArgs EnvArgs) error {
+	if deviceID == "" {
+		return nil
+	}
+	pool, err := util.LoadDeviceMACPool(util.DefaultMACPoolDir, deviceID)
+	if err != nil || pool == nil {
+		return err
+	}
+
+	start := time.Now()
+	err = pool.Release(util.DefaultMACPoolDir, macPoolKey(args, envArgs), args.ContainerID)
+	logging.Step("release MAC to pool", start, err, "pool", pool.Name)
+	return err
+}
+
+// getSpoofCheck returns the source addresses the macvtap interface is allowed
+// to send from, nil if they are not checked. The allowed IPs are those of the
+// result assigned to the interface.
+func getSpoofCheck(netConf NetConf, macvtapInterface *current.Interface, result *current.Result) (*util.SpoofCheck, error) {
+	if !netConf.SpoofChk && !netConf.IPSpoofChk {
+		return nil, nil
+	}
+
+	mac, err := net.ParseMAC(macvtapInterface.Mac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC of interface %q: %v", macvtapInterface.Name, err)
+	}
+	spoofCheck := &util.SpoofCheck{MAC: mac}
+
+	if netConf.IPSpoofChk {
+		spoofCheck.IPs = interfaceIPs(macvtapInterface, result)
+	}
+
+	return spoofCheck, nil
+}
+
+// interfaceIPs returns the IPs of the result assigned to the interface.
+func interfaceIPs(iface *current.Interface, result *current.Result) []net.IP {
+	var ips []net.IP
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface >= 0 && *ipc.Interface < len(result.Interfaces) && result.Interfaces[*ipc.Interface] == iface {
+			ips = append(ips, ipc.Address.IP)
+		}
+	}
+	return ips
+}
+
+// addToBPFMaps adds the addresses of the macvtap interface to the BPF maps,
+// replacing those previously recorded for the attachment, and records them for
+// DEL to remove them.
+func addToBPFMaps(netConf NetConf, bpf *util.BPF, attachment *util.Attachment, macvtapInterface *current.Interface, result *current.Result, cache *util.AttachmentCache) error {
+	mac, err := net.ParseMAC(macvtapInterface.Mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC of interface %q: %v", macvtapInterface.Name, err)
+	}
+	ips := interfaceIPs(macvtapInterface, result)
+
+	if err := removeFromBPFMaps(netConf, attachment); err != nil {
+		return err
+	}
+
+	attachment.MAC = mac.String()
+	attachment.IPs = nil
+	for _, ip := range ips {
+		attachment.IPs = append(attachment.IPs, ip.String())
+	}
+	if err := cache.Save(attachment); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = bpf.AddToMaps(mac, ips, attachment.IfIndex)
+	logging.Step("add to BPF maps", start, err, "mac", mac.String(), "ips", attachment.IPs)
+	return err
+}
+
+// checkBPFMaps verifies that the addresses of the named macvtap interface in
+// the current netns are in the BPF maps.
+func checkBPFMaps(bpf *util.BPF, name string, macvtapInterface *current.Interface, result *current.Result) error {
+	mac, err := net.ParseMAC(macvtapInterface.Mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC of interface %q: %v", name, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+	return bpf.CheckMaps(mac, interfaceIPs(macvtapInterface, result), link.Attrs().Index)
+}
+
+// removeFromBPFMaps removes the addresses recorded for the attachment from the
+// BPF maps, unless taken over by another interface since.
+func removeFromBPFMaps(netConf NetConf, attachment *util.Attachment) error {
+	if netConf.BPF == nil || attachment == nil || attachment.MAC == "" {
+		return nil
+	}
+
+	mac, err := net.ParseMAC(attachment.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid recorded MAC %q: %v", attachment.MAC, err)
+	}
+	var ips []net.IP
+	for _, s := range attachment.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return util.RemoveFromMaps(netConf.BPF, mac, ips, attachment.IfIndex)
+}
+
+// getDeviceInfoPath returns the path of the device information file of the
+// attachment.
+func getDeviceInfoPath(netConf NetConf, args *skel.CmdArgs) string {
+	if netConf.DeviceInfoFile != "" {
+		return netConf.DeviceInfoFile
+	}
+	return util.DeviceInfoPathForCNI(netConf.Name, args.ContainerID, args.IfName)
+}
+
+// getRuntimeIPs parses the addresses requested through the ips capability.
+func getRuntimeIPs(netConf NetConf) ([]*net.IPNet, error) {
+	var ips []*net.IPNet
+	for _, ipString := range netConf.RuntimeConfig.IPs {
+		ip, ipNet, err := net.ParseCIDR(ipString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q in runtimeConfig: %v", ipString, err)
+		}
+		ipNet.IP = ip
+		ips = append(ips, ipNet)
+	}
+	return ips, nil
+}
+
 // CmdAdd - CNI interface
 func CmdAdd(args *skel.CmdArgs) error {
 	var err error
@@ -88,72 +595,1257 @@ func CmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	if err := checkUnknownFields(args.StdinData); err != nil {
+		return invalidConfig("invalid netconf", err)
+	}
+
+	if err := setupLogging("ADD", netConf, args); err != nil {
+		return invalidConfig("invalid logging configuration", err)
+	}
+
+	// Validate everything that can be before any side effect, so that a
+	// refused ADD leaves the macvtap where it was.
 	envArgs, err := getEnvArgs(args.Args)
 	if err != nil {
-		return err
+		return types.NewError(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS", err.Error())
+	}
+
+	mac, err := getMAC(netConf, envArgs)
+	if err != nil {
+		return invalidConfig("invalid MAC address", err)
+	}
+
+	mtu := getMTU(netConf)
+	if mtu < 0 {
+		return invalidConfig("invalid MTU", fmt.Errorf("MTU %d is negative", mtu))
+	}
+
+	tapAccess, err := getTapAccess(netConf)
+	if err != nil {
+		return invalidConfig("invalid tap access", err)
+	}
+
+	if err = netConf.Tuning.Validate(); err != nil {
+		return invalidConfig("invalid tuning", err)
+	}
+
+	bandwidth := getBandwidth(netConf)
+	if err = bandwidth.Validate(); err != nil {
+		return invalidConfig("invalid bandwidth", err)
+	}
+
+	runtimeIPs, err := getRuntimeIPs(netConf)
+	if err != nil {
+		return invalidConfig("invalid runtime addresses", err)
+	}
+
+	sourceMACs, err := util.ParseSourceMACs(netConf.SourceMACs)
+	if err != nil {
+		return invalidConfig("invalid source MACs", err)
 	}
 
-	var mac *net.HardwareAddr = nil
-	if envArgs.MAC != "" {
-		aMac, err := net.ParseMAC(string(envArgs.MAC))
-		mac = &aMac
+	// Results prior to 0.3.0 can't describe interfaces, only addresses
+	if !supportsInterfaces(cniVersion) && netConf.IPAM.Type == "" && len(runtimeIPs) == 0 {
+		return types.NewError(types.ErrIncompatibleCNIVersion, fmt.Sprintf("CNI version %s requires an ipam configuration", cniVersion), "")
+	}
+
+	// When chained, extend the result of the previous plugins
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	if netConf.RawPrevResult != nil {
+		if err = version.ParsePrevResult(&netConf.NetConf); err != nil {
+			return types.NewError(types.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+		}
+		result, err = current.NewResultFromResult(netConf.PrevResult)
 		if err != nil {
-			return err
+			return types.NewError(types.ErrDecodingFailure, "failed to convert prevResult", err.Error())
 		}
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	guards, err := getGuards(netConf, envArgs)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return invalidConfig("invalid guards", err)
 	}
 
-	// Delete link if err to avoid link leak in this ns
+	if err = netConf.BPF.Validate(); err != nil {
+		return invalidConfig("invalid BPF configuration", err)
+	}
+
+	mirror, err := getMirror(netConf, envArgs)
+	if err != nil {
+		return invalidConfig("invalid mirror", err)
+	}
+
+	standby, err := getStandby(netConf, envArgs)
+	if err != nil {
+		return invalidConfig("invalid migration target", err)
+	}
+
+	if _, err = getAllocationGracePeriod(netConf); err != nil {
+		return invalidConfig("invalid allocation grace period", err)
+	}
+
+	if netConf.IPSpoofChk && netConf.IPAM.Type == "" && len(runtimeIPs) == 0 {
+		return invalidConfig("invalid spoof check", fmt.Errorf("ipSpoofChk requires an ipam configuration or the ips capability"))
+	}
+
+	// Without a device allocated by the device plugin, the macvtap is created
+	// on top of the configured master.
+	if netConf.DeviceID == "" && netConf.Master == "" {
+		return invalidConfig("invalid netconf", fmt.Errorf("deviceID or master is required"))
+	}
 	if netConf.DeviceID == "" {
-		return fmt.Errorf("deviceID is required")
+		if err = util.ValidateSourceMACs(netConf.Mode, sourceMACs); err != nil {
+			return invalidConfig("invalid mode", err)
+		}
+		if err = netConf.Macvlan.Validate(netConf.Mode); err != nil {
+			return invalidConfig("invalid macvlan settings", err)
+		}
+		if standby == util.StandbySource && netConf.Mode != "source" {
+			return invalidConfig("invalid migration target", fmt.Errorf("the %s standby mode requires the source mode", util.StandbySource))
+		}
+	} else if netConf.Macvlan != nil {
+		// Allocated macvtaps are created by the device plugin
+		return invalidConfig("invalid macvlan settings", fmt.Errorf("macvlan settings only apply along master, those of allocated devices are part of the device plugin resource"))
 	}
-	tempIfaceName := util.TemporaryInterfaceName(netConf.DeviceID)
-	defer func() {
-		netns.Close()
+
+	start := time.Now()
+	bpf, err := util.OpenBPF(netConf.BPF)
+	logging.Step("open BPF objects", start, err)
+	if err != nil {
+		return invalidConfig("invalid BPF configuration", err)
+	}
+	defer bpf.Close()
+
+	start = time.Now()
+	netns, err := ns.GetNS(args.Netns)
+	logging.Step("open netns", start, err, "netns", args.Netns)
+	if err != nil {
+		return types.NewError(types.ErrUnknownContainer, fmt.Sprintf("failed to open netns %q", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	var tempIfaceName string
+	if netConf.DeviceID != "" {
+		tempIfaceName = util.TemporaryInterfaceName(netConf.DeviceID)
+	}
+
+	// Without a requested MAC, the MAC of a device of a resource with a MAC
+	// pool is allocated from it, the same one for the same pod interface.
+	var macPool *util.MACPool
+	if mac == nil && netConf.DeviceID != "" {
+		macPool, err = util.LoadDeviceMACPool(util.DefaultMACPoolDir, netConf.DeviceID)
 		if err != nil {
-			util.LinkDelete(tempIfaceName)
+			return err
 		}
-	}()
+	}
+	if macPool != nil {
+		var poolMAC net.HardwareAddr
+		start = time.Now()
+		poolMAC, err = macPool.Allocate(util.DefaultMACPoolDir, macPoolKey(args, envArgs), args.ContainerID)
+		logging.Step("allocate MAC from pool", start, err, "pool", macPool.Name, "mac", poolMAC.String())
+		if err != nil {
+			return err
+		}
+		mac = &poolMAC
+
+		// The checks below may fail before the attachment is rolled back
+		defer func() {
+			if err != nil {
+				releasePoolMAC(netConf.DeviceID, args, envArgs)
+			}
+		}()
+	}
 
-	macvtapInterface, err := util.ConfigureInterface(tempIfaceName, args.IfName, mac, netConf.MTU, netConf.IsPromiscuous, netConf.Owner, netConf.Group, netns)
+	// A retried ADD finds the macvtap its previous attempt set up, and
+	// reconciles it instead of failing on the name clash.
+	cache := util.NewAttachmentCache(netConf.CacheDir)
+	lowerDevice, err := findExistingMacvtap(netConf, args, tempIfaceName, cache, mac, mtu, netns)
 	if err != nil {
 		return err
 	}
-
-	result := &current.Result{
-		CNIVersion: cniVersion,
-		Interfaces: []*current.Interface{macvtapInterface},
+	reconcile := lowerDevice != ""
+	if !reconcile {
+		lowerDevice, err = getLowerDevice(netConf, tempIfaceName, mtu)
+		if err != nil {
+			return err
+		}
 	}
 
-	return types.PrintResult(result, cniVersion)
-}
+	// The target of a live migration shares the MAC of its source
+	if mac != nil && !bool(envArgs.AllowDuplicateMAC) && standby == "" {
+		if err = checkDuplicateMAC(args, netConf.Name, lowerDevice, tempIfaceName, *mac); err != nil {
+			return err
+		}
+	}
 
-// CmdDel - CNI plugin Interface
-func CmdDel(args *skel.CmdArgs) error {
-	if args.Netns == "" {
-		return nil
+	var standbySourceMACs []string
+	if standby == util.StandbySource {
+		standbySourceMACs, err = getStandbySourceMACs(sourceMACs, tempIfaceName, reconcile, args)
+		if err != nil {
+			return err
+		}
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+	deviceInfoPath := getDeviceInfoPath(netConf, args)
+	attachment := &util.Attachment{
+		Network:        netConf.Name,
+		ContainerID:    args.ContainerID,
+		IfName:         args.IfName,
+		NetNsPath:      args.Netns,
+		DeviceID:       netConf.DeviceID,
+		TempIfaceName:  tempIfaceName,
+		LowerDevice:    lowerDevice,
+		DeviceInfoFile: deviceInfoPath,
+	}
+	if macPool != nil {
+		attachment.MACPool = macPool
+		attachment.MACPoolKey = macPoolKey(args, envArgs)
+	}
 
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				return err
+	// Delete link if err to avoid link leak in this ns
+	mirrorName := util.MirrorInterfaceName(args.ContainerID, args.IfName)
+	ipamAllocated := false
+	defer func() {
+		if err != nil {
+			slog.Info("rolling back attachment", "error", err)
+			if ipamAllocated {
+				ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
 			}
+			removeFromBPFMaps(netConf, attachment)
+			util.DeleteStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+			cache.Delete(netConf.Name, args.ContainerID, args.IfName)
+			util.CleanDeviceInfo(deviceInfoPath)
+			if tempIfaceName != "" {
+				util.LinkDelete(tempIfaceName)
+			}
+			util.RemoveLowerDeviceMirror(lowerDevice, mirrorName)
+			// The links of the pod netns with these names may not be
+			// the ones of this attachment, as when the macvtap could
+			// not be renamed over an existing interface
+			netns.Do(func(_ ns.NetNS) error {
+				deleteOwnedLink(attachment, func() (netlink.Link, error) { return netlink.LinkByName(mirrorName) })
+				return deleteOwnedLink(attachment, func() (netlink.Link, error) { return netlink.LinkByName(args.IfName) })
+			})
 		}
-		return nil
-	})
+	}()
 
-	return err
-}
+	var macvtapInterface *current.Interface
+
+	if reconcile {
+		slog.Info("reconciling existing macvtap", "lowerDevice", lowerDevice)
+		// Keep track of the addresses added to the BPF maps by the
+		// previous ADD, to replace them
+		if previous, _ := cache.Load(netConf.Name, args.ContainerID, args.IfName); previous != nil {
+			attachment.MAC, attachment.IPs = previous.MAC, previous.IPs
+		}
+		macvtapInterface, err = util.ReconcileInterface(args.IfName, mac, mtu, netConf.IsPromiscuous, tapAccess, sourceMACs, netConf.Tuning, standby, netns)
+	} else if netConf.DeviceID != "" {
+		// Claim the macvtap for this attachment so that GC can tell if it leaks
+		err = util.SetLinkOwner(tempIfaceName, attachment.Owner())
+		if err != nil {
+			return err
+		}
+
+		macvtapInterface, err = util.ConfigureInterface(tempIfaceName, args.IfName, mac, mtu, netConf.IsPromiscuous, tapAccess, sourceMACs, netConf.Tuning, standby, netns)
+	} else {
+		macvtapInterface, err = util.CreateInterface(netConf.Master, netConf.Mode, netConf.Macvlan, args.IfName, mac, mtu, netConf.IsPromiscuous, tapAccess, sourceMACs, netConf.Tuning, standby, netns)
+		if err == nil {
+			// Claim it as well so that DEL can tell it apart
+			err = netns.Do(func(_ ns.NetNS) error {
+				if err := util.SetLinkOwner(args.IfName, attachment.Owner()); err != nil {
+					util.LinkDelete(args.IfName)
+					return err
+				}
+				return nil
+			})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if bandwidth != nil {
+		start = time.Now()
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.SetBandwidth(args.IfName, bandwidth)
+		})
+		logging.Step("set bandwidth", start, err)
+		if err != nil {
+			return err
+		}
+	} else if reconcile {
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.RemoveBandwidth(args.IfName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Publish the device information so that consumers don't have to guess
+	// the tap device from the interface index.
+	start = time.Now()
+	err = netns.Do(func(_ ns.NetNS) error {
+		info, err := util.NewMacvtapDeviceInfo(args.IfName, lowerDevice)
+		if err != nil {
+			return err
+		}
+		attachment.IfIndex = info.Macvtap.IfIndex
+		return util.SaveDeviceInfo(deviceInfoPath, info)
+	})
+	logging.Step("save device info", start, err, "path", deviceInfoPath)
+	if err != nil {
+		return err
+	}
+
+	// Record the attachment so that DEL can clean it up without a netns
+	if err = cache.Save(attachment); err != nil {
+		return err
+	}
+
+	result.Interfaces = append(result.Interfaces, macvtapInterface)
+
+	if netConf.IPAM.Type != "" || len(runtimeIPs) > 0 {
+		// Configure the addresses anew, as they may have changed since the
+		// previous attempt
+		if reconcile && !netConf.IPAMReportOnly {
+			err = netns.Do(func(_ ns.NetNS) error {
+				return util.FlushAddresses(args.IfName)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		var ipamResult *current.Result
+		start = time.Now()
+		ipamResult, err = addIPAMConfig(args, netConf, runtimeIPs, macvtapInterface, netns)
+		logging.Step("configure addresses", start, err, "ipam", netConf.IPAM.Type)
+		if err != nil {
+			return err
+		}
+		ipamAllocated = netConf.IPAM.Type != ""
+
+		macvtapIndex := len(result.Interfaces) - 1
+		for _, ipc := range ipamResult.IPs {
+			ipc.Interface = current.Int(macvtapIndex)
+		}
+		result.IPs = append(result.IPs, ipamResult.IPs...)
+		result.Routes = append(result.Routes, ipamResult.Routes...)
+		if !ipamResult.DNS.IsEmpty() {
+			result.DNS = ipamResult.DNS
+		}
+	}
+
+	if len(guards) > 0 || reconcile {
+		start = time.Now()
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.SetGuards(args.IfName, guards)
+		})
+		logging.Step("set guards", start, err, "guards", guards)
+		if err != nil {
+			return err
+		}
+	}
+
+	var spoofCheck *util.SpoofCheck
+	spoofCheck, err = getSpoofCheck(netConf, macvtapInterface, result)
+	if err != nil {
+		return err
+	}
+	if spoofCheck != nil {
+		start = time.Now()
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.SetSpoofCheck(args.IfName, spoofCheck)
+		})
+		logging.Step("set spoof check", start, err, "ips", len(spoofCheck.IPs))
+		if err != nil {
+			return err
+		}
+	} else if reconcile {
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.RemoveSpoofCheck(args.IfName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if bpf != nil {
+		start = time.Now()
+		err = netns.Do(func(_ ns.NetNS) error {
+			return bpf.Attach(args.IfName)
+		})
+		logging.Step("attach BPF programs", start, err)
+		if err != nil {
+			return err
+		}
+
+		if err = addToBPFMaps(netConf, bpf, attachment, macvtapInterface, result, cache); err != nil {
+			return err
+		}
+	} else if reconcile {
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.DetachBPF(args.IfName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if mirror != nil {
+		start = time.Now()
+		err = setMirror(args.IfName, mirrorName, attachment.Owner(), lowerDevice, macvtapInterface, mirror, netns)
+		logging.Step("set mirror", start, err, "device", mirror.Device, "direction", mirror.Direction, "sampleRate", mirror.SampleRate, "fromLowerDevice", mirror.FromLowerDevice)
+		if err != nil {
+			return err
+		}
+	} else if reconcile {
+		if err = util.RemoveLowerDeviceMirror(lowerDevice, mirrorName); err != nil {
+			return err
+		}
+		err = netns.Do(func(_ ns.NetNS) error {
+			return util.RemoveMirror(args.IfName, mirrorName)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record the macvtap on standby for the device plugin to activate it on
+	// switchover
+	if standby != "" {
+		err = saveStandby(netConf, args, envArgs, standby, standbySourceMACs, macvtapInterface, result)
+		if err != nil {
+			return err
+		}
+	} else if reconcile {
+		err = util.DeleteStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = types.PrintResult(result, cniVersion)
+	return err
+}
+
+// setMirror mirrors the traffic of the macvtap, either from its lower device
+// or through a monitoring macvlan in netns claimed by owner, and removes the
+// other kind of mirror a previous ADD may have set.
+func setMirror(ifName string, mirrorName string, owner util.LinkOwner, lowerDevice string, macvtapInterface *current.Interface, mirror *util.Mirror, netns ns.NetNS) error {
+	if !mirror.FromLowerDevice {
+		if err := util.RemoveLowerDeviceMirror(lowerDevice, mirrorName); err != nil {
+			return err
+		}
+		return util.SetMirror(ifName, mirrorName, owner, mirror, netns)
+	}
+
+	mac, err := net.ParseMAC(macvtapInterface.Mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC of interface %q: %v", ifName, err)
+	}
+	if err := netns.Do(func(_ ns.NetNS) error {
+		return util.RemoveMirror(ifName, mirrorName)
+	}); err != nil {
+		return err
+	}
+	return util.SetLowerDeviceMirror(lowerDevice, mirrorName, mac, mirror)
+}
+
+// saveStandby records the macvtap interface of the attachment on standby,
+// along the addresses announced on its activation.
+func saveStandby(netConf NetConf, args *skel.CmdArgs, envArgs EnvArgs, standby string, sourceMACs []string, macvtapInterface *current.Interface, result *current.Result) error {
+	record := &util.StandbyAttachment{
+		Network:      netConf.Name,
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		PodNamespace: string(envArgs.K8S_POD_NAMESPACE),
+		PodName:      string(envArgs.K8S_POD_NAME),
+		NetNsPath:    args.Netns,
+		Mode:         standby,
+		MAC:          macvtapInterface.Mac,
+		SourceMACs:   sourceMACs,
+	}
+	for _, ip := range interfaceIPs(macvtapInterface, result) {
+		record.IPs = append(record.IPs, ip.String())
+	}
+
+	start := time.Now()
+	err := util.SaveStandby(util.DefaultStandbyDir, record)
+	logging.Step("record standby macvtap", start, err, "mode", standby, "ips", record.IPs)
+	return err
+}
+
+// supportsInterfaces tells whether results of the given CNI version are able
+// to report interfaces.
+func supportsInterfaces(cniVersion string) bool {
+	ok, err := version.GreaterThanOrEqualTo(cniVersion, "0.3.0")
+	return err == nil && ok
+}
+
+// findExistingMacvtap returns the lower device of the macvtap a previous ADD
+// of the attachment left in the netns, empty if there is none. It is only the
+// same macvtap if it is owned by the attachment, is on the expected lower
+// device and has the requested MAC, if any.
+func findExistingMacvtap(netConf NetConf, args *skel.CmdArgs, tempIfaceName string, cache *util.AttachmentCache, mac *net.HardwareAddr, mtu int, netns ns.NetNS) (string, error) {
+	// A macvtap still waiting on the host is a new allocation
+	if tempIfaceName != "" {
+		if exists, err := util.LinkExists(tempIfaceName); err != nil || exists {
+			return "", nil
+		}
+	}
+
+	var link netlink.Link
+	err := netns.Do(func(_ ns.NetNS) error {
+		var err error
+		link, err = netlink.LinkByName(args.IfName)
+		return err
+	})
+	if err != nil {
+		return "", nil
+	}
+
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok {
+		return "", nil
+	}
+	owner, ok := util.GetLinkOwner(link)
+	if !ok || owner.Network != netConf.Name || owner.ContainerID != args.ContainerID || owner.IfName != args.IfName {
+		return "", nil
+	}
+	if mac != nil && !bytes.Equal(link.Attrs().HardwareAddr, *mac) {
+		return "", nil
+	}
+
+	// The parent is in the current netns, where the macvtap was created
+	parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	if err != nil {
+		return "", nil
+	}
+
+	expectedLowerDevice := netConf.Master
+	if netConf.DeviceID != "" {
+		expectedLowerDevice = netConf.LowerDevice
+		if expectedLowerDevice == "" {
+			attachment, err := cache.Load(netConf.Name, args.ContainerID, args.IfName)
+			if err != nil {
+				return "", err
+			}
+			if attachment != nil {
+				expectedLowerDevice = attachment.LowerDevice
+			}
+		}
+	}
+	lowerDevice := parent.Attrs().Name
+	if expectedLowerDevice != "" && lowerDevice != expectedLowerDevice {
+		return "", nil
+	}
+
+	if netConf.Mode != "" {
+		expectedMode, err := util.ModeFromString(netConf.Mode)
+		if err != nil {
+			return "", invalidConfig("invalid mode", err)
+		}
+		if macvtap.Mode != expectedMode {
+			return "", invalidConfig("unexpected macvtap", fmt.Errorf("interface %q is in %s mode, expected %s mode", args.IfName, util.ModeToString(macvtap.Mode), netConf.Mode))
+		}
+	}
+
+	if mtu > parent.Attrs().MTU {
+		return "", invalidConfig("invalid MTU", fmt.Errorf("MTU %d is above the MTU %d of lower device %q", mtu, parent.Attrs().MTU, lowerDevice))
+	}
+
+	return lowerDevice, nil
+}
+
+// getLowerDevice returns the lower device of the macvtap of the attachment,
+// the device plugin allocated tempIfaceName or the configured master, and
+// checks that it is the expected one and can carry the requested MTU. An
+// allocated device must be a macvtap, in the expected mode if any. Devices
+// that are missing may show up later on, so the runtime is asked to try again.
+func getLowerDevice(netConf NetConf, tempIfaceName string, mtu int) (string, error) {
+	lowerDevice := netConf.Master
+	if tempIfaceName != "" {
+		link, err := netlink.LinkByName(tempIfaceName)
+		if err != nil {
+			return "", types.NewError(types.ErrTryAgainLater, fmt.Sprintf("device %q allocated for %s is not available", tempIfaceName, netConf.DeviceID), err.Error())
+		}
+
+		// A misconfigured resource name would hand over a device that is
+		// not what the network expects.
+		macvtap, ok := link.(*netlink.Macvtap)
+		if !ok {
+			return "", invalidConfig("unexpected macvtap", fmt.Errorf("device %s is of type %q, not macvtap", netConf.DeviceID, link.Type()))
+		}
+
+		lowerDevice, err = util.GetLowerDevice(tempIfaceName)
+		if err != nil {
+			return "", types.NewError(types.ErrTryAgainLater, fmt.Sprintf("device %q allocated for %s is not available", tempIfaceName, netConf.DeviceID), err.Error())
+		}
+
+		if netConf.Mode != "" {
+			expectedMode, err := util.ModeFromString(netConf.Mode)
+			if err != nil {
+				return "", invalidConfig("invalid mode", err)
+			}
+			if macvtap.Mode != expectedMode {
+				return "", invalidConfig("unexpected macvtap", fmt.Errorf("device %s is in %s mode, expected %s mode", netConf.DeviceID, util.ModeToString(macvtap.Mode), netConf.Mode))
+			}
+		}
+	}
+
+	if netConf.LowerDevice != "" && lowerDevice != netConf.LowerDevice {
+		if tempIfaceName == "" {
+			return "", invalidConfig("invalid netconf", fmt.Errorf("master %q does not match lowerDevice %q", netConf.Master, netConf.LowerDevice))
+		}
+		return "", invalidConfig("unexpected macvtap", fmt.Errorf("device %s is on lower device %q, expected %q", netConf.DeviceID, lowerDevice, netConf.LowerDevice))
+	}
+
+	link, err := netlink.LinkByName(lowerDevice)
+	if err != nil {
+		return "", types.NewError(types.ErrTryAgainLater, fmt.Sprintf("lower device %q is not available", lowerDevice), err.Error())
+	}
+
+	if mtu > link.Attrs().MTU {
+		return "", invalidConfig("invalid MTU", fmt.Errorf("MTU %d is above the MTU %d of lower device %q", mtu, link.Attrs().MTU, lowerDevice))
+	}
+
+	return lowerDevice, nil
+}
+
+// checkDuplicateMAC fails if the MAC is in use by another macvtap of the lower
+// device, as both would then silently lose traffic.
+func checkDuplicateMAC(args *skel.CmdArgs, network string, lowerDevice string, tempIfaceName string, mac net.HardwareAddr) error {
+	// Skip the macvtap of this attachment, either not claimed yet or left
+	// behind by a previous attempt
+	ignore := func(link netlink.Link) bool {
+		if tempIfaceName != "" && link.Attrs().Name == tempIfaceName {
+			return true
+		}
+		owner, ok := util.GetLinkOwner(link)
+		return ok && owner.Network == network && owner.ContainerID == args.ContainerID && owner.IfName == args.IfName
+	}
+
+	user, err := util.FindMACUser(lowerDevice, mac, []string{args.Netns}, ignore)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		return types.NewError(ErrDuplicateMAC, fmt.Sprintf("MAC %s is already in use on lower device %q", mac, lowerDevice), fmt.Sprintf("used by %s", user))
+	}
+
+	return nil
+}
+
+// addIPAMConfig delegates address allocation to the configured IPAM plugin
+// and returns its outcome, referring to the macvtap interface. Without an IPAM
+// plugin, the addresses requested through the ips capability are used as is.
+// Unless the configuration is only meant to be reported, the addresses and
+// routes are also set on the interface.
+func addIPAMConfig(args *skel.CmdArgs, netConf NetConf, runtimeIPs []*net.IPNet, macvtapInterface *current.Interface, netns ns.NetNS) (ipamResult *current.Result, err error) {
+	if netConf.IPAM.Type != "" {
+		ipamResult, err = execIPAMAdd(args, netConf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Release the IP allocation if anything goes wrong from here on
+		defer func() {
+			if err != nil {
+				ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+			}
+		}()
+	} else {
+		ipamResult = &current.Result{}
+		for _, ipNet := range runtimeIPs {
+			ipamResult.IPs = append(ipamResult.IPs, &current.IPConfig{Address: *ipNet})
+		}
+	}
+
+	ipamResult.Interfaces = []*current.Interface{macvtapInterface}
+	for _, ipc := range ipamResult.IPs {
+		ipc.Interface = current.Int(0)
+	}
+
+	if netConf.IPAMReportOnly {
+		return ipamResult, nil
+	}
+
+	err = netns.Do(func(_ ns.NetNS) error {
+		return ipam.ConfigureIface(args.IfName, ipamResult)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure IPAM addresses on %q: %v", args.IfName, err)
+	}
+
+	return ipamResult, nil
+}
+
+// execIPAMAdd runs the configured IPAM plugin. The allocation is released if
+// its result is not usable.
+func execIPAMAdd(args *skel.CmdArgs, netConf NetConf) (*current.Result, error) {
+	r, err := ipam.ExecAdd(netConf.IPAM.Type, args.StdinData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run IPAM plugin %q: %v", netConf.IPAM.Type, err)
+	}
+
+	ipamResult, err := current.NewResultFromResult(r)
+	if err != nil {
+		ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+		return nil, fmt.Errorf("failed to convert IPAM result: %v", err)
+	}
+
+	if len(ipamResult.IPs) == 0 {
+		ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+		return nil, fmt.Errorf("IPAM plugin %q returned missing IP config", netConf.IPAM.Type)
+	}
+
+	return ipamResult, nil
+}
+
+// CmdDel - CNI plugin Interface
+func CmdDel(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	_ = setupLogging("DEL", netConf, args)
+
+	cache := util.NewAttachmentCache(netConf.CacheDir)
+	attachment, err := cache.Load(netConf.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	if netConf.IPAM.Type != "" {
+		start := time.Now()
+		err := ipam.ExecDel(netConf.IPAM.Type, args.StdinData)
+		logging.Step("release addresses", start, err, "ipam", netConf.IPAM.Type)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := util.CleanDeviceInfo(getDeviceInfoPath(netConf, args)); err != nil {
+		return err
+	}
+	// The runtime may not tell the device information file of the ADD again
+	if attachment != nil && attachment.DeviceInfoFile != "" {
+		if err := util.CleanDeviceInfo(attachment.DeviceInfoFile); err != nil {
+			return err
+		}
+	}
+
+	if err := removeFromBPFMaps(netConf, attachment); err != nil {
+		return err
+	}
+
+	if err := util.DeleteStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
+
+	// CNI_ARGS that can't be parsed would have failed the ADD, without any
+	// MAC allocated.
+	envArgs, _ := getEnvArgs(args.Args)
+	deviceID := netConf.DeviceID
+	if deviceID == "" && attachment != nil {
+		deviceID = attachment.DeviceID
+	}
+	if err := releasePoolMAC(deviceID, args, envArgs); err != nil {
+		return err
+	}
+
+	// A mirror from the lower device, possibly requested through CNI_ARGS, is
+	// removed along the attachment, as its filters outlive the macvtap.
+	if attachment != nil {
+		if err := util.RemoveLowerDeviceMirror(attachment.LowerDevice, util.MirrorInterfaceName(args.ContainerID, args.IfName)); err != nil {
+			return err
+		}
+	}
+
+	// Without a netns from the runtime, fall back to the recorded one.
+	netnsPath := args.Netns
+	if netnsPath == "" && attachment != nil {
+		netnsPath = attachment.NetNsPath
+	}
+	start := time.Now()
+	err = deleteMacvtap(netnsPath, args.IfName, func() error {
+		return removeTrafficControl(args.IfName, util.MirrorInterfaceName(args.ContainerID, args.IfName), netConf)
+	}, attachment)
+	logging.Step("delete macvtap", start, err, "netns", netnsPath, "cached", attachment != nil)
+	if err != nil {
+		return err
+	}
+
+	return cache.Delete(netConf.Name, args.ContainerID, args.IfName)
+}
+
+// deleteMacvtap deletes the macvtap of an attachment from the netns at
+// netnsPath, if any, after running cleanup in that netns. When there is a
+// record of the attachment, only the macvtap it still owns is deleted, looked
+// up by name or index in that netns, and by its temporary name in the current
+// one in case it was left behind before being moved. Delete can be called
+// multiple times so don't return an error if the device is already removed or
+// the netns is gone, which takes the macvtap along.
+func deleteMacvtap(netnsPath string, ifName string, cleanup func() error, attachment *util.Attachment) error {
+	if netnsPath != "" {
+		err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+			if cleanup != nil {
+				if err := cleanup(); err != nil {
+					return err
+				}
+			}
+
+			if attachment == nil {
+				if err := ip.DelLinkByName(ifName); err != ip.ErrLinkNotFound {
+					return err
+				}
+				return nil
+			}
+
+			if err := deleteOwnedLink(attachment, func() (netlink.Link, error) {
+				return netlink.LinkByName(ifName)
+			}); err != nil {
+				return err
+			}
+			return deleteOwnedLink(attachment, func() (netlink.Link, error) {
+				return netlink.LinkByIndex(attachment.IfIndex)
+			})
+		})
+		switch err.(type) {
+		case nil, ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		default:
+			return err
+		}
+	}
+
+	if attachment == nil || attachment.TempIfaceName == "" {
+		return nil
+	}
+	return deleteOwnedLink(attachment, func() (netlink.Link, error) {
+		return netlink.LinkByName(attachment.TempIfaceName)
+	})
+}
+
+// removeTrafficControl removes the tc state configured for the attachment
+// from the named interface in the current netns, if any. The mirror may have
+// been requested through CNI_ARGS, so it is removed along its monitoring
+// macvlan regardless of the configuration.
+func removeTrafficControl(ifName string, mirrorName string, netConf NetConf) error {
+	if err := util.RemoveMirror(ifName, mirrorName); err != nil {
+		return err
+	}
+	if getBandwidth(netConf) != nil {
+		if err := util.RemoveBandwidth(ifName); err != nil {
+			return err
+		}
+	}
+	if netConf.SpoofChk || netConf.IPSpoofChk {
+		if err := util.RemoveSpoofCheck(ifName); err != nil {
+			return err
+		}
+	}
+	if len(netConf.Guards) > 0 {
+		if err := util.RemoveGuards(ifName); err != nil {
+			return err
+		}
+	}
+	if netConf.BPF != nil {
+		if err := util.DetachBPF(ifName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOwnedLink deletes the link found by lookup in the current netns, if
+// it is still owned by the attachment, as a link with the same index or name
+// may have been handed over to another one since.
+func deleteOwnedLink(attachment *util.Attachment, lookup func() (netlink.Link, error)) error {
+	link, err := lookup()
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	if owner, ok := util.GetLinkOwner(link); !ok || owner != attachment.Owner() {
+		return nil
+	}
+
+	return util.LinkDelete(link.Attrs().Name)
+}
+
+// CmdCheck - CNI plugin Interface
+func CmdCheck(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := checkUnknownFields(args.StdinData); err != nil {
+		return invalidConfig("invalid netconf", err)
+	}
+
+	if err := setupLogging("CHECK", netConf, args); err != nil {
+		return invalidConfig("invalid logging configuration", err)
+	}
+
+	envArgs, err := getEnvArgs(args.Args)
+	if err != nil {
+		return types.NewError(types.ErrInvalidEnvironmentVariables, "failed to parse CNI_ARGS", err.Error())
+	}
+
+	mac, err := getMAC(netConf, envArgs)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid MAC address", err.Error())
+	}
+
+	tapAccess, err := getTapAccess(netConf)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid tap access", err.Error())
+	}
+
+	if netConf.NetConf.RawPrevResult == nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "required prevResult missing", "")
+	}
+	if err := version.ParsePrevResult(&netConf.NetConf); err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+	}
+	result, err := current.NewResultFromResult(netConf.PrevResult)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, "failed to convert prevResult", err.Error())
+	}
+
+	macvtapIndex := -1
+	for i, iface := range result.Interfaces {
+		if iface.Name == args.IfName && (iface.Sandbox == "" || iface.Sandbox == args.Netns) {
+			macvtapIndex = i
+			break
+		}
+	}
+	if macvtapIndex < 0 {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q not found in prevResult", args.IfName), "")
+	}
+	macvtapInterface := result.Interfaces[macvtapIndex]
+
+	var macvtapIPs []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface != nil && *ipc.Interface == macvtapIndex {
+			macvtapIPs = append(macvtapIPs, ipc)
+		}
+	}
+
+	spoofCheck, err := getSpoofCheck(netConf, macvtapInterface, result)
+	if err != nil {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q not valid in prevResult", args.IfName), err.Error())
+	}
+
+	guards, err := getGuards(netConf, envArgs)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid guards", err.Error())
+	}
+
+	mirror, err := getMirror(netConf, envArgs)
+	if err != nil {
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid mirror", err.Error())
+	}
+
+	bpf, err := util.OpenBPF(netConf.BPF)
+	if err != nil {
+		return types.NewError(ErrCheckFailed, "BPF objects not available", err.Error())
+	}
+	defer bpf.Close()
+
+	if netConf.IPAM.Type != "" {
+		if err := ipam.ExecCheck(netConf.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return types.NewError(types.ErrUnknownContainer, fmt.Sprintf("failed to open netns %q", args.Netns), err.Error())
+	}
+	defer netns.Close()
+
+	if mirror != nil && mirror.FromLowerDevice {
+		if err := checkLowerDeviceMirror(args, macvtapInterface, mirror, netns); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q mirror does not match", args.IfName), err.Error())
+		}
+	}
+
+	standby, err := util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+	if err != nil {
+		return types.NewError(ErrCheckFailed, "failed to load the standby record", err.Error())
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		if err := validateMacvtapInterface(args.IfName, macvtapInterface, mac, standby != nil, tapAccess, spoofCheck, netConf); err != nil {
+			return err
+		}
+
+		if err := util.CheckGuards(args.IfName, guards); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q guards do not match", args.IfName), err.Error())
+		}
+
+		if bpf != nil {
+			if err := bpf.Check(args.IfName); err != nil {
+				return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q BPF programs do not match", args.IfName), err.Error())
+			}
+			if err := checkBPFMaps(bpf, args.IfName, macvtapInterface, result); err != nil {
+				return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q BPF map entries do not match", args.IfName), err.Error())
+			}
+		}
+
+		if mirror != nil && !mirror.FromLowerDevice {
+			if err := util.CheckMirror(args.IfName, util.MirrorInterfaceName(args.ContainerID, args.IfName), mirror); err != nil {
+				return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q mirror does not match", args.IfName), err.Error())
+			}
+		}
+
+		if (netConf.IPAM.Type == "" && len(netConf.RuntimeConfig.IPs) == 0) || netConf.IPAMReportOnly {
+			return nil
+		}
+
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, macvtapIPs); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q addresses do not match", args.IfName), err.Error())
+		}
+		if err := ip.ValidateExpectedRoute(result.Routes); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q routes do not match", args.IfName), err.Error())
+		}
+		return nil
+	})
+}
+
+// checkLowerDeviceMirror verifies the mirror of the macvtap from its lower
+// device, the parent of the macvtap in the current netns.
+func checkLowerDeviceMirror(args *skel.CmdArgs, macvtapInterface *current.Interface, mirror *util.Mirror, netns ns.NetNS) error {
+	mac, err := net.ParseMAC(macvtapInterface.Mac)
+	if err != nil {
+		return err
+	}
+
+	var parentIndex int
+	if err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup device %q: %v", args.IfName, err)
+		}
+		parentIndex = link.Attrs().ParentIndex
+		return nil
+	}); err != nil {
+		return err
+	}
+	parent, err := netlink.LinkByIndex(parentIndex)
+	if err != nil {
+		return fmt.Errorf("failed to lookup lower device of %q: %v", args.IfName, err)
+	}
+
+	return util.CheckLowerDeviceMirror(parent.Attrs().Name, util.MirrorInterfaceName(args.ContainerID, args.IfName), mac, mirror)
+}
+
+// validateMacvtapInterface checks, from within the pod netns, that the
+// macvtap interface is still configured as it was on ADD.
+func validateMacvtapInterface(ifName string, iface *current.Interface, mac *net.HardwareAddr, onStandby bool, tapAccess *util.TapAccess, spoofCheck *util.SpoofCheck, netConf NetConf) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("failed to lookup interface %q", ifName), err.Error())
+	}
+
+	if link.Type() != "macvtap" {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q is of type %q, expected macvtap", ifName, link.Type()), "")
+	}
+
+	expectedMac := iface.Mac
+	if mac != nil {
+		expectedMac = mac.String()
+	}
+	// on standby, the MAC may still be used by the source of the migration
+	// on the same lower device until activation
+	if expectedMac != "" && link.Attrs().HardwareAddr.String() != expectedMac && !onStandby {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q has MAC %s, expected %s", ifName, link.Attrs().HardwareAddr, expectedMac), "")
+	}
+
+	if mtu := getMTU(netConf); mtu != 0 && link.Attrs().MTU != mtu {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q has MTU %d, expected %d", ifName, link.Attrs().MTU, mtu), "")
+	}
+
+	if isPromiscuous := link.Attrs().Promisc == 1; isPromiscuous != netConf.IsPromiscuous {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q has promiscuous mode %t, expected %t", ifName, isPromiscuous, netConf.IsPromiscuous), "")
+	}
+
+	if bandwidth := getBandwidth(netConf); bandwidth != nil {
+		if err := util.CheckBandwidth(ifName, bandwidth); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q bandwidth limits do not match", ifName), err.Error())
+		}
+	}
+
+	if spoofCheck != nil {
+		if err := util.CheckSpoofCheck(ifName, spoofCheck); err != nil {
+			return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q spoof check does not match", ifName), err.Error())
+		}
+	}
+
+	if err := tapAccess.Check(util.TapDevicePath(link.Attrs().Index)); err != nil {
+		return types.NewError(ErrCheckFailed, fmt.Sprintf("interface %q tap device access does not match", ifName), err.Error())
+	}
+
+	return nil
+}
+
+// CmdGC - CNI plugin Interface
+func CmdGC(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	_ = setupLogging("GC", netConf, args)
+
+	// GC is not to fail over a setting that ADD would have refused
+	gracePeriod, err := getAllocationGracePeriod(netConf)
+	if err != nil {
+		slog.Warn("invalid allocation grace period, using the default", "error", err)
+		gracePeriod = DefaultAllocationGracePeriod
+	}
+
+	validAttachments := make(map[types.GCAttachment]bool)
+	for _, attachment := range netConf.ValidAttachments {
+		validAttachments[attachment] = true
+	}
+
+	// An interrupted dump still lists most links, the rest are left for the
+	// next collection.
+	links, err := netlink.LinkList()
+	if err != nil && !errors.Is(err, netlink.ErrDumpInterrupted) {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+
+	// Only macvtaps claimed by an attachment of this network, or allocated
+	// and never claimed, are up for collection. The latter are left alone
+	// while the device plugin reports them as allocated, as their pod may
+	// take long before its ADD, and are given some time to be claimed.
+	var errs []error
+	for _, link := range links {
+		owner, ok := util.GetLinkOwner(link)
+		if !ok || link.Type() != "macvtap" {
+			continue
+		}
+
+		if owner.IsAttached() {
+			attachment := types.GCAttachment{ContainerID: owner.ContainerID, IfName: owner.IfName}
+			if owner.Network != netConf.Name || validAttachments[attachment] {
+				continue
+			}
+		} else {
+			if time.Since(owner.AllocatedAt) < gracePeriod {
+				continue
+			}
+			allocated, err := util.IsAllocated(util.DefaultAllocationDir, link.Attrs().Name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if allocated {
+				continue
+			}
+		}
+
+		if err := util.LinkDelete(link.Attrs().Name); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete stale macvtap %q: %v", link.Attrs().Name, err))
+		}
+	}
+
+	// Attachments that are no longer valid may have left their macvtap in a
+	// netns that is still around.
+	cache := util.NewAttachmentCache(netConf.CacheDir)
+	attachments, err := cache.List(netConf.Name)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, attachment := range attachments {
+		if validAttachments[types.GCAttachment{ContainerID: attachment.ContainerID, IfName: attachment.IfName}] {
+			continue
+		}
+		if err := collectAttachment(netConf, attachment); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := cache.Delete(attachment.Network, attachment.ContainerID, attachment.IfName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if netConf.IPAM.Type != "" {
+		if err := invoke.DelegateGC(context.TODO(), netConf.IPAM.Type, args.StdinData, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// collectAttachment tears down what the ADD of an attachment that is no
+// longer valid left behind, as DEL would have: its BPF map entries, standby
+// record, device information file, mirror, macvtap and the lease of its MAC.
+func collectAttachment(netConf NetConf, attachment *util.Attachment) error {
+	if err := removeFromBPFMaps(netConf, attachment); err != nil {
+		return err
+	}
+	if err := util.DeleteStandby(util.DefaultStandbyDir, attachment.ContainerID, attachment.IfName); err != nil {
+		return err
+	}
+	// the records of older ADDs don't tell the device information file
+	deviceInfoPath := attachment.DeviceInfoFile
+	if deviceInfoPath == "" {
+		deviceInfoPath = util.DeviceInfoPathForCNI(attachment.Network, attachment.ContainerID, attachment.IfName)
+	}
+	if err := util.CleanDeviceInfo(deviceInfoPath); err != nil {
+		return err
+	}
+	if err := util.RemoveLowerDeviceMirror(attachment.LowerDevice, util.MirrorInterfaceName(attachment.ContainerID, attachment.IfName)); err != nil {
+		return err
+	}
+	if err := deleteMacvtap(attachment.NetNsPath, attachment.IfName, nil, attachment); err != nil {
+		return fmt.Errorf("failed to delete stale macvtap %q: %v", attachment.IfName, err)
+	}
+	if attachment.MACPool != nil {
+		return attachment.MACPool.Release(util.DefaultMACPoolDir, attachment.MACPoolKey, attachment.ContainerID)
+	}
+	return nil
+}
+
+// CmdStatus - CNI plugin Interface
+func CmdStatus(args *skel.CmdArgs) error {
+	netConf, _, err := loadConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	_ = setupLogging("STATUS", netConf, args)
+
+	for _, lowerDevice := range []string{netConf.LowerDevice, netConf.Master} {
+		if lowerDevice == "" {
+			continue
+		}
+		exists, err := util.LinkExists(lowerDevice)
+		if err != nil {
+			return types.NewError(ErrPluginNotAvailable, fmt.Sprintf("failed to lookup lower device %q", lowerDevice), err.Error())
+		}
+		if !exists {
+			return types.NewError(ErrPluginNotAvailable, fmt.Sprintf("lower device %q not found", lowerDevice), "")
+		}
+	}
+
+	if netConf.IPAM.Type != "" {
+		if err := ipam.ExecStatus(netConf.IPAM.Type, args.StdinData); err != nil {
+			return err
+		}
+	}
 
-// CmdCheck - CNI plugin Interface
-func CmdCheck(args *skel.CmdArgs) error {
 	return nil
 }
@@ -1,16 +1,27 @@
 package cni_test
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/kubevirt/macvtap-cni/pkg/cni"
 	"github.com/kubevirt/macvtap-cni/pkg/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const LOWER_DEVICE = "eth0"
@@ -50,7 +61,7 @@ var _ = Describe("Macvtap CNI", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				// create macvtap on top of lower device
-				_, err = util.CreateMacvtap(tempIfaceName, LOWER_DEVICE, "bridge")
+				_, err = util.CreateMacvtap(tempIfaceName, LOWER_DEVICE, "bridge", nil, nil)
 				Expect(err).NotTo(HaveOccurred())
 
 				// cache the macvtap interface
@@ -134,13 +145,58 @@ var _ = Describe("Macvtap CNI", func() {
 					return nil
 				})
 			})
+
+			It("SHOULD remove the macvtap interface despite unknown configuration parameters", func() {
+				args.StdinData = []byte(fmt.Sprintf(`{
+					"cniVersion": "0.3.1",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"settingFromANewerPlugin": true
+				}`, deviceID))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = netlink.LinkByName(macvtapIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the macvtap interface despite an invalid logging configuration", func() {
+				args.StdinData = []byte(fmt.Sprintf(`{
+					"cniVersion": "0.3.1",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"logLevel": "verbose"
+				}`, deviceID))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					_, err = netlink.LinkByName(macvtapIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
 		})
 
 		Context("WHEN importing a macvtap interface into the target netns with MAC address configuration", func() {
 			const macAddress = "0a:59:00:dc:6a:e0"
+			var args *skel.CmdArgs
 
 			BeforeEach(func() {
-				args := &skel.CmdArgs{
+				args = &skel.CmdArgs{
 					ContainerID: "dummy",
 					Netns:       targetNs.Path(),
 					IfName:      macvtapIfaceName,
@@ -169,6 +225,182 @@ var _ = Describe("Macvtap CNI", func() {
 					return nil
 				})
 			})
+
+			It("SHOULD reconcile the macvtap interface when the ADD is retried", func() {
+				var ifIndex int
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					ifIndex = link.Attrs().Index
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					result, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					r, err := current.GetResult(result)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(r.Interfaces).To(HaveLen(1))
+					Expect(r.Interfaces[0].Mac).To(Equal(macAddress))
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().Index).To(Equal(ifIndex))
+
+					return nil
+				})
+			})
+
+			It("SHOULD not take over a macvtap requested with another MAC address", func() {
+				retryArgs := *args
+				retryArgs.Args = "MAC=0a:59:00:dc:6a:e1"
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(retryArgs.Netns, retryArgs.ContainerID, retryArgs.IfName, retryArgs.StdinData, func() error { return cni.CmdAdd(&retryArgs) })
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		Context("WHEN the pod netns has an interface of its own with the requested name", func() {
+			BeforeEach(func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					lowerDevice, err := netlink.LinkByName(LOWER_DEVICE)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = netlink.LinkAdd(&netlink.Macvlan{
+						LinkAttrs: netlink.LinkAttrs{
+							Name:        macvtapIfaceName,
+							ParentIndex: lowerDevice.Attrs().Index,
+							Namespace:   netlink.NsFd(int(targetNs.Fd())),
+						},
+						Mode: netlink.MACVLAN_MODE_BRIDGE,
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD fail without deleting that interface", func() {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Type()).To(Equal("macvlan"))
+
+					return nil
+				})
+			})
+		})
+
+		Context("WHEN the requested MAC address is in use by another macvtap of the lower device", func() {
+			const macAddress = "0a:59:00:dc:6a:e1"
+
+			BeforeEach(func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					lowerDevice, err := netlink.LinkByName(LOWER_DEVICE)
+					Expect(err).NotTo(HaveOccurred())
+					mac, err := net.ParseMAC(macAddress)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = netlink.LinkAdd(&netlink.Macvtap{
+						Macvlan: netlink.Macvlan{
+							LinkAttrs: netlink.LinkAttrs{
+								Name:         "conflict0",
+								ParentIndex:  lowerDevice.Attrs().Index,
+								HardwareAddr: mac,
+							},
+							Mode: netlink.MACVLAN_MODE_BRIDGE,
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			AfterEach(func() {
+				originalNS.Do(func(ns.NetNS) error {
+					return util.LinkDelete("conflict0")
+				})
+			})
+
+			It("SHOULD reject the attachment", func() {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+					Args:        fmt.Sprintf("MAC=%s", macAddress),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*types.Error).Code).To(Equal(cni.ErrDuplicateMAC))
+
+					return nil
+				})
+			})
+
+			It("SHOULD accept the attachment when duplicates are explicitly allowed", func() {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(stdInArgs),
+					Args:        fmt.Sprintf("MAC=%s;AllowDuplicateMAC=true", macAddress),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
 		})
 
 		Context("WHEN importing a macvtap interface into the target netns with link MTU configuration", func() {
@@ -253,5 +485,1845 @@ var _ = Describe("Macvtap CNI", func() {
 				})
 			})
 		})
+
+		for _, cniVersion := range version.All.SupportedVersions() {
+			cniVersion := cniVersion
+
+			It(fmt.Sprintf("SHOULD negotiate CNI version %s", cniVersion), func() {
+				conf := fmt.Sprintf(`{
+				"cniVersion": "%s",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s"
+			}`, cniVersion, deviceID)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					if ok, _ := version.GreaterThanOrEqualTo(cniVersion, "0.3.0"); !ok {
+						Expect(err).To(HaveOccurred())
+						Expect(err.(*types.Error).Code).To(Equal(types.ErrIncompatibleCNIVersion))
+						return nil
+					}
+					Expect(err).NotTo(HaveOccurred())
+					Expect(r.Version()).To(Equal(cniVersion))
+
+					result, err := current.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Interfaces).To(HaveLen(1))
+					Expect(result.Interfaces[0].Name).To(Equal(macvtapIfaceName))
+					Expect(result.Interfaces[0].Sandbox).To(Equal(targetNs.Path()))
+
+					return nil
+				})
+			})
+		}
+
+		When("chained after another plugin", func() {
+			It("SHOULD add the macvtap interface to the previous result", func() {
+				conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"prevResult": {
+					"cniVersion": "1.0.0",
+					"interfaces": [{"name": "eth0", "sandbox": "%s"}],
+					"ips": [{"address": "10.1.0.5/24", "interface": 0}]
+				}
+			}`, deviceID, targetNs.Path())
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err := current.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Interfaces).To(HaveLen(2))
+					Expect(result.Interfaces[0].Name).To(Equal("eth0"))
+					Expect(result.Interfaces[1].Name).To(Equal(macvtapIfaceName))
+					Expect(result.IPs).To(HaveLen(1))
+					Expect(*result.IPs[0].Interface).To(Equal(0))
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with capabilities passed through runtimeConfig", func() {
+			const (
+				argsMacAddress    = "0a:59:00:dc:6a:e0"
+				runtimeMacAddress = "0a:59:00:dc:6a:e1"
+				runtimeMTU        = 1400
+				runtimeIP         = "10.10.0.5/24"
+			)
+			var result *current.Result
+
+			BeforeEach(func() {
+				runtimeConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"mtu": 1000,
+				"ipamReportOnly": true,
+				"capabilities": {"mac": true, "mtu": true, "ips": true},
+				"runtimeConfig": {
+					"mac": "%s",
+					"mtu": %d,
+					"ips": ["%s"]
+				}
+			}`, deviceID, runtimeMacAddress, runtimeMTU, runtimeIP)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(runtimeConf),
+					Args:        fmt.Sprintf("MAC=%s", argsMacAddress),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err = current.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD prefer the runtimeConfig MAC address over CNI_ARGS", func() {
+				Expect(result.Interfaces[0].Mac).To(Equal(runtimeMacAddress))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().HardwareAddr.String()).To(Equal(runtimeMacAddress))
+
+					return nil
+				})
+			})
+
+			It("SHOULD prefer the runtimeConfig MTU over the network configuration", func() {
+				Expect(result.Interfaces[0].Mtu).To(Equal(runtimeMTU))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().MTU).To(Equal(runtimeMTU))
+
+					return nil
+				})
+			})
+
+			It("SHOULD report the runtimeConfig addresses", func() {
+				Expect(result.IPs).To(HaveLen(1))
+				Expect(result.IPs[0].Address.String()).To(Equal(runtimeIP))
+				Expect(*result.IPs[0].Interface).To(Equal(0))
+			})
+		})
+
+		When("importing a macvtap interface with an IPAM configuration", func() {
+			const (
+				ipamIP  = "10.10.0.5/24"
+				gateway = "10.10.0.1"
+			)
+			var ipamConf string
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				ipamConf = fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"ipam": {
+					"type": "%%s",
+					"addresses": [{"address": "%s", "gateway": "%s"}],
+					"routes": [{"dst": "0.0.0.0/0"}]
+				}
+				%%s
+			}`, deviceID, ipamIP, gateway)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(fmt.Sprintf(ipamConf, "static", "")),
+				}
+			})
+
+			It("SHOULD configure the allocated addresses and release them on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					r, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err := current.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.IPs).To(HaveLen(1))
+					Expect(result.IPs[0].Address.String()).To(Equal(ipamIP))
+					Expect(*result.IPs[0].Interface).To(Equal(0))
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+
+					addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(addrs).To(HaveLen(1))
+					Expect(addrs[0].IPNet.String()).To(Equal(ipamIP))
+
+					routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(routes).To(ContainElement(WithTransform(func(r netlink.Route) string {
+						return r.Gw.String()
+					}, Equal(gateway))))
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD release the allocated addresses when a later step fails", func() {
+				// Record the commands the IPAM plugin is run with
+				calls := filepath.Join(cniPath, "recording-calls")
+				defer os.Remove(calls)
+				script := fmt.Sprintf("#!/bin/sh\necho $CNI_COMMAND >> %s\nexec %s\n", calls, filepath.Join(cniPath, "static"))
+				recorder := filepath.Join(cniPath, "recording")
+				Expect(os.WriteFile(recorder, []byte(script), 0755)).To(Succeed())
+				defer os.Remove(recorder)
+
+				args.StdinData = []byte(fmt.Sprintf(ipamConf, "recording", `, "mirror": {"device": "missing0"}`))
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+
+				recorded, err := os.ReadFile(calls)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(recorded)).To(Equal("ADD\nDEL\n"))
+			})
+		})
+
+		When("importing a macvtap interface with tuning settings", func() {
+			const txQueueLen = 42
+
+			BeforeEach(func() {
+				tuningConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"tuning": {
+					"txQueueLen": %d,
+					"addrGenMode": "none",
+					"sysctls": {"net.ipv6.conf.IFNAME.accept_ra": "0"}
+				}
+			}`, deviceID, txQueueLen)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(tuningConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD apply the tuning settings to the macvtap interface", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().TxQLen).To(Equal(txQueueLen))
+
+					addrGenMode, err := sysctl.Sysctl(fmt.Sprintf("net.ipv6.conf.%s.addr_gen_mode", macvtapIfaceName))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(addrGenMode).To(Equal("1"))
+
+					acceptRA, err := sysctl.Sysctl(fmt.Sprintf("net.ipv6.conf.%s.accept_ra", macvtapIfaceName))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(acceptRA).To(Equal("0"))
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with tap access settings overridden by the runtime", func() {
+			It("SHOULD grant the access of the runtime settings over the configured ones", func() {
+				conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"capabilities": {"tapAccess": true},
+				"tapAccess": {"user": "1001", "mode": "0600"},
+				"runtimeConfig": {"tapAccess": {"user": "1000", "mode": "0660"}}
+			}`, deviceID)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+
+					var stat unix.Stat_t
+					Expect(unix.Stat(util.TapDevicePath(link.Attrs().Index), &stat)).To(Succeed())
+					Expect(stat.Uid).To(Equal(uint32(1000)))
+					Expect(stat.Gid).To(Equal(uint32(107)))
+					Expect(stat.Mode & 0777).To(Equal(uint32(0660)))
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with an invalid configuration", func() {
+			addWith := func(conf string, cniArgs string) error {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+					Args:        cniArgs,
+				}
+
+				var addErr error
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, addErr = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+
+					exists, err := util.LinkExists(tempIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeTrue())
+
+					return nil
+				})
+				return addErr
+			}
+
+			It("SHOULD refuse it with a typed error before moving the macvtap interface", func() {
+				for _, conf := range []string{
+					`"lowerDevice": "eth1"`,
+					`"mode": "vepa"`,
+					`"mtu": -1`,
+					`"mtu": 65536`,
+					`"mtuu": 1500`,
+					`"tapAccess": {"user": "no-such-user"}`,
+					`"runtimeConfig": {"tapAccess": {"mode": "999"}}`,
+					`"runtimeConfig": {"tapAccess": {"acl": ["u:no-such-user:rw"]}}`,
+				} {
+					err := addWith(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "deviceID": "%s", %s}`, deviceID, conf), "")
+					Expect(err).To(HaveOccurred(), conf)
+					Expect(err.(*types.Error).Code).To(Equal(types.ErrInvalidNetworkConfig), conf)
+				}
+
+				err := addWith(stdInArgs, "MAC=0a:59:00")
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*types.Error).Code).To(Equal(types.ErrInvalidNetworkConfig))
+
+				// the tap access is only overridden by the runtime
+				for _, cniArgs := range []string{"TapUser=0", "TapMode=0666", "TapACL=u:0:rw"} {
+					err = addWith(stdInArgs, cniArgs)
+					Expect(err).To(HaveOccurred(), cniArgs)
+					Expect(err.(*types.Error).Code).To(Equal(types.ErrInvalidEnvironmentVariables), cniArgs)
+				}
+			})
+
+			It("SHOULD ask to try again later when the device is not there yet", func() {
+				conf := `{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "deviceID": "not-allocated"}`
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*types.Error).Code).To(Equal(types.ErrTryAgainLater))
+
+					return nil
+				})
+			})
+
+			It("SHOULD refuse an allocated macvtap in another mode or on another lower device", func() {
+				for conf, details := range map[string]string{
+					`"mode": "vepa"`:         fmt.Sprintf("device %s is in bridge mode, expected vepa mode", deviceID),
+					`"lowerDevice": "eth1"`:  fmt.Sprintf(`device %s is on lower device %q, expected "eth1"`, deviceID, LOWER_DEVICE),
+					`"mode": "passthru"`:     fmt.Sprintf("device %s is in bridge mode, expected passthru mode", deviceID),
+					`"lowerDevice": "bond0"`: fmt.Sprintf(`device %s is on lower device %q, expected "bond0"`, deviceID, LOWER_DEVICE),
+				} {
+					err := addWith(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "deviceID": "%s", %s}`, deviceID, conf), "")
+					Expect(err).To(HaveOccurred(), conf)
+					Expect(err.(*types.Error).Code).To(Equal(types.ErrInvalidNetworkConfig), conf)
+					Expect(err.(*types.Error).Details).To(Equal(details), conf)
+				}
+			})
+
+			It("SHOULD refuse an allocated device that is not a macvtap", func() {
+				const otherDeviceID = "dev501"
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(netlink.LinkAdd(&netlink.Macvlan{
+						LinkAttrs: netlink.LinkAttrs{
+							Name:        util.TemporaryInterfaceName(otherDeviceID),
+							ParentIndex: lowerDevice.Attrs().Index,
+						},
+						Mode: netlink.MACVLAN_MODE_BRIDGE,
+					})).To(Succeed())
+					return nil
+				})
+
+				err := addWith(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "deviceID": "%s"}`, otherDeviceID), "")
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*types.Error).Code).To(Equal(types.ErrInvalidNetworkConfig))
+				Expect(err.(*types.Error).Details).To(Equal(fmt.Sprintf(`device %s is of type "macvlan", not macvtap`, otherDeviceID)))
+			})
+
+			It("SHOULD accept an allocated macvtap in the expected mode and on the expected lower device", func() {
+				conf := fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "mynet", "type": "macvtap", "deviceID": "%s", "mode": "bridge", "lowerDevice": "%s"}`, deviceID, LOWER_DEVICE)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(conf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with invalid tuning settings", func() {
+			It("SHOULD fail before moving the macvtap interface", func() {
+				tuningConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"tuning": {"sysctls": {"net.core.somaxconn": "1024"}}
+			}`, deviceID)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(tuningConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					exists, err := util.LinkExists(tempIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeTrue())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with a device information file", func() {
+			var args *skel.CmdArgs
+			var deviceInfoFile string
+
+			BeforeEach(func() {
+				dir, err := os.MkdirTemp("", "devinfo")
+				Expect(err).NotTo(HaveOccurred())
+				deviceInfoFile = filepath.Join(dir, "mynet-dummy-macvtap0-device.json")
+
+				deviceInfoConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"CNIDeviceInfoFile": "%s"
+			}`, deviceID, deviceInfoFile)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(deviceInfoConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(filepath.Dir(deviceInfoFile))
+			})
+
+			It("SHOULD describe the tap device in the file", func() {
+				info, err := util.LoadDeviceInfo(deviceInfoFile)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Type).To(Equal(util.DeviceInfoTypeMacvtap))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(info.Macvtap).To(Equal(&util.MacvtapDeviceInfo{
+						TapPath:     util.TapDevicePath(link.Attrs().Index),
+						LowerDevice: LOWER_DEVICE,
+						Mode:        "bridge",
+						IfIndex:     link.Attrs().Index,
+						MAC:         link.Attrs().HardwareAddr.String(),
+					}))
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the file on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+				Expect(deviceInfoFile).NotTo(BeAnExistingFile())
+			})
+		})
+
+		When("deleting an attachment without a netns", func() {
+			var args *skel.CmdArgs
+			var cacheDir string
+
+			BeforeEach(func() {
+				var err error
+				cacheDir, err = os.MkdirTemp("", "attachments")
+				Expect(err).NotTo(HaveOccurred())
+
+				cacheConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"cacheDir": "%s"
+			}`, deviceID, cacheDir)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(cacheConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(cacheDir)
+			})
+
+			It("SHOULD remove the macvtap interface from the recorded netns", func() {
+				attachment, err := util.NewAttachmentCache(cacheDir).Load("mynet", args.ContainerID, args.IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(attachment).NotTo(BeNil())
+				Expect(attachment.NetNsPath).To(Equal(targetNs.Path()))
+				Expect(attachment.TempIfaceName).To(Equal(tempIfaceName))
+				Expect(attachment.LowerDevice).To(Equal(LOWER_DEVICE))
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					args.Netns = ""
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+
+				attachment, err = util.NewAttachmentCache(cacheDir).Load("mynet", args.ContainerID, args.IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(attachment).To(BeNil())
+			})
+		})
+
+		When("importing a macvtap interface with bandwidth limits", func() {
+			const (
+				ingressRate = 8000000
+				egressRate  = 16000000
+			)
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				bandwidthConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"capabilities": {"bandwidth": true},
+				"runtimeConfig": {
+					"bandwidth": {
+						"ingressRate": %d,
+						"ingressBurst": 80000,
+						"egressRate": %d,
+						"egressBurst": 160000
+					}
+				}
+			}`, deviceID, ingressRate, egressRate)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(bandwidthConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD shape the egress and police the ingress of the macvtap interface", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+
+					qdiscs, err := netlink.QdiscList(link)
+					Expect(err).NotTo(HaveOccurred())
+					var tbf *netlink.Tbf
+					for _, qdisc := range qdiscs {
+						if q, ok := qdisc.(*netlink.Tbf); ok {
+							tbf = q
+						}
+					}
+					Expect(tbf).NotTo(BeNil())
+					Expect(tbf.Rate).To(Equal(uint64(egressRate / 8)))
+
+					filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(filters).To(HaveLen(1))
+					Expect(filters[0]).To(BeAssignableToTypeOf(&netlink.MatchAll{}))
+
+					return util.CheckBandwidth(macvtapIfaceName, &util.BandwidthEntry{
+						IngressRate: ingressRate, IngressBurst: 80000, EgressRate: egressRate, EgressBurst: 160000,
+					})
+				})
+			})
+
+			It("SHOULD remove the limits on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with spoof checks", func() {
+			const (
+				macAddress = "0a:59:00:dc:6a:e0"
+				ipAddress  = "192.168.1.10"
+			)
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				spoofChkConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"spoofChk": true,
+				"ipSpoofChk": true,
+				"ipamReportOnly": true,
+				"capabilities": {"ips": true},
+				"runtimeConfig": {"ips": ["%s/24"]}
+			}`, deviceID, ipAddress)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(spoofChkConf),
+					Args:        fmt.Sprintf("MAC=%s", macAddress),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD only let through the frames sent from the assigned addresses", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					mac, err := net.ParseMAC(macAddress)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(util.CheckSpoofCheck(macvtapIfaceName, &util.SpoofCheck{
+						MAC: mac,
+						IPs: []net.IP{net.ParseIP(ipAddress)},
+					})).To(Succeed())
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the filters on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with guards", func() {
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				guardsConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"guards": ["dhcp", "ra"]
+			}`, deviceID)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(guardsConf),
+					Args:        "GuardExceptions=ra",
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD only install the guards without exception", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(util.CheckGuards(macvtapIfaceName, []string{util.GuardDHCP})).To(Succeed())
+					Expect(util.CheckGuards(macvtapIfaceName, []string{util.GuardRA})).NotTo(Succeed())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with BPF programs and maps", func() {
+			const (
+				macAddress = "0a:59:00:dc:6a:e1"
+				ipAddress  = "192.168.1.10"
+			)
+			var args *skel.CmdArgs
+			var bpfDir string
+			var macMap string
+			var ipMap string
+			var mac net.HardwareAddr
+			var ifIndex int
+
+			bpfConf := func(extra string) string {
+				return fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"ipamReportOnly": true,
+				"capabilities": {"ips": true},
+				"runtimeConfig": {"ips": ["%s/24"]},
+				"bpf": {"egress": "%s", "macMap": "%s", "ipMap": "%s"}%s
+			}`, deviceID, ipAddress, filepath.Join(bpfDir, "egress"), macMap, ipMap, extra)
+			}
+
+			check := func() error {
+				var err error
+				originalNS.Do(func(ns.NetNS) error {
+					err = testutils.CmdCheck(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdCheck(args) })
+					return nil
+				})
+				return err
+			}
+
+			BeforeEach(func() {
+				var err error
+				bpfDir, err = os.MkdirTemp("", "bpffs")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(unix.Mount("bpf", bpfDir, "bpf", 0, "")).To(Succeed())
+
+				macMap = filepath.Join(bpfDir, "macs")
+				ipMap = filepath.Join(bpfDir, "ips")
+				Expect(pinBPFProgram(filepath.Join(bpfDir, "egress"))).To(Succeed())
+				Expect(pinBPFMap(macMap, 6, 4)).To(Succeed())
+				Expect(pinBPFMap(ipMap, 16, 6)).To(Succeed())
+
+				mac, err = net.ParseMAC(macAddress)
+				Expect(err).NotTo(HaveOccurred())
+
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(bpfConf("")),
+					Args:        fmt.Sprintf("MAC=%s", macAddress),
+				}
+
+				var result types.Result
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					result, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				prevResult, err := json.Marshal(result)
+				Expect(err).NotTo(HaveOccurred())
+				args.StdinData = []byte(bpfConf(fmt.Sprintf(`, "prevResult": %s`, prevResult)))
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					ifIndex = link.Attrs().Index
+
+					return nil
+				})
+			})
+
+			AfterEach(func() {
+				Expect(unix.Unmount(bpfDir, 0)).To(Succeed())
+				os.RemoveAll(bpfDir)
+			})
+
+			It("SHOULD add the addresses of the interface to the maps and pass CHECK", func() {
+				value, err := lookupBPFMap(macMap, mac, 4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binary.NativeEndian.Uint32(value)).To(Equal(uint32(ifIndex)))
+
+				value, err = lookupBPFMap(ipMap, net.ParseIP(ipAddress).To16(), 6)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(net.HardwareAddr(value)).To(Equal(mac))
+
+				Expect(check()).To(Succeed())
+			})
+
+			It("SHOULD fail CHECK once the program is detached", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(util.DetachBPF(macvtapIfaceName)).To(Succeed())
+
+					return nil
+				})
+
+				err := check()
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*types.Error).Code).To(Equal(cni.ErrCheckFailed))
+			})
+
+			It("SHOULD fail CHECK once an entry is taken over by another interface", func() {
+				otherMAC, err := net.ParseMAC("0a:59:00:dc:6a:e2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(updateBPFMap(ipMap, net.ParseIP(ipAddress).To16(), otherMAC)).To(Succeed())
+
+				err = check()
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*types.Error).Code).To(Equal(cni.ErrCheckFailed))
+			})
+
+			It("SHOULD remove its entries on deletion, leaving those taken over alone", func() {
+				otherMAC, err := net.ParseMAC("0a:59:00:dc:6a:e2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(updateBPFMap(ipMap, net.ParseIP(ipAddress).To16(), otherMAC)).To(Succeed())
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				_, err = lookupBPFMap(macMap, mac, 4)
+				Expect(err).To(MatchError(unix.ENOENT))
+
+				value, err := lookupBPFMap(ipMap, net.ParseIP(ipAddress).To16(), 6)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(net.HardwareAddr(value)).To(Equal(otherMAC))
+			})
+		})
+
+		When("importing a macvtap interface with a mirror", func() {
+			const mirrorDevice = "mon0"
+			var args *skel.CmdArgs
+			mirrorName := util.MirrorInterfaceName("dummy", macvtapIfaceName)
+
+			BeforeEach(func() {
+				mirrorConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"mirror": {"device": "%s", "sampleRate": 10}
+			}`, deviceID, mirrorDevice)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(mirrorConf),
+					Args:        "MirrorDirection=egress",
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: mirrorDevice}})
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD mirror the requested direction to a monitoring macvlan of the device", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(util.CheckMirror(macvtapIfaceName, mirrorName, &util.Mirror{
+						Device: mirrorDevice, Direction: util.MirrorEgress, SampleRate: 10,
+					})).To(Succeed())
+					Expect(util.CheckMirror(macvtapIfaceName, mirrorName, &util.Mirror{
+						Device: mirrorDevice, Direction: util.MirrorIngress, SampleRate: 10,
+					})).NotTo(Succeed())
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the monitoring macvlan on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					exists, err := util.LinkExists(mirrorName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with a mirror from the lower device", func() {
+			const (
+				mirrorDevice = "mon0"
+				macAddress   = "0a:59:00:dc:6a:e3"
+			)
+			var args *skel.CmdArgs
+			var mac net.HardwareAddr
+			mirror := &util.Mirror{Device: mirrorDevice, FromLowerDevice: true}
+			mirrorName := util.MirrorInterfaceName("dummy", macvtapIfaceName)
+
+			BeforeEach(func() {
+				var err error
+				mac, err = net.ParseMAC(macAddress)
+				Expect(err).NotTo(HaveOccurred())
+
+				mirrorConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"mirror": {"device": "%s"}
+			}`, deviceID, mirrorDevice)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(mirrorConf),
+					Args:        fmt.Sprintf("MAC=%s;MirrorFromLowerDevice=true", macAddress),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: mirrorDevice}})
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD mirror from the lower device without a monitoring macvlan", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(util.CheckLowerDeviceMirror(LOWER_DEVICE, mirrorName, mac, mirror)).To(Succeed())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					exists, err := util.LinkExists(mirrorName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the mirror from the lower device on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(util.CheckLowerDeviceMirror(LOWER_DEVICE, mirrorName, mac, mirror)).NotTo(Succeed())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface as the target of a live migration", func() {
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				migrationConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s"
+			}`, deviceID)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(migrationConf),
+					Args:        "MigrationTarget=down",
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD leave the macvtap interface down until activated", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().Flags & net.FlagUp).To(BeZero())
+
+					return nil
+				})
+
+				standby, err := util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(standby).NotTo(BeNil())
+				Expect(standby.Mode).To(Equal(util.StandbyDown))
+
+				Expect(util.Activate(standby, originalNS.Path())).To(Succeed())
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().Flags & net.FlagUp).NotTo(BeZero())
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the standby record on deletion", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				Expect(util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)).To(BeNil())
+			})
+		})
+
+		When("importing a macvtap interface as the target of a live migration whose source is on the same lower device", func() {
+			const macAddress = "0a:59:00:dc:6a:e4"
+			const sourceIfaceName = "source0"
+			var args *skel.CmdArgs
+			var mac net.HardwareAddr
+
+			BeforeEach(func() {
+				var err error
+				mac, err = net.ParseMAC(macAddress)
+				Expect(err).NotTo(HaveOccurred())
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					lowerDevice, err := netlink.LinkByName(LOWER_DEVICE)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = netlink.LinkAdd(&netlink.Macvtap{
+						Macvlan: netlink.Macvlan{
+							LinkAttrs: netlink.LinkAttrs{
+								Name:         sourceIfaceName,
+								ParentIndex:  lowerDevice.Attrs().Index,
+								HardwareAddr: mac,
+							},
+							Mode: netlink.MACVLAN_MODE_BRIDGE,
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkSetUp(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: sourceIfaceName}})).To(Succeed())
+
+					return nil
+				})
+
+				migrationConf := `{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s"%s
+			}`
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(fmt.Sprintf(migrationConf, deviceID, "")),
+					Args:        fmt.Sprintf("MigrationTarget=down;MAC=%s", macAddress),
+				}
+
+				var result types.Result
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					result, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				prevResult, err := json.Marshal(result)
+				Expect(err).NotTo(HaveOccurred())
+				args.StdinData = []byte(fmt.Sprintf(migrationConf, deviceID, fmt.Sprintf(`, "prevResult": %s`, prevResult)))
+			})
+
+			AfterEach(func() {
+				originalNS.Do(func(ns.NetNS) error {
+					return util.LinkDelete(sourceIfaceName)
+				})
+			})
+
+			It("SHOULD take the MAC over from the source on activation", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdCheck(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdCheck(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				standby, err := util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(standby).NotTo(BeNil())
+				Expect(standby.MAC).To(Equal(macAddress))
+
+				// activated from another netns than the one of the
+				// lower device
+				Expect(util.Activate(standby, originalNS.Path())).To(Succeed())
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					source, err := netlink.LinkByName(sourceIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(source.Attrs().Flags & net.FlagUp).To(BeZero())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Attrs().HardwareAddr).To(Equal(mac))
+					Expect(link.Attrs().Flags & net.FlagUp).NotTo(BeZero())
+
+					return nil
+				})
+			})
+		})
+
+		When("importing a macvtap interface with a rate but no burst", func() {
+			It("SHOULD fail before moving the macvtap interface", func() {
+				bandwidthConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"bandwidth": {"egressRate": 1000000}
+			}`, deviceID)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(bandwidthConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					exists, err := util.LinkExists(tempIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeTrue())
+
+					return nil
+				})
+			})
+		})
+
+		When("creating the macvtap interface from a master, without a device plugin", func() {
+			const standaloneIfaceName = "standalone0"
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				standaloneConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"master": "%s",
+				"mode": "vepa"
+			}`, LOWER_DEVICE)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      standaloneIfaceName,
+					StdinData:   []byte(standaloneConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD create the macvtap interface in the target netns", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(standaloneIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(link.Type()).To(Equal("macvtap"))
+					Expect(link.(*netlink.Macvtap).Mode).To(Equal(netlink.MACVLAN_MODE_VEPA))
+
+					return nil
+				})
+			})
+
+			It("SHOULD remove the macvtap interface, once requested via CmdDel", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdDel(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdDel(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, err := netlink.LinkByName(standaloneIfaceName)
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
+
+		When("creating the macvtap interface from a master in source mode", func() {
+			const sourceIfaceName = "source0"
+			const sourceMAC = "02:00:00:00:00:01"
+
+			BeforeEach(func() {
+				sourceConf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"master": "%s",
+				"mode": "source",
+				"sourceMACs": ["%s"]
+			}`, LOWER_DEVICE, sourceMAC)
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      sourceIfaceName,
+					StdinData:   []byte(sourceConf),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD only allow the configured source MACs", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(sourceIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					macvtap := link.(*netlink.Macvtap)
+					Expect(macvtap.Mode).To(Equal(netlink.MACVLAN_MODE_SOURCE))
+					Expect(macvtap.MACAddrs).To(HaveLen(1))
+					Expect(macvtap.MACAddrs[0].String()).To(Equal(sourceMAC))
+
+					return nil
+				})
+			})
+		})
+
+		When("allocating the MAC of a macvtap interface from a MAC pool", func() {
+			// a single address, free again as soon as released
+			pool := &util.MACPool{
+				Name: "pooltest",
+				MACPoolConfig: util.MACPoolConfig{
+					Prefix:             "02:5a:00:00:00",
+					Start:              "01",
+					End:                "01",
+					ReleaseGracePeriod: "0s",
+				},
+			}
+
+			// allocatable tells whether the address of the pool is free
+			allocatable := func() bool {
+				_, err := pool.Allocate(util.DefaultMACPoolDir, "default/other/net1", "other")
+				if err != nil {
+					return false
+				}
+				Expect(pool.Release(util.DefaultMACPoolDir, "default/other/net1", "other")).To(Succeed())
+				return true
+			}
+
+			BeforeEach(func() {
+				Expect(util.SaveDeviceMACPool(util.DefaultMACPoolDir, deviceID, pool)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				Expect(util.SaveDeviceMACPool(util.DefaultMACPoolDir, deviceID, nil)).To(Succeed())
+				os.Remove(filepath.Join(util.DefaultMACPoolDir, pool.Name+".leases.json"))
+			})
+
+			It("SHOULD release the MAC when the ADD fails after allocating it", func() {
+				args := &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData: []byte(fmt.Sprintf(`{
+					"cniVersion": "1.0.0",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"lowerDevice": "other0"
+				}`, deviceID)),
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+
+				Expect(allocatable()).To(BeTrue())
+			})
+
+			It("SHOULD release the MAC and clean up after an attachment no longer valid on GC", func() {
+				bpfDir, err := os.MkdirTemp("", "bpffs")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(unix.Mount("bpf", bpfDir, "bpf", 0, "")).To(Succeed())
+				defer func() {
+					Expect(unix.Unmount(bpfDir, 0)).To(Succeed())
+					os.RemoveAll(bpfDir)
+				}()
+				macMap := filepath.Join(bpfDir, "macs")
+				Expect(pinBPFProgram(filepath.Join(bpfDir, "egress"))).To(Succeed())
+				Expect(pinBPFMap(macMap, 6, 4)).To(Succeed())
+
+				conf := fmt.Sprintf(`{
+					"cniVersion": "1.1.0",
+					"name": "mynet",
+					"type": "macvtap",
+					"deviceID": "%s",
+					"bpf": {"egress": "%s", "macMap": "%s"}
+					%%s
+				}`, deviceID, filepath.Join(bpfDir, "egress"), macMap)
+
+				// the device information file Multus asks for is not
+				// told to GC
+				deviceInfoDir, err := os.MkdirTemp("", "devinfo")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(deviceInfoDir)
+				deviceInfoPath := filepath.Join(deviceInfoDir, "net1-device.json")
+
+				args := &skel.CmdArgs{
+					ContainerID: "stale",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(fmt.Sprintf(conf, fmt.Sprintf(`, "CNIDeviceInfoFile": "%s"`, deviceInfoPath))),
+					Args:        "MigrationTarget=down",
+				}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					_, _, err := testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				mac := net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x01}
+				Expect(allocatable()).To(BeFalse())
+				Expect(lookupBPFMap(macMap, mac, 4)).NotTo(BeNil())
+				Expect(util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)).NotTo(BeNil())
+				Expect(deviceInfoPath).To(BeAnExistingFile())
+
+				gcArgs := &skel.CmdArgs{
+					StdinData: []byte(fmt.Sprintf(conf, fmt.Sprintf(`, "cni.dev/valid-attachments": [{"containerID": "dummy", "ifname": "%s"}]`, macvtapIfaceName))),
+				}
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(cni.CmdGC(gcArgs)).To(Succeed())
+
+					return nil
+				})
+
+				Expect(allocatable()).To(BeTrue())
+				_, err = lookupBPFMap(macMap, mac, 4)
+				Expect(err).To(MatchError(unix.ENOENT))
+				Expect(util.LoadStandby(util.DefaultStandbyDir, args.ContainerID, args.IfName)).To(BeNil())
+				Expect(deviceInfoPath).NotTo(BeAnExistingFile())
+
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					exists, err := util.LinkExists(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+
+					return nil
+				})
+			})
+		})
+
+		When("garbage collecting", func() {
+			gcConf := `{
+				"cniVersion": "1.1.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"cni.dev/valid-attachments": [{"containerID": "%s", "ifname": "%s"}]
+			}`
+
+			BeforeEach(func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					owner := util.LinkOwner{Network: "mynet", ContainerID: "stale", IfName: macvtapIfaceName}
+					Expect(util.SetLinkOwner(tempIfaceName, owner)).To(Succeed())
+
+					return nil
+				})
+			})
+
+			It("SHOULD delete macvtaps of attachments no longer valid", func() {
+				args := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(gcConf, "dummy", macvtapIfaceName))}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(cni.CmdGC(args)).To(Succeed())
+
+					exists, err := util.LinkExists(tempIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeFalse())
+
+					return nil
+				})
+			})
+
+			It("SHOULD keep macvtaps of valid attachments", func() {
+				args := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(gcConf, "stale", macvtapIfaceName))}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(cni.CmdGC(args)).To(Succeed())
+
+					exists, err := util.LinkExists(tempIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(exists).To(BeTrue())
+
+					return nil
+				})
+			})
+
+			Context("macvtaps allocated an hour ago and never claimed", func() {
+				BeforeEach(func() {
+					originalNS.Do(func(ns.NetNS) error {
+						defer GinkgoRecover()
+
+						owner := util.LinkOwner{AllocatedAt: time.Now().Add(-time.Hour)}
+						Expect(util.SetLinkOwner(tempIfaceName, owner)).To(Succeed())
+
+						return nil
+					})
+				})
+
+				collect := func(conf string) bool {
+					args := &skel.CmdArgs{StdinData: []byte(conf)}
+
+					var exists bool
+					originalNS.Do(func(ns.NetNS) error {
+						defer GinkgoRecover()
+
+						Expect(cni.CmdGC(args)).To(Succeed())
+
+						var err error
+						exists, err = util.LinkExists(tempIfaceName)
+						Expect(err).NotTo(HaveOccurred())
+
+						return nil
+					})
+					return !exists
+				}
+
+				It("SHOULD delete them once the grace period is over", func() {
+					Expect(collect(fmt.Sprintf(gcConf, "dummy", macvtapIfaceName))).To(BeTrue())
+				})
+
+				It("SHOULD keep them within the configured grace period", func() {
+					conf := `{
+						"cniVersion": "1.1.0",
+						"name": "mynet",
+						"type": "macvtap",
+						"allocationGracePeriod": "2h"
+					}`
+					Expect(collect(conf)).To(BeFalse())
+				})
+
+				It("SHOULD keep them while the device plugin reports them as allocated", func() {
+					Expect(util.SaveAllocation(util.DefaultAllocationDir, &util.Allocation{DeviceID: deviceID, AllocatedAt: time.Now().Add(-time.Hour)})).To(Succeed())
+					defer util.DeleteAllocation(util.DefaultAllocationDir, deviceID)
+
+					Expect(collect(fmt.Sprintf(gcConf, "dummy", macvtapIfaceName))).To(BeFalse())
+				})
+			})
+		})
+
+		When("reporting status", func() {
+			statusConf := `{
+				"cniVersion": "1.1.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"lowerDevice": "%s"
+			}`
+
+			It("SHOULD be ready while the lower device exists", func() {
+				args := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(statusConf, LOWER_DEVICE))}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(cni.CmdStatus(args)).To(Succeed())
+
+					return nil
+				})
+			})
+
+			It("SHOULD not be ready when the lower device is absent", func() {
+				args := &skel.CmdArgs{StdinData: []byte(fmt.Sprintf(statusConf, "absent0"))}
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := cni.CmdStatus(args)
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*types.Error).Code).To(Equal(cni.ErrPluginNotAvailable))
+
+					return nil
+				})
+			})
+		})
+
+		When("checking a macvtap interface imported into the target netns", func() {
+			var args *skel.CmdArgs
+
+			BeforeEach(func() {
+				addConf := fmt.Sprintf(`{
+				"cniVersion": "0.4.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"mtu": 1000
+			}`, deviceID)
+				args = &skel.CmdArgs{
+					ContainerID: "dummy",
+					Netns:       targetNs.Path(),
+					IfName:      macvtapIfaceName,
+					StdinData:   []byte(addConf),
+				}
+
+				var result types.Result
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					var err error
+					result, _, err = testutils.CmdAdd(args.Netns, args.ContainerID, args.IfName, args.StdinData, func() error { return cni.CmdAdd(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+
+				prevResult, err := json.Marshal(result)
+				Expect(err).NotTo(HaveOccurred())
+
+				args.StdinData = []byte(fmt.Sprintf(`{
+				"cniVersion": "0.4.0",
+				"name": "mynet",
+				"type": "macvtap",
+				"deviceID": "%s",
+				"mtu": 1000,
+				"prevResult": %s
+			}`, deviceID, prevResult))
+			})
+
+			It("SHOULD succeed while the interface matches its configuration", func() {
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdCheck(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdCheck(args) })
+					Expect(err).NotTo(HaveOccurred())
+
+					return nil
+				})
+			})
+
+			It("SHOULD fail once the interface MTU has changed", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					link, err := netlink.LinkByName(macvtapIfaceName)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(netlink.LinkSetMTU(link, 1200)).To(Succeed())
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdCheck(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdCheck(args) })
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*types.Error).Code).To(Equal(cni.ErrCheckFailed))
+
+					return nil
+				})
+			})
+
+			It("SHOULD fail once the interface is gone", func() {
+				targetNs.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					Expect(util.LinkDelete(macvtapIfaceName)).To(Succeed())
+
+					return nil
+				})
+
+				originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdCheck(args.Netns, args.ContainerID, args.IfName, func() error { return cni.CmdCheck(args) })
+					Expect(err).To(HaveOccurred())
+
+					return nil
+				})
+			})
+		})
 	})
 })
@@ -0,0 +1,103 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// activationRequest identifies the attachment on standby to activate, either
+// by container or by pod, along its interface name in the pod.
+type activationRequest struct {
+	ContainerID string `json:"containerID,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	IfName      string `json:"ifName"`
+}
+
+// matches tells whether the request identifies the attachment on standby.
+func (r activationRequest) matches(s *util.StandbyAttachment) bool {
+	if r.IfName != s.IfName {
+		return false
+	}
+	if r.ContainerID != "" {
+		return r.ContainerID == s.ContainerID
+	}
+	return r.Namespace == s.PodNamespace && r.Pod == s.PodName
+}
+
+// activationHandler serves the activation of the macvtaps on standby recorded
+// in a directory, once the migration of their VM switches over to them.
+type activationHandler struct {
+	standbyDir string
+	// netNsPath is the path to the network namespace of the lower devices.
+	netNsPath string
+	activate  func(s *util.StandbyAttachment, hostNsPath string) error
+	// activations are serialized, a migration only switches over once
+	lock sync.Mutex
+}
+
+func newActivationHandler(standbyDir string, netNsPath string, activate func(s *util.StandbyAttachment, hostNsPath string) error) *activationHandler {
+	return &activationHandler{
+		standbyDir: standbyDir,
+		netNsPath:  netNsPath,
+		activate:   activate,
+	}
+}
+
+func (h *activationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req activationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.IfName == "" || (req.ContainerID == "" && (req.Namespace == "" || req.Pod == "")) {
+		http.Error(w, "ifName along containerID, or namespace and pod, are required", http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	standby, err := util.ListStandby(h.standbyDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var found *util.StandbyAttachment
+	for _, s := range standby {
+		if req.matches(s) {
+			found = s
+			break
+		}
+	}
+	if found == nil {
+		http.Error(w, "no macvtap on standby for this attachment", http.StatusNotFound)
+		return
+	}
+
+	if err := h.activate(found, h.netNsPath); err != nil {
+		glog.Errorf("Error activating macvtap %q of container %s: %v", found.IfName, found.ContainerID, err)
+		http.Error(w, fmt.Sprintf("failed to activate: %v", err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Activated macvtap %q of container %s", found.IfName, found.ContainerID)
+
+	// The macvtap is in service, a later request has nothing to activate
+	if err := util.DeleteStandby(h.standbyDir, found.ContainerID, found.IfName); err != nil {
+		glog.Warningf("Error removing standby record: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(found)
+}
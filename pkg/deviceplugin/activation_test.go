@@ -0,0 +1,72 @@
+package deviceplugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Activation API", func() {
+	var dir string
+	var activated []*util.StandbyAttachment
+	var handler *activationHandler
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "standby")
+		Expect(err).NotTo(HaveOccurred())
+
+		activated = nil
+		handler = newActivationHandler(dir, "/proc/1/ns/net", func(s *util.StandbyAttachment, hostNsPath string) error {
+			Expect(hostNsPath).To(Equal("/proc/1/ns/net"))
+			activated = append(activated, s)
+			return nil
+		})
+
+		Expect(util.SaveStandby(dir, &util.StandbyAttachment{
+			Network:      "dataplane",
+			ContainerID:  "c1",
+			IfName:       "net1",
+			PodNamespace: "default",
+			PodName:      "virt-launcher-vm-target",
+			Mode:         util.StandbyDown,
+			MAC:          "02:5a:00:00:00:01",
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	post := func(body string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/activate", strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	It("activates the attachment of a pod once", func() {
+		Expect(post(`{"namespace": "default", "pod": "virt-launcher-vm-target", "ifName": "net1"}`)).To(Equal(http.StatusOK))
+		Expect(activated).To(HaveLen(1))
+		Expect(activated[0].ContainerID).To(Equal("c1"))
+
+		Expect(post(`{"containerID": "c1", "ifName": "net1"}`)).To(Equal(http.StatusNotFound))
+		Expect(activated).To(HaveLen(1))
+	})
+
+	It("refuses incomplete requests", func() {
+		Expect(post(`{"containerID": "c1"}`)).To(Equal(http.StatusBadRequest))
+		Expect(post(`{"namespace": "default", "ifName": "net1"}`)).To(Equal(http.StatusBadRequest))
+		Expect(post(`not json`)).To(Equal(http.StatusBadRequest))
+		Expect(activated).To(BeEmpty())
+	})
+
+	It("does not activate other attachments", func() {
+		Expect(post(`{"containerID": "c1", "ifName": "net2"}`)).To(Equal(http.StatusNotFound))
+		Expect(activated).To(BeEmpty())
+	})
+})
@@ -0,0 +1,138 @@
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+const (
+	// DefaultPodResourcesSocket is the socket of the kubelet pod resources
+	// API by default.
+	DefaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	allocationTrackerInterval = 30 * time.Second
+	podResourcesTimeout       = 10 * time.Second
+	// allocationSettleTime leaves the kubelet time to report a device it
+	// just had allocated as assigned to its pod.
+	allocationSettleTime = time.Minute
+)
+
+// AllocationTracker removes the records and the device information files of
+// the macvtaps allocated by the device plugin once the kubelet no longer
+// assigns their devices to a pod, as there is no deallocation call. Until
+// then, GC leaves the macvtaps alone even if the ADD of their pod is long in
+// coming, e.g. waiting on its volumes.
+type AllocationTracker struct {
+	// AllocationDir is where the allocations are recorded.
+	AllocationDir string
+
+	// listAssigned returns the devices of the macvtap resources assigned to
+	// pods, by resource and device ID.
+	listAssigned func() (map[string]bool, error)
+	// deviceInfoPath returns the path of the device information file of a
+	// device.
+	deviceInfoPath func(resource string, deviceID string) string
+}
+
+func NewAllocationTracker(podResourcesSocket string) *AllocationTracker {
+	return &AllocationTracker{
+		AllocationDir: util.DefaultAllocationDir,
+		listAssigned: func() (map[string]bool, error) {
+			return listAssignedDevices(podResourcesSocket)
+		},
+		deviceInfoPath: util.DeviceInfoPathForDP,
+	}
+}
+
+// Run tracks the allocations until stop is closed.
+func (t *AllocationTracker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(allocationTrackerInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.refresh(time.Now()); err != nil {
+			glog.Warningf("Error tracking the allocated macvtaps: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refresh removes the records and the device information files of the
+// allocations whose devices are no longer assigned to a pod.
+func (t *AllocationTracker) refresh(now time.Time) error {
+	allocations, err := util.ListAllocations(t.AllocationDir)
+	if err != nil {
+		return err
+	}
+	if len(allocations) == 0 {
+		return nil
+	}
+
+	assigned, err := t.listAssigned()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range allocations {
+		if assigned[allocatedDeviceKey(a.Resource, a.DeviceID)] || now.Sub(a.AllocatedAt) < allocationSettleTime {
+			continue
+		}
+		glog.V(3).Infof("Device %s of %s is no longer allocated", a.DeviceID, a.Resource)
+		if err := util.CleanDeviceInfo(t.deviceInfoPath(a.Resource, a.DeviceID)); err != nil {
+			glog.Warningf("Error removing device info file: %v", err)
+		}
+		if err := util.DeleteAllocation(t.AllocationDir, a.DeviceID); err != nil {
+			glog.Warningf("Error removing allocation record: %v", err)
+		}
+	}
+	return nil
+}
+
+func allocatedDeviceKey(resource string, deviceID string) string {
+	return resource + "/" + deviceID
+}
+
+// listAssignedDevices returns the devices of the macvtap resources the
+// kubelet assigns to pods, as told by its pod resources API.
+func listAssignedDevices(socket string) (map[string]bool, error) {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the pod resources API: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), podResourcesTimeout)
+	defer cancel()
+	response, err := podresourcesapi.NewPodResourcesListerClient(conn).List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pod resources: %v", err)
+	}
+
+	assigned := map[string]bool{}
+	for _, pod := range response.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				if !strings.HasPrefix(devices.GetResourceName(), resourceNamespace+"/") {
+					continue
+				}
+				for _, deviceID := range devices.GetDeviceIds() {
+					assigned[allocatedDeviceKey(devices.GetResourceName(), deviceID)] = true
+				}
+			}
+		}
+	}
+	return assigned, nil
+}
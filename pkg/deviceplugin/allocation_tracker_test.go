@@ -0,0 +1,88 @@
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Allocation tracker", func() {
+	const resource = "macvtap.network.kubevirt.io/dataplane"
+	var dir string
+	var infoDir string
+	var tracker *AllocationTracker
+	var assigned map[string]bool
+
+	now := time.Now()
+
+	allocated := func(deviceID string) bool {
+		ok, err := util.IsAllocated(dir, util.TemporaryInterfaceName(deviceID))
+		Expect(err).NotTo(HaveOccurred())
+		return ok
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "allocated")
+		Expect(err).NotTo(HaveOccurred())
+		infoDir, err = os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+
+		assigned = map[string]bool{}
+		tracker = NewAllocationTracker("")
+		tracker.AllocationDir = dir
+		tracker.listAssigned = func() (map[string]bool, error) {
+			return assigned, nil
+		}
+		tracker.deviceInfoPath = func(resource string, deviceID string) string {
+			return filepath.Join(infoDir, deviceID+"-device.json")
+		}
+
+		for _, deviceID := range []string{"dataplaneMvp0", "dataplaneMvp1"} {
+			Expect(util.SaveAllocation(dir, &util.Allocation{
+				Resource:    resource,
+				DeviceID:    deviceID,
+				AllocatedAt: now.Add(-time.Hour),
+			})).To(Succeed())
+			Expect(util.SaveDeviceInfo(tracker.deviceInfoPath(resource, deviceID), &util.DeviceInfo{
+				Type:    util.DeviceInfoTypeMacvtap,
+				Version: util.DeviceInfoVersion,
+				Macvtap: &util.MacvtapDeviceInfo{LowerDevice: "eth0"},
+			})).To(Succeed())
+		}
+		Expect(util.SaveAllocation(dir, &util.Allocation{
+			Resource:    resource,
+			DeviceID:    "dataplaneMvp2",
+			AllocatedAt: now,
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(infoDir)
+	})
+
+	It("keeps the devices still assigned to pods", func() {
+		assigned[allocatedDeviceKey(resource, "dataplaneMvp0")] = true
+
+		Expect(tracker.refresh(now)).To(Succeed())
+		Expect(allocated("dataplaneMvp0")).To(BeTrue())
+		Expect(allocated("dataplaneMvp1")).To(BeFalse())
+
+		// the device information files go along
+		Expect(tracker.deviceInfoPath(resource, "dataplaneMvp0")).To(BeAnExistingFile())
+		Expect(tracker.deviceInfoPath(resource, "dataplaneMvp1")).NotTo(BeAnExistingFile())
+	})
+
+	It("leaves the kubelet time to report the devices just allocated", func() {
+		Expect(tracker.refresh(now)).To(Succeed())
+		Expect(allocated("dataplaneMvp2")).To(BeTrue())
+
+		Expect(tracker.refresh(now.Add(allocationSettleTime))).To(Succeed())
+		Expect(allocated("dataplaneMvp2")).To(BeFalse())
+	})
+})
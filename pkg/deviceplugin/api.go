@@ -0,0 +1,47 @@
+package deviceplugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// DefaultAPISocket is the unix socket the node API is served on by default.
+const DefaultAPISocket = "/var/run/macvtap-cni/api.sock"
+
+// ServeAPI serves the node API on the unix socket at socketPath, accessible
+// to root only:
+//   - POST /v1/activate with the containerID, or the namespace and pod, and
+//     the ifName of an attachment on standby brings its macvtap into service
+//     and announces its addresses.
+//   - GET /v1/ips returns the addresses learned by the learner, if any.
+//
+// The lower devices are looked up in the network namespace at netNsPath.
+func ServeAPI(socketPath string, netNsPath string, learner *IPLearner) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %v", socketPath, err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict access to %s: %v", socketPath, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/activate", newActivationHandler(util.DefaultStandbyDir, netNsPath, util.Activate))
+	if learner != nil {
+		mux.Handle("/v1/ips", learner)
+	}
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,375 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+const (
+	// DefaultLearnedIPTTL is how long a learned address is kept by default
+	// without being seen again.
+	DefaultLearnedIPTTL = 10 * time.Minute
+
+	ipLearnerRefreshInterval = 10 * time.Second
+	snifferTimeout           = time.Second
+)
+
+// LearnedIP is an address the consumer of a macvtap was seen using.
+type LearnedIP struct {
+	IP        string    `json:"ip"`
+	Source    string    `json:"source"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LearnedAttachment holds the addresses learned for the macvtap of an
+// attachment of the node.
+type LearnedAttachment struct {
+	MAC            string      `json:"mac"`
+	LowerDevice    string      `json:"lowerDevice"`
+	DeviceInfoFile string      `json:"deviceInfoFile"`
+	IPs            []LearnedIP `json:"ips"`
+}
+
+// macvtapAttachment is a macvtap of the node, as described by the device
+// information file of its attachment.
+type macvtapAttachment struct {
+	mac            string
+	lowerDevice    string
+	deviceInfoFile string
+	publishedIPs   []string
+}
+
+// IPLearner learns the addresses the consumers of the macvtaps of the node
+// use from the traffic of their lower devices, as guests get them from DHCP
+// servers or SLAAC on their own. The macvtaps are found from the device
+// information files of their attachments, which the learned addresses are
+// published to.
+type IPLearner struct {
+	// TTL is how long an address is kept without being seen again, or for
+	// the lease time granted by a DHCP server if longer.
+	TTL time.Duration
+	// DeviceInfoDir is where the device information files of the
+	// attachments are.
+	DeviceInfoDir string
+	// NetNsPath is the path to the network namespace of the lower devices.
+	NetNsPath string
+
+	// startSniffer learns from the traffic of a lower device until stop is
+	// closed.
+	startSniffer func(lowerDevice string, stop <-chan struct{})
+
+	lock sync.Mutex
+	// macvtaps are keyed by the path of their device information file, as
+	// the source and the target of a migration on the same node share
+	// their MAC, and ips by MAC.
+	macvtaps map[string]*macvtapAttachment
+	ips      map[string]map[string]*LearnedIP
+	sniffers map[string]chan struct{}
+}
+
+func NewIPLearner(ttl time.Duration, netNsPath string) *IPLearner {
+	l := &IPLearner{
+		TTL:           ttl,
+		DeviceInfoDir: filepath.Join(util.DeviceInfoDir, "cni"),
+		NetNsPath:     netNsPath,
+		macvtaps:      map[string]*macvtapAttachment{},
+		ips:           map[string]map[string]*LearnedIP{},
+		sniffers:      map[string]chan struct{}{},
+	}
+	l.startSniffer = l.sniff
+	return l
+}
+
+// Run learns addresses until stop is closed.
+func (l *IPLearner) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(ipLearnerRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		l.refresh(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			l.lock.Lock()
+			for lowerDevice, stopSniffer := range l.sniffers {
+				close(stopSniffer)
+				delete(l.sniffers, lowerDevice)
+			}
+			l.lock.Unlock()
+			return
+		}
+	}
+}
+
+// refresh looks up the macvtaps of the node, sniffs the lower devices they are
+// on, expires the stale addresses and publishes the others.
+func (l *IPLearner) refresh(now time.Time) {
+	infos := l.loadDeviceInfos()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	macvtaps := map[string]*macvtapAttachment{}
+	lowerDevices := map[string]bool{}
+	for path, info := range infos {
+		macvtaps[path] = &macvtapAttachment{
+			mac:            info.Macvtap.MAC,
+			lowerDevice:    info.Macvtap.LowerDevice,
+			deviceInfoFile: path,
+			publishedIPs:   info.Macvtap.LearnedIPs,
+		}
+		lowerDevices[info.Macvtap.LowerDevice] = true
+	}
+	l.macvtaps = macvtaps
+
+	for lowerDevice := range lowerDevices {
+		if _, ok := l.sniffers[lowerDevice]; !ok {
+			stop := make(chan struct{})
+			l.sniffers[lowerDevice] = stop
+			go l.startSniffer(lowerDevice, stop)
+		}
+	}
+	for lowerDevice, stop := range l.sniffers {
+		if !lowerDevices[lowerDevice] {
+			close(stop)
+			delete(l.sniffers, lowerDevice)
+		}
+	}
+
+	for mac, ips := range l.ips {
+		if !l.hasMAC(mac, "") {
+			delete(l.ips, mac)
+			continue
+		}
+		for ip, learned := range ips {
+			if !now.Before(learned.ExpiresAt) {
+				delete(ips, ip)
+			}
+		}
+	}
+
+	for _, macvtap := range l.macvtaps {
+		ips := l.learnedIPs(macvtap.mac)
+		if equalStrings(ips, macvtap.publishedIPs) {
+			continue
+		}
+		if err := util.SetLearnedIPs(macvtap.deviceInfoFile, macvtap.mac, ips); err != nil {
+			glog.Warningf("Error publishing the learned addresses of %s: %v", macvtap.mac, err)
+			continue
+		}
+		macvtap.publishedIPs = ips
+	}
+}
+
+// loadDeviceInfos returns the macvtap device information files of the
+// attachments, by path.
+func (l *IPLearner) loadDeviceInfos() map[string]*util.DeviceInfo {
+	infos := map[string]*util.DeviceInfo{}
+	entries, err := os.ReadDir(l.DeviceInfoDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Error listing device info files: %v", err)
+		}
+		return infos
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(l.DeviceInfoDir, entry.Name())
+		info, err := util.LoadDeviceInfo(path)
+		if err != nil {
+			// removed meanwhile, or not ours to read
+			glog.V(4).Infof("Skipping device info file: %v", err)
+			continue
+		}
+		if info.Type != util.DeviceInfoTypeMacvtap || info.Macvtap == nil {
+			continue
+		}
+		infos[path] = info
+	}
+	return infos
+}
+
+// hasMAC tells whether a macvtap uses mac, on lowerDevice unless empty. The
+// lock must be held.
+func (l *IPLearner) hasMAC(mac string, lowerDevice string) bool {
+	for _, macvtap := range l.macvtaps {
+		if macvtap.mac == mac && (lowerDevice == "" || macvtap.lowerDevice == lowerDevice) {
+			return true
+		}
+	}
+	return false
+}
+
+// learnedIPs returns the sorted addresses learned for a MAC. The lock must be
+// held.
+func (l *IPLearner) learnedIPs(mac string) []string {
+	var ips []string
+	for ip := range l.ips[mac] {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// observe records an address seen on a lower device, if it is used by one of
+// its macvtaps. An address is only learned for one MAC at a time, the last one
+// seen using it.
+func (l *IPLearner) observe(lowerDevice string, o *util.IPObservation, now time.Time) {
+	mac := o.MAC.String()
+	ip := o.IP.String()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.hasMAC(mac, lowerDevice) {
+		return
+	}
+
+	for other, ips := range l.ips {
+		if other != mac {
+			delete(ips, ip)
+		}
+	}
+
+	ttl := l.TTL
+	if o.Lease > ttl {
+		ttl = o.Lease
+	}
+	if l.ips[mac] == nil {
+		l.ips[mac] = map[string]*LearnedIP{}
+	}
+	l.ips[mac][ip] = &LearnedIP{
+		IP:        ip,
+		Source:    o.Source,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// sniff learns from the traffic of a lower device until stop is closed. The
+// sniffer is opened again on failure, as the lower device may come and go.
+func (l *IPLearner) sniff(lowerDevice string, stop <-chan struct{}) {
+	for {
+		var sniffer *util.Sniffer
+		err := ns.WithNetNSPath(l.NetNsPath, func(_ ns.NetNS) error {
+			var err error
+			sniffer, err = util.OpenSniffer(lowerDevice, snifferTimeout)
+			return err
+		})
+		if err == nil {
+			glog.V(3).Infof("Learning addresses from the traffic of %s", lowerDevice)
+			err = l.learn(lowerDevice, sniffer, stop)
+			sniffer.Close()
+		}
+		if err != nil {
+			glog.Warningf("Error learning addresses from the traffic of %s: %v", lowerDevice, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(ipLearnerRefreshInterval):
+		}
+	}
+}
+
+func (l *IPLearner) learn(lowerDevice string, sniffer *util.Sniffer, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		o, err := sniffer.Next()
+		if err != nil {
+			return err
+		}
+		if o != nil {
+			l.observe(lowerDevice, o, time.Now())
+		}
+	}
+}
+
+// Attachments returns the addresses learned for the macvtaps of the node.
+func (l *IPLearner) Attachments() []LearnedAttachment {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	attachments := []LearnedAttachment{}
+	for _, macvtap := range l.macvtaps {
+		attachment := LearnedAttachment{
+			MAC:            macvtap.mac,
+			LowerDevice:    macvtap.lowerDevice,
+			DeviceInfoFile: macvtap.deviceInfoFile,
+			IPs:            []LearnedIP{},
+		}
+		for _, ip := range l.learnedIPs(macvtap.mac) {
+			attachment.IPs = append(attachment.IPs, *l.ips[macvtap.mac][ip])
+		}
+		attachments = append(attachments, attachment)
+	}
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].MAC != attachments[j].MAC {
+			return attachments[i].MAC < attachments[j].MAC
+		}
+		return attachments[i].DeviceInfoFile < attachments[j].DeviceInfoFile
+	})
+	return attachments
+}
+
+// ServeHTTP serves the learned addresses of the macvtaps of the node, or of
+// the one with the MAC given by the mac query parameter.
+func (l *IPLearner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attachments := l.Attachments()
+	if query := r.URL.Query().Get("mac"); query != "" {
+		mac, err := net.ParseMAC(query)
+		if err != nil {
+			http.Error(w, "invalid mac", http.StatusBadRequest)
+			return
+		}
+		filtered := []LearnedAttachment{}
+		for _, attachment := range attachments {
+			if attachment.MAC == mac.String() {
+				filtered = append(filtered, attachment)
+			}
+		}
+		attachments = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
@@ -0,0 +1,150 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP learner", func() {
+	var dir string
+	var learner *IPLearner
+	var sniffed map[string]bool
+	var path string
+
+	mac := net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x01}
+	now := time.Now()
+
+	observe := func(lowerDevice string, ip string, at time.Time) {
+		learner.observe(lowerDevice, &util.IPObservation{MAC: mac, IP: net.ParseIP(ip), Source: util.LearnedFromARP}, at)
+	}
+
+	learnedIPs := func() []string {
+		info, err := util.LoadDeviceInfo(path)
+		Expect(err).NotTo(HaveOccurred())
+		return info.Macvtap.LearnedIPs
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+
+		sniffed = map[string]bool{}
+		learner = NewIPLearner(time.Minute, "")
+		learner.DeviceInfoDir = dir
+		learner.startSniffer = func(lowerDevice string, stop <-chan struct{}) {}
+
+		path = filepath.Join(dir, "dataplane-0123abcd-net1-device.json")
+		Expect(util.SaveDeviceInfo(path, &util.DeviceInfo{
+			Type:    util.DeviceInfoTypeMacvtap,
+			Version: util.DeviceInfoVersion,
+			Macvtap: &util.MacvtapDeviceInfo{LowerDevice: "eth0", MAC: mac.String()},
+		})).To(Succeed())
+		learner.refresh(now)
+		for lowerDevice := range learner.sniffers {
+			sniffed[lowerDevice] = true
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("sniffs the lower devices of the macvtaps", func() {
+		Expect(sniffed).To(Equal(map[string]bool{"eth0": true}))
+	})
+
+	It("publishes the addresses of the macvtaps seen on their lower device", func() {
+		observe("eth0", "10.0.0.5", now)
+		observe("eth1", "10.0.0.6", now)
+		learner.refresh(now)
+
+		Expect(learnedIPs()).To(Equal([]string{"10.0.0.5"}))
+	})
+
+	It("expires the addresses not seen again", func() {
+		observe("eth0", "10.0.0.5", now)
+		observe("eth0", "fd00::5", now.Add(30*time.Second))
+		learner.refresh(now.Add(time.Minute))
+
+		Expect(learnedIPs()).To(Equal([]string{"fd00::5"}))
+	})
+
+	It("forgets the macvtaps whose device info file is gone", func() {
+		observe("eth0", "10.0.0.5", now)
+		Expect(util.CleanDeviceInfo(path)).To(Succeed())
+		learner.refresh(now)
+
+		Expect(learner.Attachments()).To(BeEmpty())
+		Expect(learner.sniffers).To(BeEmpty())
+		Expect(path).NotTo(BeAnExistingFile())
+	})
+
+	It("publishes the addresses to every macvtap using the MAC", func() {
+		// the target of a migration on the same node shares the MAC of
+		// the source
+		targetPath := filepath.Join(dir, "dataplane-4567cdef-net1-device.json")
+		Expect(util.SaveDeviceInfo(targetPath, &util.DeviceInfo{
+			Type:    util.DeviceInfoTypeMacvtap,
+			Version: util.DeviceInfoVersion,
+			Macvtap: &util.MacvtapDeviceInfo{LowerDevice: "eth0", MAC: mac.String()},
+		})).To(Succeed())
+		learner.refresh(now)
+
+		observe("eth0", "10.0.0.5", now)
+		learner.refresh(now)
+
+		Expect(learnedIPs()).To(Equal([]string{"10.0.0.5"}))
+		target, err := util.LoadDeviceInfo(targetPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target.Macvtap.LearnedIPs).To(Equal([]string{"10.0.0.5"}))
+
+		attachments := learner.Attachments()
+		Expect(attachments).To(HaveLen(2))
+		Expect(attachments[0].DeviceInfoFile).To(Equal(path))
+		Expect(attachments[1].DeviceInfoFile).To(Equal(targetPath))
+
+		// the source goes away along with its device info file
+		Expect(util.CleanDeviceInfo(path)).To(Succeed())
+		learner.refresh(now)
+
+		Expect(learner.Attachments()).To(HaveLen(1))
+		Expect(learner.learnedIPs(mac.String())).To(Equal([]string{"10.0.0.5"}))
+	})
+
+	It("serves the learned addresses", func() {
+		observe("eth0", "10.0.0.5", now)
+
+		get := func(url string) (int, []LearnedAttachment) {
+			recorder := httptest.NewRecorder()
+			learner.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+			var attachments []LearnedAttachment
+			json.Unmarshal(recorder.Body.Bytes(), &attachments)
+			return recorder.Code, attachments
+		}
+
+		code, attachments := get("/v1/ips?mac=02:5A:00:00:00:01")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(attachments).To(HaveLen(1))
+		Expect(attachments[0].LowerDevice).To(Equal("eth0"))
+		Expect(attachments[0].IPs).To(HaveLen(1))
+		Expect(attachments[0].IPs[0].IP).To(Equal("10.0.0.5"))
+		Expect(attachments[0].IPs[0].ExpiresAt).To(BeTemporally("~", now.Add(time.Minute)))
+
+		code, attachments = get("/v1/ips?mac=02:5a:00:00:00:02")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(attachments).To(BeEmpty())
+
+		code, _ = get("/v1/ips?mac=nope")
+		Expect(code).To(Equal(http.StatusBadRequest))
+	})
+})
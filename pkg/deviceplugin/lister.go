@@ -2,6 +2,7 @@ package deviceplugin
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -20,6 +21,32 @@ type macvtapConfig struct {
 	LowerDevice string `json:"lowerDevice"`
 	Mode        string `json:"mode"`
 	Capacity    int    `json:"capacity"`
+	// SourceMACs is the allowlist of source MACs of the macvtaps in source
+	// mode, which only receive the frames sent from those addresses.
+	SourceMACs []string `json:"sourceMACs,omitempty"`
+	// Macvlan are the settings of the macvlan driver backing the macvtaps.
+	Macvlan *util.MacvlanSettings `json:"macvlan,omitempty"`
+	// MACPool is the range the CNI allocates the MACs of the macvtaps from,
+	// when no MAC is requested.
+	MACPool *util.MACPoolConfig `json:"macPool,omitempty"`
+}
+
+// validate checks that the resource can be offered as configured.
+func (c macvtapConfig) validate() error {
+	sourceMACs, err := util.ParseSourceMACs(c.SourceMACs)
+	if err != nil {
+		return err
+	}
+	if err := util.ValidateSourceMACs(c.Mode, sourceMACs); err != nil {
+		return err
+	}
+	if err := c.Macvlan.Validate(c.Mode); err != nil {
+		return err
+	}
+	if err := c.MACPool.Validate(); err != nil {
+		return fmt.Errorf("invalid MAC pool: %v", err)
+	}
+	return nil
 }
 
 type macvtapLister struct {
@@ -49,6 +76,9 @@ func readConfig() (map[string]macvtapConfig, error) {
 	}
 
 	for _, macvtapConfig := range config {
+		if err := macvtapConfig.validate(); err != nil {
+			return configMap, fmt.Errorf("invalid configuration of resource %q: %v", macvtapConfig.Name, err)
+		}
 		configMap[macvtapConfig.Name] = macvtapConfig
 	}
 
@@ -164,6 +194,15 @@ func (ml *macvtapLister) NewPlugin(name string) dpm.PluginInterface {
 		}
 	}
 
+	// A lower device in passthru mode can only have one macvtap
+	if c.Mode == "passthru" && c.Capacity != 1 {
+		glog.Warningf("Forcing capacity of resource %q to 1 as it is in passthru mode", c.Name)
+		c.Capacity = 1
+	}
+
+	// The configuration has been validated when read
+	sourceMACs, _ := util.ParseSourceMACs(c.SourceMACs)
+
 	glog.V(3).Infof("Creating device plugin with config %+v", c)
-	return NewMacvtapDevicePlugin(c.Name, c.LowerDevice, c.Mode, c.Capacity, ml.NetNsPath)
+	return NewMacvtapDevicePlugin(c.Name, c.LowerDevice, c.Mode, c.Capacity, sourceMACs, c.Macvlan, c.MACPool, ml.NetNsPath)
 }
@@ -2,6 +2,8 @@ package deviceplugin
 
 import (
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/golang/glog"
@@ -26,22 +28,37 @@ type macvtapDevicePlugin struct {
 	LowerDevice string
 	Mode        string
 	Capacity    int
+	// SourceMACs is the allowlist of source MACs of macvtaps in source mode.
+	SourceMACs []net.HardwareAddr
+	// Macvlan are the settings of the macvlan driver backing the macvtaps.
+	Macvlan *util.MacvlanSettings
+	// MACPool is the range the MACs of the macvtaps are allocated from.
+	MACPool *util.MACPoolConfig
 	// NetNsPath is the path to the network namespace the plugin operates in.
 	NetNsPath   string
 	stopWatcher chan struct{}
 }
 
-func NewMacvtapDevicePlugin(name string, lowerDevice string, mode string, capacity int, netNsPath string) *macvtapDevicePlugin {
+func NewMacvtapDevicePlugin(name string, lowerDevice string, mode string, capacity int, sourceMACs []net.HardwareAddr, macvlan *util.MacvlanSettings, macPool *util.MACPoolConfig, netNsPath string) *macvtapDevicePlugin {
 	return &macvtapDevicePlugin{
 		Name:        name,
 		LowerDevice: lowerDevice,
 		Mode:        mode,
 		Capacity:    capacity,
+		SourceMACs:  sourceMACs,
+		Macvlan:     macvlan,
+		MACPool:     macPool,
 		NetNsPath:   netNsPath,
 		stopWatcher: make(chan struct{}),
 	}
 }
 
+// resourceName returns the fully qualified name of the resource the plugin
+// advertises.
+func (mdp *macvtapDevicePlugin) resourceName() string {
+	return fmt.Sprint(resourceNamespace, "/", mdp.Name)
+}
+
 func (mdp *macvtapDevicePlugin) generateMacvtapDevices() []*pluginapi.Device {
 	var macvtapDevs []*pluginapi.Device
 
@@ -128,16 +145,49 @@ func (mdp *macvtapDevicePlugin) Allocate(ctx context.Context, r *pluginapi.Alloc
 			// no de-allocate flow to clean up. So we attempt to delete a
 			// possibly existing existing interface before creating it to reset
 			// its state.
+			// Record the allocation first, so that GC never takes the
+			// macvtap for leaked while the kubelet assigns it to a pod.
+			allocation := &util.Allocation{Resource: mdp.resourceName(), DeviceID: name, AllocatedAt: time.Now()}
+			if err := util.SaveAllocation(util.DefaultAllocationDir, allocation); err != nil {
+				return nil, err
+			}
+
 			var index int
+			var info *util.DeviceInfo
 			err := ns.WithNetNSPath(mdp.NetNsPath, func(_ ns.NetNS) error {
 				var err error
-				index, err = util.RecreateMacvtap(ifaceName, mdp.LowerDevice, mdp.Mode)
+				index, err = util.RecreateMacvtap(ifaceName, mdp.LowerDevice, mdp.Mode, mdp.SourceMACs, mdp.Macvlan)
+				if err != nil {
+					return err
+				}
+				// Record the allocation so that the CNI can garbage collect
+				// the interface if it's never claimed.
+				if err = util.SetLinkOwner(ifaceName, util.LinkOwner{AllocatedAt: allocation.AllocatedAt}); err != nil {
+					return err
+				}
+				info, err = util.NewMacvtapDeviceInfo(ifaceName, mdp.LowerDevice)
 				return err
 			})
 			if err != nil {
 				return nil, err
 			}
 
+			// Publish the device information so that consumers don't have to
+			// guess the tap device from the interface index.
+			if err := util.SaveDeviceInfo(util.DeviceInfoPathForDP(mdp.resourceName(), name), info); err != nil {
+				return nil, err
+			}
+
+			// Publish the MAC pool of the resource for the CNI to allocate
+			// the MAC of the macvtap from, as it only knows the device.
+			var pool *util.MACPool
+			if mdp.MACPool != nil {
+				pool = &util.MACPool{Name: mdp.resourceName(), MACPoolConfig: *mdp.MACPool}
+			}
+			if err := util.SaveDeviceMACPool(util.DefaultMACPoolDir, name, pool); err != nil {
+				return nil, err
+			}
+
 			devPath := fmt.Sprint(tapPath, index)
 			dev.HostPath = devPath
 			dev.ContainerPath = devPath
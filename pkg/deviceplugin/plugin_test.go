@@ -90,7 +90,7 @@ var _ = Describe("Macvtap", func() {
 		var sendSpy *ListAndWatchServerSendSpy
 
 		BeforeEach(func() {
-			mvdp = NewMacvtapDevicePlugin(lowerDeviceIfaceName, lowerDeviceIfaceName, "bridge", 0, testNs.Path())
+			mvdp = NewMacvtapDevicePlugin(lowerDeviceIfaceName, lowerDeviceIfaceName, "bridge", 0, nil, nil, nil, testNs.Path())
 			sendSpy = &ListAndWatchServerSendSpy{}
 			go func() {
 				err := mvdp.ListAndWatch(nil, sendSpy)
@@ -207,6 +207,72 @@ var _ = Describe("Macvtap", func() {
 			})
 		})
 
+		Context("WHEN provided a passthru configuration", func() {
+			resourceName := "passthrough"
+
+			BeforeEach(func() {
+				config := fmt.Sprintf(`[{"name":"%s","lowerDevice":"%s","mode":"passthru","capacity":10,"macvlan":{"noPromisc":true,"bcQueueLen":10000}}]`, resourceName, lowerDeviceIfaceName)
+				os.Setenv(ConfigEnvironmentVariable, config)
+			})
+
+			AfterEach(func() {
+				os.Unsetenv(ConfigEnvironmentVariable)
+			})
+
+			It("SHOULD offer a single device", func() {
+				Eventually(pluginListCh).Should(Receive(ConsistOf(resourceName)))
+
+				plugin := lister.NewPlugin(resourceName)
+				Expect(plugin.(*macvtapDevicePlugin).Mode).To(Equal("passthru"))
+				Expect(plugin.(*macvtapDevicePlugin).Capacity).To(Equal(1))
+				Expect(plugin.(*macvtapDevicePlugin).Macvlan).To(Equal(&util.MacvlanSettings{NoPromisc: true, BCQueueLen: 10000}))
+			})
+		})
+
+		Context("WHEN provided a source mode configuration", func() {
+			resourceName := "migration"
+
+			BeforeEach(func() {
+				config := fmt.Sprintf(`[{"name":"%s","lowerDevice":"%s","mode":"source","sourceMACs":["02:00:00:00:00:01"]}]`, resourceName, lowerDeviceIfaceName)
+				os.Setenv(ConfigEnvironmentVariable, config)
+			})
+
+			AfterEach(func() {
+				os.Unsetenv(ConfigEnvironmentVariable)
+			})
+
+			It("SHOULD create the plugin with the source MACs", func() {
+				Eventually(pluginListCh).Should(Receive(ConsistOf(resourceName)))
+
+				plugin := lister.NewPlugin(resourceName)
+				Expect(plugin.(*macvtapDevicePlugin).Mode).To(Equal("source"))
+				Expect(plugin.(*macvtapDevicePlugin).SourceMACs).To(HaveLen(1))
+				Expect(plugin.(*macvtapDevicePlugin).SourceMACs[0].String()).To(Equal("02:00:00:00:00:01"))
+			})
+		})
+
+		Context("WHEN provided a MAC pool configuration", func() {
+			resourceName := "pooled"
+
+			BeforeEach(func() {
+				config := fmt.Sprintf(`[{"name":"%s","lowerDevice":"%s","macPool":{"prefix":"02:5a:00","start":"00:00:01","end":"00:ff:ff","releaseGracePeriod":"10m"}}]`, resourceName, lowerDeviceIfaceName)
+				os.Setenv(ConfigEnvironmentVariable, config)
+			})
+
+			AfterEach(func() {
+				os.Unsetenv(ConfigEnvironmentVariable)
+			})
+
+			It("SHOULD create the plugin with the MAC pool", func() {
+				Eventually(pluginListCh).Should(Receive(ConsistOf(resourceName)))
+
+				plugin := lister.NewPlugin(resourceName)
+				Expect(plugin.(*macvtapDevicePlugin).MACPool).To(Equal(&util.MACPoolConfig{
+					Prefix: "02:5a:00", Start: "00:00:01", End: "00:ff:ff", ReleaseGracePeriod: "10m",
+				}))
+			})
+		})
+
 		Context("WHEN provided an empty configuration", func() {
 			BeforeEach(func() {
 				os.Setenv(ConfigEnvironmentVariable, "[]")
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// GlogHandler hands the records logged with slog, e.g. by the steps of
+// pkg/util, to glog, so that long running components log to a single place.
+// Debug records are logged at verbosity 4.
+type GlogHandler struct {
+	prefix string
+	attrs  string
+}
+
+func (h *GlogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || bool(glog.V(4))
+}
+
+func (h *GlogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+
+	switch {
+	case r.Level >= slog.LevelError:
+		glog.Error(b.String())
+	case r.Level >= slog.LevelWarn:
+		glog.Warning(b.String())
+	default:
+		glog.Info(b.String())
+	}
+	return nil
+}
+
+func (h *GlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		writeAttr(&b, h.prefix, a)
+	}
+	return &GlogHandler{prefix: h.prefix, attrs: b.String()}
+}
+
+func (h *GlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &GlogHandler{prefix: h.prefix + name + ".", attrs: h.attrs}
+}
+
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, prefix, ga)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%v", prefix, a.Key, a.Value)
+}
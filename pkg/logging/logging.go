@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLevel is the level logged at when a log file is configured
+	// without a level.
+	DefaultLevel = "info"
+)
+
+// ParseLevel parses a log level name: debug, info, warning or error.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// Setup makes the default logger write JSON records at or above level to the
+// rotating logFile. Nothing is logged without a log file, as the standard
+// streams of a CNI plugin are reserved to the runtime, nor with an invalid
+// level, for which an error is returned.
+func Setup(logFile string, level string) error {
+	var w io.Writer = io.Discard
+	slogLevel, err := ParseLevel(level)
+	if err == nil && logFile != "" {
+		w = newRotatingFile(logFile)
+	}
+
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slogLevel})))
+	return err
+}
+
+// Step logs the outcome of a step that started at start with the default
+// logger, along with its duration: at debug level if it succeeded, at error
+// level otherwise.
+func Step(step string, start time.Time, err error, attrs ...any) {
+	attrs = append(attrs, "duration", time.Since(start))
+	if err != nil {
+		slog.Error(step+" failed", append(attrs, "error", err)...)
+		return
+	}
+	slog.Debug(step, attrs...)
+}
@@ -0,0 +1,82 @@
+package logging_test
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/logging"
+)
+
+var _ = Describe("Logging", func() {
+	var dir string
+	var logFile string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "logging")
+		Expect(err).NotTo(HaveOccurred())
+		logFile = filepath.Join(dir, "macvtap.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readRecords := func() []map[string]interface{} {
+		data, err := os.ReadFile(logFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			record := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(line), &record)).To(Succeed())
+			records = append(records, record)
+		}
+		return records
+	}
+
+	It("rejects unknown levels and discards the records", func() {
+		Expect(logging.Setup(logFile, "verbose")).NotTo(Succeed())
+
+		slog.Error("DEL failed")
+		Expect(logFile).NotTo(BeAnExistingFile())
+	})
+
+	It("logs steps with their duration and attributes", func() {
+		Expect(logging.Setup(logFile, "debug")).To(Succeed())
+		slog.SetDefault(slog.Default().With("containerID", "0123abcd"))
+
+		logging.Step("set MTU", time.Now(), nil, "mtu", 1500)
+		logging.Step("rename macvtap", time.Now(), errors.New("file exists"))
+
+		records := readRecords()
+		Expect(records).To(HaveLen(2))
+		Expect(records[0]).To(HaveKeyWithValue("msg", "set MTU"))
+		Expect(records[0]).To(HaveKeyWithValue("level", "DEBUG"))
+		Expect(records[0]).To(HaveKeyWithValue("containerID", "0123abcd"))
+		Expect(records[0]).To(HaveKeyWithValue("mtu", BeNumerically("==", 1500)))
+		Expect(records[0]).To(HaveKey("duration"))
+		Expect(records[1]).To(HaveKeyWithValue("msg", "rename macvtap failed"))
+		Expect(records[1]).To(HaveKeyWithValue("level", "ERROR"))
+		Expect(records[1]).To(HaveKeyWithValue("error", "file exists"))
+	})
+
+	It("only logs at or above the configured level", func() {
+		Expect(logging.Setup(logFile, "info")).To(Succeed())
+
+		logging.Step("set MTU", time.Now(), nil)
+		slog.Info("ADD succeeded")
+
+		records := readRecords()
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]).To(HaveKeyWithValue("msg", "ADD succeeded"))
+	})
+})
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Log files are rotated once they reach maxSize, and up to maxBackups
+	// rotated ones are kept.
+	maxSize    = 10 * 1024 * 1024
+	maxBackups = 5
+)
+
+// rotatingFile appends to a log file shared by concurrent plugin processes.
+// Every write holds an exclusive lock on a companion lock file, so that a
+// record is never split and a single process rotates the file at a time; the
+// processes that still have the rotated file open notice it under the lock
+// and reopen the path.
+type rotatingFile struct {
+	path string
+
+	mu   sync.Mutex
+	lock *os.File
+	file *os.File
+}
+
+func newRotatingFile(path string) *rotatingFile {
+	return &rotatingFile{path: path}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lock == nil {
+		if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+			return 0, fmt.Errorf("failed to create log directory: %v", err)
+		}
+		lock, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open log lock file: %v", err)
+		}
+		r.lock = lock
+	}
+
+	if err := unix.Flock(int(r.lock.Fd()), unix.LOCK_EX); err != nil {
+		return 0, fmt.Errorf("failed to lock log file: %v", err)
+	}
+	defer unix.Flock(int(r.lock.Fd()), unix.LOCK_UN)
+
+	if err := r.reopen(); err != nil {
+		return 0, err
+	}
+
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat log file: %v", err)
+	}
+	if info.Size() > 0 && info.Size()+int64(len(p)) > maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.file.Write(p)
+}
+
+// reopen opens the log file unless the one open is still at its path, i.e.
+// it was not rotated by another process.
+func (r *rotatingFile) reopen() error {
+	if r.file != nil {
+		current, err := r.file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat log file: %v", err)
+		}
+		atPath, err := os.Stat(r.path)
+		if err == nil && os.SameFile(current, atPath) {
+			return nil
+		}
+		r.file.Close()
+		r.file = nil
+	}
+
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	r.file = file
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest one, moves the log
+// file to the first of them and opens a new one.
+func (r *rotatingFile) rotate() error {
+	for i := maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate log file: %v", err)
+		}
+	}
+	if err := os.Rename(r.path, backupPath(r.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	return r.reopen()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rotating log file", func() {
+	var dir string
+	var logFile string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "logging")
+		Expect(err).NotTo(HaveOccurred())
+		logFile = filepath.Join(dir, "macvtap.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	record := func(b byte) []byte {
+		return append(bytes.Repeat([]byte{b}, maxSize/2), '\n')
+	}
+
+	It("is shared by the processes rotating it", func() {
+		first := newRotatingFile(logFile)
+		second := newRotatingFile(logFile)
+
+		_, err := first.Write(record('a'))
+		Expect(err).NotTo(HaveOccurred())
+		// the second record does not fit anymore and rotates the file
+		_, err = second.Write(record('b'))
+		Expect(err).NotTo(HaveOccurred())
+		// the first writer follows the rotation
+		_, err = first.Write([]byte("c\n"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.ReadFile(backupPath(logFile, 1))).To(Equal(record('a')))
+		Expect(os.ReadFile(logFile)).To(Equal(append(record('b'), "c\n"...)))
+	})
+
+	It("keeps a bounded number of rotated files", func() {
+		w := newRotatingFile(logFile)
+		for i := 0; i < maxBackups+3; i++ {
+			_, err := w.Write(record(byte('a' + i)))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		for i := 1; i <= maxBackups; i++ {
+			Expect(backupPath(logFile, i)).To(BeAnExistingFile())
+		}
+		Expect(backupPath(logFile, maxBackups+1)).NotTo(BeAnExistingFile())
+		Expect(os.ReadFile(backupPath(logFile, 1))).To(Equal(record(byte('a' + maxBackups + 1))))
+	})
+})
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultAllocationDir is where the device plugin records the macvtaps it
+// allocated to pods, for GC to leave alone those that are yet to be claimed by
+// an attachment.
+const DefaultAllocationDir = "/var/run/macvtap-cni/allocated"
+
+// Allocation records a macvtap allocated by the device plugin, until the
+// kubelet no longer assigns its device to a pod.
+type Allocation struct {
+	Resource    string    `json:"resource"`
+	DeviceID    string    `json:"deviceID"`
+	AllocatedAt time.Time `json:"allocatedAt"`
+}
+
+// allocationPath returns the path of the record of an allocation, named after
+// the temporary interface name of the macvtap so that GC can look it up from
+// the link.
+func allocationPath(dir string, ifaceName string) string {
+	return filepath.Join(dir, ifaceName+".json")
+}
+
+// SaveAllocation records an allocation in dir, replacing any previous record
+// of the device.
+func SaveAllocation(dir string, a *Allocation) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to marshal allocation: %v", err)
+	}
+	return writeFileAtomic(allocationPath(dir, TemporaryInterfaceName(a.DeviceID)), data, 0644)
+}
+
+// IsAllocated tells whether the macvtap with the given temporary interface
+// name is recorded as allocated in dir.
+func IsAllocated(dir string, ifaceName string) (bool, error) {
+	_, err := os.Stat(allocationPath(dir, ifaceName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up the allocation of %q: %v", ifaceName, err)
+	}
+	return true, nil
+}
+
+// DeleteAllocation removes the record of the allocation of a device from dir,
+// if any.
+func DeleteAllocation(dir string, deviceID string) error {
+	path := allocationPath(dir, TemporaryInterfaceName(deviceID))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove allocation record %s: %v", path, err)
+	}
+	return nil
+}
+
+// ListAllocations returns the allocations recorded in dir.
+func ListAllocations(dir string) ([]*Allocation, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list allocation records: %v", err)
+	}
+
+	var allocations []*Allocation
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read allocation record %s: %v", path, err)
+		}
+		a := &Allocation{}
+		if err := json.Unmarshal(data, a); err != nil {
+			return nil, fmt.Errorf("failed to parse allocation record %s: %v", path, err)
+		}
+		allocations = append(allocations, a)
+	}
+	return allocations, nil
+}
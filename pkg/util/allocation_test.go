@@ -0,0 +1,43 @@
+package util_test
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Allocations", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "allocated")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("records the allocated macvtaps by temporary interface name", func() {
+		allocation := &util.Allocation{
+			Resource:    "macvtap.network.kubevirt.io/dataplane",
+			DeviceID:    "dataplaneMvp0",
+			AllocatedAt: time.Unix(1700000000, 0).UTC(),
+		}
+		Expect(util.SaveAllocation(dir, allocation)).To(Succeed())
+
+		Expect(util.IsAllocated(dir, util.TemporaryInterfaceName("dataplaneMvp0"))).To(BeTrue())
+		Expect(util.IsAllocated(dir, util.TemporaryInterfaceName("dataplaneMvp1"))).To(BeFalse())
+		Expect(util.ListAllocations(dir)).To(ConsistOf(allocation))
+
+		Expect(util.DeleteAllocation(dir, "dataplaneMvp0")).To(Succeed())
+		Expect(util.IsAllocated(dir, util.TemporaryInterfaceName("dataplaneMvp0"))).To(BeFalse())
+		Expect(util.ListAllocations(dir)).To(BeEmpty())
+		Expect(util.DeleteAllocation(dir, "dataplaneMvp0")).To(Succeed())
+	})
+})
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// announceRounds is how many times the announcements are sent, spaced by
+	// announceInterval, as a single frame is easily lost while the network
+	// converges.
+	announceRounds   = 3
+	announceInterval = 100 * time.Millisecond
+
+	// minFrameLen is the minimum length of an ethernet frame without its FCS,
+	// which shorter frames are padded to.
+	minFrameLen = 60
+
+	arpRequest        = 1
+	rarpRequest       = 3
+	icmpv6NeighborAdv = 136
+	ndOptTargetLLAddr = 2
+	ndFlagOverride    = 0x20000000
+)
+
+var (
+	broadcastMAC      = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	allNodesMulticast = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// AnnouncementFrames returns the frames announcing that mac, along the IPs,
+// is now reached through the interface sending them: a gratuitous ARP per
+// IPv4 address and an unsolicited neighbor advertisement per IPv6 address,
+// or a RARP as QEMU sends after a migration when there are no IPs, which
+// still updates the forwarding tables of the switches.
+func AnnouncementFrames(mac net.HardwareAddr, ips []net.IP) [][]byte {
+	var frames [][]byte
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			frames = append(frames, arpFrame(broadcastMAC, unix.ETH_P_ARP, arpRequest, mac, ip4, nil, ip4))
+		} else if ip.To16() != nil {
+			frames = append(frames, neighborAdvertisement(mac, ip.To16()))
+		}
+	}
+	if len(frames) == 0 {
+		frames = append(frames, arpFrame(broadcastMAC, unix.ETH_P_RARP, rarpRequest, mac, net.IPv4zero.To4(), mac, net.IPv4zero.To4()))
+	}
+	return frames
+}
+
+// ethernetFrame returns a frame with the given header and payload, padded to
+// the minimum length.
+func ethernetFrame(dst net.HardwareAddr, src net.HardwareAddr, ethType uint16, payload []byte) []byte {
+	frame := make([]byte, 14, minFrameLen)
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], ethType)
+	frame = append(frame, payload...)
+	for len(frame) < minFrameLen {
+		frame = append(frame, 0)
+	}
+	return frame
+}
+
+// arpFrame returns an ARP or RARP frame for ethernet and IPv4 addresses. A
+// nil target MAC is all zeros.
+func arpFrame(dst net.HardwareAddr, ethType uint16, op uint16, senderMAC net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:2], 1) // ethernet
+	binary.BigEndian.PutUint16(arp[2:4], unix.ETH_P_IP)
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], op)
+	copy(arp[8:14], senderMAC)
+	copy(arp[14:18], senderIP)
+	copy(arp[18:24], targetMAC)
+	copy(arp[24:28], targetIP)
+	return ethernetFrame(dst, senderMAC, ethType, arp)
+}
+
+// neighborAdvertisement returns an unsolicited neighbor advertisement of the
+// IPv6 address to all nodes, overriding their cached link-layer address.
+func neighborAdvertisement(mac net.HardwareAddr, ip net.IP) []byte {
+	dst := net.IPv6linklocalallnodes
+
+	icmp := make([]byte, 32)
+	icmp[0] = icmpv6NeighborAdv
+	binary.BigEndian.PutUint32(icmp[4:8], ndFlagOverride)
+	copy(icmp[8:24], ip)
+	icmp[24] = ndOptTargetLLAddr
+	icmp[25] = 1 // in units of 8 bytes
+	copy(icmp[26:32], mac)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip, dst, icmp))
+
+	packet := make([]byte, 40, 40+len(icmp))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(icmp)))
+	packet[6] = unix.IPPROTO_ICMPV6
+	packet[7] = 255 // required by neighbor discovery
+	copy(packet[8:24], ip)
+	copy(packet[24:40], dst)
+	packet = append(packet, icmp...)
+
+	return ethernetFrame(allNodesMulticast, mac, unix.ETH_P_IPV6, packet)
+}
+
+// icmpv6Checksum returns the checksum of an ICMPv6 message, which covers the
+// IPv6 pseudo-header.
+func icmpv6Checksum(src net.IP, dst net.IP, icmp []byte) uint16 {
+	pseudo := make([]byte, 0, 40+len(icmp))
+	pseudo = append(pseudo, src.To16()...)
+	pseudo = append(pseudo, dst.To16()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(icmp)))
+	pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_ICMPV6)
+	pseudo = append(pseudo, icmp...)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Announce sends the announcements of mac and the IPs out of the named
+// interface of the current netns, which must be up.
+func Announce(name string, mac net.HardwareAddr, ips []net.IP) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	defer unix.Close(fd)
+
+	frames := AnnouncementFrames(mac, ips)
+	for round := 0; round < announceRounds; round++ {
+		if round > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, frame := range frames {
+			addr := &unix.SockaddrLinklayer{
+				Ifindex:  iface.Index,
+				Protocol: nl.Swap16(binary.BigEndian.Uint16(frame[12:14])),
+				Halen:    6,
+			}
+			copy(addr.Addr[:], frame[0:6])
+			if err := unix.Sendto(fd, frame, 0, addr); err != nil {
+				return fmt.Errorf("failed to send announcement on %q: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
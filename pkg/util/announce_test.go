@@ -0,0 +1,62 @@
+package util_test
+
+import (
+	"encoding/binary"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Announcements", func() {
+	mac := net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x01}
+
+	It("sends a gratuitous ARP per IPv4 address and a neighbor advertisement per IPv6 address", func() {
+		frames := util.AnnouncementFrames(mac, []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")})
+		Expect(frames).To(HaveLen(2))
+
+		arp := frames[0]
+		Expect(arp).To(HaveLen(60))
+		Expect(net.HardwareAddr(arp[0:6]).String()).To(Equal("ff:ff:ff:ff:ff:ff"))
+		Expect(net.HardwareAddr(arp[6:12])).To(Equal(mac))
+		Expect(binary.BigEndian.Uint16(arp[12:14])).To(Equal(uint16(0x0806)))
+		Expect(binary.BigEndian.Uint16(arp[20:22])).To(Equal(uint16(1)))
+		Expect(net.IP(arp[28:32]).String()).To(Equal("10.0.0.5"))
+		Expect(net.IP(arp[38:42]).String()).To(Equal("10.0.0.5"))
+
+		na := frames[1]
+		Expect(na).To(HaveLen(14 + 40 + 32))
+		Expect(net.HardwareAddr(na[0:6]).String()).To(Equal("33:33:00:00:00:01"))
+		Expect(binary.BigEndian.Uint16(na[12:14])).To(Equal(uint16(0x86dd)))
+		Expect(na[21]).To(Equal(byte(255)))
+		Expect(net.IP(na[22:38]).String()).To(Equal("fd00::5"))
+		Expect(net.IP(na[38:54]).String()).To(Equal("ff02::1"))
+		Expect(na[54]).To(Equal(byte(136)))
+		Expect(net.IP(na[62:78]).String()).To(Equal("fd00::5"))
+		Expect(net.HardwareAddr(na[80:86])).To(Equal(mac))
+
+		// the checksum of a message along its pseudo-header sums to all ones
+		var sum uint32
+		for i := 22; i < 54; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(na[i : i+2]))
+		}
+		sum += 32 + 58
+		for i := 54; i < len(na); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(na[i : i+2]))
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		Expect(sum).To(Equal(uint32(0xffff)))
+	})
+
+	It("sends a RARP without addresses", func() {
+		frames := util.AnnouncementFrames(mac, nil)
+		Expect(frames).To(HaveLen(1))
+		Expect(binary.BigEndian.Uint16(frames[0][12:14])).To(Equal(uint16(0x8035)))
+		Expect(binary.BigEndian.Uint16(frames[0][20:22])).To(Equal(uint16(3)))
+		Expect(net.HardwareAddr(frames[0][32:38])).To(Equal(mac))
+	})
+})
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultAttachmentCacheDir is where attachments are recorded by default,
+// along the results cached by libcni.
+const DefaultAttachmentCacheDir = "/var/lib/cni/macvtap"
+
+// Attachment records what an ADD set up, so that DEL can clean it up even if
+// the netns is gone or the runtime does not provide it.
+type Attachment struct {
+	Network     string `json:"network"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	// NetNsPath is the netns the macvtap was moved or created into.
+	NetNsPath string `json:"netns"`
+	// DeviceID and TempIfaceName identify the macvtap allocated by the device
+	// plugin, empty when it was created from a master.
+	DeviceID      string `json:"deviceID,omitempty"`
+	TempIfaceName string `json:"tempIfaceName,omitempty"`
+	IfIndex       int    `json:"ifIndex"`
+	LowerDevice   string `json:"lowerDevice"`
+	// MAC and IPs are the addresses added to the BPF maps, if any, for DEL
+	// to remove them.
+	MAC string   `json:"mac,omitempty"`
+	IPs []string `json:"ips,omitempty"`
+	// MACPool and MACPoolKey are the pool the MAC of the macvtap was
+	// allocated from, if any, and the key of its lease, for GC to release
+	// it without the CNI_ARGS of the attachment.
+	MACPool    *MACPool `json:"macPool,omitempty"`
+	MACPoolKey string   `json:"macPoolKey,omitempty"`
+	// DeviceInfoFile is the device information file of the attachment,
+	// wherever the runtime asked for it, for GC to remove it.
+	DeviceInfoFile string `json:"deviceInfoFile,omitempty"`
+}
+
+// Owner returns the owner recorded on the macvtap of the attachment.
+func (a *Attachment) Owner() LinkOwner {
+	return LinkOwner{Network: a.Network, ContainerID: a.ContainerID, IfName: a.IfName}
+}
+
+// AttachmentCache keeps one record per attachment in a directory, the same
+// way libcni caches results.
+type AttachmentCache struct {
+	Dir string
+}
+
+// NewAttachmentCache returns the cache kept in dir, or in the default
+// directory if empty.
+func NewAttachmentCache(dir string) *AttachmentCache {
+	if dir == "" {
+		dir = DefaultAttachmentCacheDir
+	}
+	return &AttachmentCache{Dir: dir}
+}
+
+func (c *AttachmentCache) path(network string, containerID string, ifName string) string {
+	return filepath.Join(c.Dir, strings.Join([]string{network, containerID, ifName}, "-")+".json")
+}
+
+// Save records an attachment, replacing any previous record of it.
+func (c *AttachmentCache) Save(attachment *Attachment) error {
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %v", err)
+	}
+
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create attachment cache directory: %v", err)
+	}
+
+	path := c.path(attachment.Network, attachment.ContainerID, attachment.IfName)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save attachment record: %v", err)
+	}
+
+	return nil
+}
+
+// Load returns the record of an attachment, nil if there is none.
+func (c *AttachmentCache) Load(network string, containerID string, ifName string) (*Attachment, error) {
+	path := c.path(network, containerID, ifName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment record %s: %v", path, err)
+	}
+
+	attachment := &Attachment{}
+	if err := json.Unmarshal(data, attachment); err != nil {
+		return nil, fmt.Errorf("failed to parse attachment record %s: %v", path, err)
+	}
+
+	return attachment, nil
+}
+
+// Delete removes the record of an attachment, if any.
+func (c *AttachmentCache) Delete(network string, containerID string, ifName string) error {
+	path := c.path(network, containerID, ifName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove attachment record %s: %v", path, err)
+	}
+	return nil
+}
+
+// List returns the records of all the attachments of a network. Unreadable
+// records are skipped.
+func (c *AttachmentCache) List(network string) ([]*Attachment, error) {
+	entries, err := os.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachment records: %v", err)
+	}
+
+	var attachments []*Attachment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, network+"-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(c.Dir, name))
+		if err != nil {
+			continue
+		}
+		attachment := &Attachment{}
+		if err := json.Unmarshal(data, attachment); err != nil || attachment.Network != network {
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
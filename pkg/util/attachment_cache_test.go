@@ -0,0 +1,50 @@
+package util_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("AttachmentCache", func() {
+	var cache *util.AttachmentCache
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "attachments")
+		Expect(err).NotTo(HaveOccurred())
+		cache = util.NewAttachmentCache(dir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cache.Dir)
+	})
+
+	It("defaults to the libcni cache directory", func() {
+		Expect(util.NewAttachmentCache("").Dir).To(Equal(util.DefaultAttachmentCacheDir))
+	})
+
+	It("round trips an attachment", func() {
+		attachment := &util.Attachment{
+			Network:       "dataplane",
+			ContainerID:   "0123abcd",
+			IfName:        "net1",
+			NetNsPath:     "/var/run/netns/pod",
+			DeviceID:      "dataplaneMvp0",
+			TempIfaceName: util.TemporaryInterfaceName("dataplaneMvp0"),
+			IfIndex:       12,
+			LowerDevice:   "eth0",
+		}
+
+		Expect(cache.Save(attachment)).To(Succeed())
+		Expect(cache.Load("dataplane", "0123abcd", "net1")).To(Equal(attachment))
+		Expect(cache.List("dataplane")).To(ConsistOf(attachment))
+		Expect(cache.List("other")).To(BeEmpty())
+
+		Expect(cache.Delete("dataplane", "0123abcd", "net1")).To(Succeed())
+		Expect(cache.Load("dataplane", "0123abcd", "net1")).To(BeNil())
+		Expect(cache.Delete("dataplane", "0123abcd", "net1")).To(Succeed())
+	})
+})
@@ -0,0 +1,226 @@
+package util
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// latencyInMillis is the maximum time a packet may sit in the egress
+	// qdisc, used to size its queue.
+	latencyInMillis = 25
+	// policeMtu is the largest packet the ingress policer lets through,
+	// sized for GRO packets.
+	policeMtu = 65536
+)
+
+// BandwidthEntry holds the bandwidth limits of a macvtap interface, from the
+// point of view of its consumer. Rates are in bits per second and bursts in
+// bits. Zero rates are not limited.
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+func (bw *BandwidthEntry) isIngressSet() bool {
+	return bw != nil && bw.IngressRate > 0
+}
+
+func (bw *BandwidthEntry) isEgressSet() bool {
+	return bw != nil && bw.EgressRate > 0
+}
+
+// Validate checks the limits without applying them.
+func (bw *BandwidthEntry) Validate() error {
+	if bw == nil {
+		return nil
+	}
+
+	if bw.IngressRate > 0 && bw.IngressBurst == 0 {
+		return fmt.Errorf("ingressBurst is required along with ingressRate")
+	}
+	if bw.EgressRate > 0 && bw.EgressBurst == 0 {
+		return fmt.Errorf("egressBurst is required along with egressRate")
+	}
+
+	// the ingress policer rate and burst are kept in bytes as 32 bit values
+	if bw.IngressRate/8 > math.MaxUint32 || bw.IngressBurst/8 > math.MaxUint32 {
+		return fmt.Errorf("ingress rate and burst must be lower than %d bits", uint64(math.MaxUint32)*8)
+	}
+	if bw.EgressBurst/8 > math.MaxUint32 {
+		return fmt.Errorf("egressBurst must be lower than %d bits", uint64(math.MaxUint32)*8)
+	}
+
+	return nil
+}
+
+// SetBandwidth limits the bandwidth of the named interface in the current
+// netns, replacing any previous limits. What the consumer of the macvtap sends
+// goes through the egress of the interface, and is shaped with a TBF root
+// qdisc. What it receives goes through the ingress hook of the interface, and
+// is policed as there is no host side interface to redirect it to for
+// shaping.
+func SetBandwidth(name string, bw *BandwidthEntry) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if err := removeBandwidth(link); err != nil {
+		return err
+	}
+
+	if bw.isEgressSet() {
+		if err := netlink.QdiscAdd(newEgressQdisc(link.Attrs().Index, bw)); err != nil {
+			return fmt.Errorf("failed to add egress qdisc to %q: %v", name, err)
+		}
+	}
+
+	if bw.isIngressSet() {
+		if err := ensureClsact(link); err != nil {
+			return err
+		}
+		if err := netlink.FilterAdd(newIngressPolicer(link.Attrs().Index, bw)); err != nil {
+			return fmt.Errorf("failed to add ingress policer to %q: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveBandwidth removes the bandwidth limits from the named interface in the
+// current netns, if any.
+func RemoveBandwidth(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	return removeBandwidth(link)
+}
+
+func removeBandwidth(link netlink.Link) error {
+	name := link.Attrs().Name
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+	}
+
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Tbf); !ok {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("failed to delete egress qdisc of %q: %v", name, err)
+		}
+	}
+
+	if !hasClsact(qdiscs) {
+		return nil
+	}
+	return deleteFilters(link, netlink.HANDLE_MIN_INGRESS, bandwidthFilterPriority)
+}
+
+// CheckBandwidth verifies that the named interface in the current netns is
+// limited as expected.
+func CheckBandwidth(name string, bw *BandwidthEntry) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+	}
+
+	var tbf *netlink.Tbf
+	for _, qdisc := range qdiscs {
+		if q, ok := qdisc.(*netlink.Tbf); ok {
+			tbf = q
+		}
+	}
+
+	if bw.isEgressSet() {
+		if tbf == nil {
+			return fmt.Errorf("egress qdisc of %q not found", name)
+		}
+		if tbf.Rate != bw.EgressRate/8 {
+			return fmt.Errorf("egress rate of %q is %d bytes/s, expected %d", name, tbf.Rate, bw.EgressRate/8)
+		}
+	} else if tbf != nil {
+		return fmt.Errorf("unexpected egress qdisc on %q", name)
+	}
+
+	var filter netlink.Filter
+	if hasClsact(qdiscs) {
+		filter, err = findFilter(link, netlink.HANDLE_MIN_INGRESS, bandwidthFilterPriority)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !bw.isIngressSet() {
+		if filter != nil {
+			return fmt.Errorf("unexpected ingress policer on %q", name)
+		}
+		return nil
+	}
+
+	if matchAll, ok := filter.(*netlink.MatchAll); ok {
+		for _, action := range matchAll.Actions {
+			if police, ok := action.(*netlink.PoliceAction); ok && uint64(police.Rate) == bw.IngressRate/8 {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("ingress policer of %q with rate %d bytes/s not found", name, bw.IngressRate/8)
+}
+
+func newEgressQdisc(linkIndex int, bw *BandwidthEntry) *netlink.Tbf {
+	rateInBytes := bw.EgressRate / 8
+	burstInBytes := uint32(bw.EgressBurst / 8)
+	bufferInTicks := netlink.Xmittime(rateInBytes, burstInBytes)
+	latencyInUsec := float64(netlink.TIME_UNITS_PER_SEC) * latencyInMillis / 1000
+	limitInBytes := uint32(float64(rateInBytes)*latencyInUsec/float64(netlink.TIME_UNITS_PER_SEC)) + burstInBytes
+
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateInBytes,
+		Buffer: bufferInTicks,
+		Limit:  limitInBytes,
+	}
+}
+
+func newIngressPolicer(linkIndex int, bw *BandwidthEntry) *netlink.MatchAll {
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(bw.IngressRate / 8)
+	police.Burst = uint32(bw.IngressBurst / 8)
+	police.Mtu = policeMtu
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	// let the traffic within the limits go through the next filters
+	police.NotExceedAction = netlink.TC_POLICE_UNSPEC
+
+	return &netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  bandwidthFilterPriority,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{police},
+	}
+}
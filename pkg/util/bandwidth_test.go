@@ -0,0 +1,31 @@
+package util_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("BandwidthEntry", func() {
+	It("accepts unset limits", func() {
+		var bw *util.BandwidthEntry
+		Expect(bw.Validate()).To(Succeed())
+		Expect((&util.BandwidthEntry{}).Validate()).To(Succeed())
+	})
+
+	It("accepts rates along with their bursts", func() {
+		bw := &util.BandwidthEntry{IngressRate: 1000000, IngressBurst: 8000, EgressRate: 2000000, EgressBurst: 16000}
+		Expect(bw.Validate()).To(Succeed())
+	})
+
+	It("rejects rates without bursts", func() {
+		Expect((&util.BandwidthEntry{IngressRate: 1000000}).Validate()).NotTo(Succeed())
+		Expect((&util.BandwidthEntry{EgressRate: 1000000}).Validate()).NotTo(Succeed())
+	})
+
+	It("rejects limits the kernel can't hold", func() {
+		bw := &util.BandwidthEntry{IngressRate: 1 << 40, IngressBurst: 8000}
+		Expect(bw.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,460 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// BPFConfig names the BPF programs and maps pinned in bpffs that apply to a
+// macvtap interface.
+type BPFConfig struct {
+	// Ingress and Egress are the tc programs attached to the clsact hooks of
+	// the interface, in direct action mode.
+	Ingress string `json:"ingress,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+	// MACMap is a hash map the MAC of the interface is added to, along its
+	// index in the pod netns as a 32 bit value.
+	MACMap string `json:"macMap,omitempty"`
+	// IPMap is a hash map the IPs of the interface are added to, as 16 byte
+	// IPv6 or IPv4-mapped IPv6 addresses, along the MAC of the interface.
+	IPMap string `json:"ipMap,omitempty"`
+}
+
+// Sizes of the keys and values of the maps, as the programs expect them.
+const (
+	macMapKeySize   = 6
+	macMapValueSize = 4
+	ipMapKeySize    = 16
+	ipMapValueSize  = 6
+)
+
+// BPF holds the pinned BPF programs and maps of a BPFConfig, opened.
+type BPF struct {
+	config    BPFConfig
+	ingressFd int
+	egressFd  int
+	macMapFd  int
+	ipMapFd   int
+}
+
+// bpfProgInfo and bpfMapInfo are the leading fields of the kernel
+// bpf_prog_info and bpf_map_info, which are all that is needed.
+type bpfProgInfo struct {
+	Type uint32
+	ID   uint32
+}
+
+type bpfMapInfo struct {
+	Type       uint32
+	ID         uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+}
+
+// Validate checks the configuration without opening the pinned objects.
+func (c *BPFConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	for _, path := range []string{c.Ingress, c.Egress, c.MACMap, c.IPMap} {
+		if path != "" && !filepath.IsAbs(path) {
+			return fmt.Errorf("invalid pinned object path %q, expected an absolute path", path)
+		}
+	}
+	if c.Ingress == "" && c.Egress == "" {
+		return fmt.Errorf("an ingress or egress program is required")
+	}
+
+	return nil
+}
+
+// OpenBPF opens the pinned programs and maps of the configuration and checks
+// they are of the expected types and sizes. It returns nil without any.
+func OpenBPF(c *BPFConfig) (*BPF, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	b := &BPF{config: *c, ingressFd: -1, egressFd: -1, macMapFd: -1, ipMapFd: -1}
+	open := func(path string, fd *int, check func(fd int) error) error {
+		if path == "" {
+			return nil
+		}
+		var err error
+		if *fd, err = bpfObjGet(path); err != nil {
+			return fmt.Errorf("failed to open pinned object %s: %v", path, err)
+		}
+		if err := check(*fd); err != nil {
+			return fmt.Errorf("unexpected pinned object %s: %v", path, err)
+		}
+		return nil
+	}
+	checkProg := func(fd int) error {
+		info := bpfProgInfo{}
+		if err := bpfObjGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+			return err
+		}
+		if info.Type != unix.BPF_PROG_TYPE_SCHED_CLS {
+			return fmt.Errorf("program of type %d, expected a tc classifier", info.Type)
+		}
+		return nil
+	}
+	checkMap := func(keySize uint32, valueSize uint32) func(fd int) error {
+		return func(fd int) error {
+			info := bpfMapInfo{}
+			if err := bpfObjGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+				return err
+			}
+			if info.KeySize != keySize || info.ValueSize != valueSize {
+				return fmt.Errorf("map with %d byte keys and %d byte values, expected %d and %d", info.KeySize, info.ValueSize, keySize, valueSize)
+			}
+			return nil
+		}
+	}
+
+	err := errors.Join(
+		open(c.Ingress, &b.ingressFd, checkProg),
+		open(c.Egress, &b.egressFd, checkProg),
+		open(c.MACMap, &b.macMapFd, checkMap(macMapKeySize, macMapValueSize)),
+		open(c.IPMap, &b.ipMapFd, checkMap(ipMapKeySize, ipMapValueSize)),
+	)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Close closes the pinned objects, which stay pinned.
+func (b *BPF) Close() {
+	if b == nil {
+		return
+	}
+	for _, fd := range []int{b.ingressFd, b.egressFd, b.macMapFd, b.ipMapFd} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// Attach attaches the programs to the clsact hooks of the named interface in
+// the current netns, replacing any previously attached ones. Programs
+// returning TC_ACT_UNSPEC let the spoof check and the mirror, which come next
+// on the egress hook, have their say.
+func (b *BPF) Attach(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if err := detachBPF(link); err != nil {
+		return err
+	}
+
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	for _, filter := range b.filters(link.Attrs().Index) {
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to attach BPF program %s to %q: %v", filter.Name, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Check verifies that the programs are attached to the named interface in the
+// current netns.
+func (b *BPF) Check(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	for _, expected := range b.filters(link.Attrs().Index) {
+		info := bpfProgInfo{}
+		if err := bpfObjGetInfo(expected.Fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+			return fmt.Errorf("failed to get the id of BPF program %s: %v", expected.Name, err)
+		}
+
+		filter, err := findFilter(link, expected.Parent, bpfFilterPriority)
+		if err != nil {
+			return err
+		}
+		if bpf, ok := filter.(*netlink.BpfFilter); !ok || bpf.Id != int(info.ID) {
+			return fmt.Errorf("BPF program %s is not attached to %q", expected.Name, name)
+		}
+	}
+
+	return nil
+}
+
+// DetachBPF detaches the programs from the named interface in the current
+// netns, if any.
+func DetachBPF(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	return detachBPF(link)
+}
+
+func detachBPF(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	if !hasClsact(qdiscs) {
+		return nil
+	}
+
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		if err := deleteFilters(link, parent, bpfFilterPriority); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *BPF) filters(linkIndex int) []*netlink.BpfFilter {
+	var filters []*netlink.BpfFilter
+	for _, prog := range []struct {
+		path   string
+		fd     int
+		parent uint32
+	}{{b.config.Ingress, b.ingressFd, netlink.HANDLE_MIN_INGRESS}, {b.config.Egress, b.egressFd, netlink.HANDLE_MIN_EGRESS}} {
+		if prog.fd < 0 {
+			continue
+		}
+		filters = append(filters, &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: linkIndex,
+				Parent:    prog.parent,
+				Priority:  bpfFilterPriority,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Fd:           prog.fd,
+			Name:         filepath.Base(prog.path),
+			DirectAction: true,
+		})
+	}
+	return filters
+}
+
+// AddToMaps adds the MAC and IPs of the interface with the given index in the
+// pod netns to the maps, replacing existing entries.
+func (b *BPF) AddToMaps(mac net.HardwareAddr, ips []net.IP, ifIndex int) error {
+	if b.macMapFd >= 0 {
+		if err := bpfMapUpdate(b.macMapFd, mac, ifIndexValue(ifIndex)); err != nil {
+			return fmt.Errorf("failed to add %s to map %s: %v", mac, b.config.MACMap, err)
+		}
+	}
+
+	if b.ipMapFd >= 0 {
+		for _, ip := range ips {
+			if err := bpfMapUpdate(b.ipMapFd, ip.To16(), mac); err != nil {
+				return fmt.Errorf("failed to add %s to map %s: %v", ip, b.config.IPMap, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckMaps verifies that the MAC and IPs of the interface with the given
+// index in the pod netns are in the maps.
+func (b *BPF) CheckMaps(mac net.HardwareAddr, ips []net.IP, ifIndex int) error {
+	if b.macMapFd >= 0 {
+		if err := checkMapEntry(b.macMapFd, mac, ifIndexValue(ifIndex)); err != nil {
+			return fmt.Errorf("%s in map %s: %v", mac, b.config.MACMap, err)
+		}
+	}
+
+	if b.ipMapFd >= 0 {
+		for _, ip := range ips {
+			if err := checkMapEntry(b.ipMapFd, ip.To16(), mac); err != nil {
+				return fmt.Errorf("%s in map %s: %v", ip, b.config.IPMap, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RemoveFromMaps removes the MAC and IPs of the interface with the given index
+// in the pod netns from the maps of the configuration, if still pinned. Entries
+// no longer pointing to the interface, e.g. taken over by another attachment
+// since, are left alone.
+func RemoveFromMaps(c *BPFConfig, mac net.HardwareAddr, ips []net.IP, ifIndex int) error {
+	if c == nil {
+		return nil
+	}
+
+	type entry struct {
+		key   []byte
+		value []byte
+	}
+	remove := func(path string, entries []entry) error {
+		if path == "" || len(entries) == 0 {
+			return nil
+		}
+		fd, err := bpfObjGet(path)
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open pinned object %s: %v", path, err)
+		}
+		defer unix.Close(fd)
+
+		for _, e := range entries {
+			value := make([]byte, len(e.value))
+			err := bpfMapLookup(fd, e.key, value)
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to look up entry in map %s: %v", path, err)
+			}
+			if !bytes.Equal(value, e.value) {
+				continue
+			}
+			if err := bpfMapDelete(fd, e.key); err != nil && !errors.Is(err, unix.ENOENT) {
+				return fmt.Errorf("failed to remove entry from map %s: %v", path, err)
+			}
+		}
+		return nil
+	}
+
+	var macEntries, ipEntries []entry
+	if mac != nil {
+		macEntries = append(macEntries, entry{mac, ifIndexValue(ifIndex)})
+		for _, ip := range ips {
+			ipEntries = append(ipEntries, entry{ip.To16(), mac})
+		}
+	}
+
+	return errors.Join(remove(c.MACMap, macEntries), remove(c.IPMap, ipEntries))
+}
+
+// ifIndexValue returns the value of the MAC map for the interface with the
+// given index.
+func ifIndexValue(ifIndex int) []byte {
+	value := make([]byte, macMapValueSize)
+	binary.NativeEndian.PutUint32(value, uint32(ifIndex))
+	return value
+}
+
+// checkMapEntry verifies that the map has the given value for key.
+func checkMapEntry(fd int, key []byte, expected []byte) error {
+	value := make([]byte, len(expected))
+	err := bpfMapLookup(fd, key, value)
+	if errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("entry not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up entry: %v", err)
+	}
+	if !bytes.Equal(value, expected) {
+		return fmt.Errorf("entry belongs to another interface")
+	}
+	return nil
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func bpfObjGet(path string) (int, error) {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	attr := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(pathname)))}
+
+	fd, err := bpf(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	if err != nil {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+func bpfObjGetInfo(fd int, info unsafe.Pointer, size uintptr) error {
+	attr := struct {
+		BpfFd   uint32
+		InfoLen uint32
+		Info    uint64
+	}{BpfFd: uint32(fd), InfoLen: uint32(size), Info: uint64(uintptr(info))}
+
+	_, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(info)
+	return err
+}
+
+func bpfMapUpdate(fd int, key []byte, value []byte) error {
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{MapFd: uint32(fd), Key: uint64(uintptr(unsafe.Pointer(&key[0]))), Value: uint64(uintptr(unsafe.Pointer(&value[0]))), Flags: unix.BPF_ANY}
+
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func bpfMapLookup(fd int, key []byte, value []byte) error {
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{MapFd: uint32(fd), Key: uint64(uintptr(unsafe.Pointer(&key[0]))), Value: uint64(uintptr(unsafe.Pointer(&value[0])))}
+
+	_, err := bpf(unix.BPF_MAP_LOOKUP_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func bpfMapDelete(fd int, key []byte) error {
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+	}{MapFd: uint32(fd), Key: uint64(uintptr(unsafe.Pointer(&key[0])))}
+
+	_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	return err
+}
@@ -0,0 +1,32 @@
+package util_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("BPF configuration", func() {
+	It("accepts pinned programs and maps", func() {
+		var config *util.BPFConfig
+		Expect(config.Validate()).To(Succeed())
+
+		config = &util.BPFConfig{
+			Egress: "/sys/fs/bpf/macvtap/egress",
+			MACMap: "/sys/fs/bpf/macvtap/macs",
+			IPMap:  "/sys/fs/bpf/macvtap/ips",
+		}
+		Expect(config.Validate()).To(Succeed())
+	})
+
+	It("rejects relative paths", func() {
+		config := &util.BPFConfig{Ingress: "macvtap/ingress"}
+		Expect(config.Validate()).NotTo(Succeed())
+	})
+
+	It("rejects maps without programs", func() {
+		config := &util.BPFConfig{MACMap: "/sys/fs/bpf/macvtap/macs"}
+		Expect(config.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,167 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DeviceInfoDir is where device information files are kept, as defined by
+	// the Network Plumbing Working Group device information specification.
+	DeviceInfoDir = "/var/run/k8s.cni.cncf.io/devinfo"
+	// DeviceInfoVersion is the version of the specification implemented.
+	DeviceInfoVersion = "1.1.0"
+	// DeviceInfoTypeMacvtap is the device information type of macvtap devices.
+	// The specification does not define one for them, so this type and its
+	// macvtap section are an extension of it, which consumers that only
+	// know the types of the specification ignore.
+	DeviceInfoTypeMacvtap = "macvtap"
+
+	deviceInfoSuffix = "device.json"
+)
+
+// DeviceInfo holds the information of a device, as defined by the device
+// information specification.
+type DeviceInfo struct {
+	Type    string             `json:"type"`
+	Version string             `json:"version"`
+	Macvtap *MacvtapDeviceInfo `json:"macvtap,omitempty"`
+}
+
+// MacvtapDeviceInfo holds the information consumers need to open a macvtap
+// device.
+type MacvtapDeviceInfo struct {
+	TapPath     string `json:"tap-path"`
+	LowerDevice string `json:"lower-device"`
+	Mode        string `json:"mode"`
+	IfIndex     int    `json:"ifindex"`
+	MAC         string `json:"mac"`
+	// LearnedIPs are the addresses the consumer of the macvtap was seen
+	// using, as learned by the device plugin from the traffic of the lower
+	// device.
+	LearnedIPs []string `json:"learned-ips,omitempty"`
+}
+
+// NewMacvtapDeviceInfo returns the information of the named macvtap interface
+// of the current netns. The lower device is provided by the caller as the
+// parent of the interface may live in a different netns.
+func NewMacvtapDeviceInfo(name string, lowerDevice string) (*DeviceInfo, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok {
+		return nil, fmt.Errorf("device %q is of type %q, not macvtap", name, link.Type())
+	}
+
+	return &DeviceInfo{
+		Type:    DeviceInfoTypeMacvtap,
+		Version: DeviceInfoVersion,
+		Macvtap: &MacvtapDeviceInfo{
+			TapPath:     TapDevicePath(macvtap.Attrs().Index),
+			LowerDevice: lowerDevice,
+			Mode:        ModeToString(macvtap.Mode),
+			IfIndex:     macvtap.Attrs().Index,
+			MAC:         macvtap.Attrs().HardwareAddr.String(),
+		},
+	}, nil
+}
+
+// DeviceInfoPathForDP returns the path of the device information file of a
+// device allocated by a device plugin.
+func DeviceInfoPathForDP(resourceName string, deviceID string) string {
+	name := strings.Join([]string{strings.ReplaceAll(resourceName, "/", "-"), deviceID, deviceInfoSuffix}, "-")
+	return filepath.Join(DeviceInfoDir, "dp", name)
+}
+
+// DeviceInfoPathForCNI returns the path of the device information file of a
+// network attachment.
+func DeviceInfoPathForCNI(network string, containerID string, ifName string) string {
+	name := strings.Join([]string{network, containerID, ifName, deviceInfoSuffix}, "-")
+	return filepath.Join(DeviceInfoDir, "cni", name)
+}
+
+// lockDeviceInfoDir locks the directory of the device information file at
+// path, which is held while the file is written or removed, so that the
+// addresses learned by the device plugin are not published to a stale copy of
+// it. The returned function releases the lock. A missing directory is not
+// locked.
+func lockDeviceInfoDir(path string) (func(), error) {
+	dirPath := filepath.Dir(path)
+	dir, err := os.Open(dirPath)
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device info directory %s: %v", dirPath, err)
+	}
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to lock device info directory %s: %v", dirPath, err)
+	}
+	// closing the directory releases the lock
+	return func() { dir.Close() }, nil
+}
+
+// SaveDeviceInfo writes a device information file, replacing any previous
+// one. The file is written aside and renamed so that readers never see a
+// partial file.
+func SaveDeviceInfo(path string, info *DeviceInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device info: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create device info directory: %v", err)
+	}
+
+	unlock, err := lockDeviceInfoDir(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := writeFileAtomic(path, data, 0444); err != nil {
+		return fmt.Errorf("failed to save device info: %v", err)
+	}
+
+	return nil
+}
+
+// LoadDeviceInfo reads a device information file.
+func LoadDeviceInfo(path string) (*DeviceInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device info file %s: %v", path, err)
+	}
+
+	info := &DeviceInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("failed to parse device info file %s: %v", path, err)
+	}
+
+	return info, nil
+}
+
+// CleanDeviceInfo removes a device information file, if it exists.
+func CleanDeviceInfo(path string) error {
+	unlock, err := lockDeviceInfoDir(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove device info file %s: %v", path, err)
+	}
+	return nil
+}
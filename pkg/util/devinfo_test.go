@@ -0,0 +1,54 @@
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("DeviceInfo", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("names the files as defined by the specification", func() {
+		Expect(util.DeviceInfoPathForDP("macvtap.network.kubevirt.io/dataplane", "dataplaneMvp0")).To(
+			Equal("/var/run/k8s.cni.cncf.io/devinfo/dp/macvtap.network.kubevirt.io-dataplane-dataplaneMvp0-device.json"))
+		Expect(util.DeviceInfoPathForCNI("dataplane", "0123abcd", "net1")).To(
+			Equal("/var/run/k8s.cni.cncf.io/devinfo/cni/dataplane-0123abcd-net1-device.json"))
+	})
+
+	It("round trips through a file", func() {
+		info := &util.DeviceInfo{
+			Type:    util.DeviceInfoTypeMacvtap,
+			Version: util.DeviceInfoVersion,
+			Macvtap: &util.MacvtapDeviceInfo{
+				TapPath:     "/dev/tap12",
+				LowerDevice: "eth0",
+				Mode:        "bridge",
+				IfIndex:     12,
+				MAC:         "02:00:00:00:00:01",
+			},
+		}
+		path := filepath.Join(dir, "cni", "dataplane-0123abcd-net1-device.json")
+
+		Expect(util.SaveDeviceInfo(path, info)).To(Succeed())
+		Expect(util.LoadDeviceInfo(path)).To(Equal(info))
+
+		Expect(util.CleanDeviceInfo(path)).To(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+		Expect(util.CleanDeviceInfo(path)).To(Succeed())
+	})
+})
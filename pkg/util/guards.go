@@ -0,0 +1,290 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Guards keep the consumer of a macvtap interface from acting as a network
+// service it is not meant to be on the network of the lower device.
+const (
+	// GuardDHCP drops the DHCPv4 and DHCPv6 server replies.
+	GuardDHCP = "dhcp"
+	// GuardRA drops the ICMPv6 router advertisements and redirects.
+	GuardRA = "ra"
+)
+
+const (
+	dhcpv4ServerPort = 67
+	dhcpv6ServerPort = 547
+
+	icmpv6RouterAdvertisement = 134
+	icmpv6Redirect            = 137
+
+	// icmpv6TypeTable is the u32 hash table the ICMPv6 messages found
+	// after an extension header are matched by type in.
+	icmpv6TypeTable = 0x00100000
+)
+
+// IPv6 extension headers the RA guard looks through: all but the fragment
+// header carry their length in 8-octet units, not including the first 8
+// octets, in their second octet.
+var ipv6ExtensionHeaders = []uint32{unix.IPPROTO_HOPOPTS, unix.IPPROTO_ROUTING, unix.IPPROTO_FRAGMENT, unix.IPPROTO_DSTOPTS}
+
+// ValidateGuards checks that the guards are known ones.
+func ValidateGuards(guards []string) error {
+	for _, guard := range guards {
+		if guard != GuardDHCP && guard != GuardRA {
+			return fmt.Errorf("unknown guard %q, expected %q or %q", guard, GuardDHCP, GuardRA)
+		}
+	}
+	return nil
+}
+
+// SetGuards drops the frames the consumer of the named macvtap interface in
+// the current netns sends that the guards are against, replacing any previous
+// guards. The frames it sends go through the egress hook of the interface.
+func SetGuards(name string, guards []string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if err := removeGuards(link); err != nil {
+		return err
+	}
+
+	filters := newGuardFilters(link.Attrs().Index, guards)
+	if len(filters) == 0 {
+		return nil
+	}
+
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add guard %s filter to %q: %v", filter.Type(), name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveGuards removes the guards from the named interface in the current
+// netns, if any.
+func RemoveGuards(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	return removeGuards(link)
+}
+
+func removeGuards(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	if !hasClsact(qdiscs) {
+		return nil
+	}
+
+	for _, priority := range []uint16{guardDHCPPriority, guardICMPv6Priority} {
+		if err := deleteFilters(link, netlink.HANDLE_MIN_EGRESS, priority); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckGuards verifies that the named interface in the current netns is
+// guarded as expected.
+func CheckGuards(name string, guards []string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+	if err != nil {
+		return fmt.Errorf("failed to list filters of %q: %v", name, err)
+	}
+
+	for _, expected := range newGuardFilters(link.Attrs().Index, guards) {
+		// hash tables are not listed, only the filters in them
+		if u32, ok := expected.(*netlink.U32); ok && u32.Divisor != 0 {
+			continue
+		}
+		found := false
+		for _, filter := range filters {
+			if sameGuardFilter(filter, expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("guard %s filter with priority %d of %q not found", expected.Type(), expected.Attrs().Priority, name)
+		}
+	}
+
+	return nil
+}
+
+// newGuardFilters returns the filters dropping what the guards are against,
+// in the order they are to be added. VLAN tagged frames are dropped, as the
+// filters only look into untagged ones. DHCP server replies are told by their
+// source port. ICMPv6 messages are told by their type, right after the IPv6
+// header or after a hop-by-hop, routing, destination options or first
+// fragment header; IPv6 packets starting with more than one of these
+// extension headers are dropped, as what follows them is not looked into.
+func newGuardFilters(linkIndex int, guards []string) []netlink.Filter {
+	if len(guards) == 0 {
+		return nil
+	}
+
+	flowerAttrs := netlink.FilterAttrs{
+		LinkIndex: linkIndex,
+		Parent:    netlink.HANDLE_MIN_EGRESS,
+		Priority:  guardDHCPPriority,
+		Protocol:  unix.ETH_P_ALL,
+	}
+	var filters []netlink.Filter
+	for _, ethType := range []uint16{unix.ETH_P_8021Q, unix.ETH_P_8021AD} {
+		filters = append(filters, &netlink.Flower{
+			FilterAttrs: flowerAttrs,
+			EthType:     ethType,
+			Actions:     []netlink.Action{newGenericAction(netlink.TC_ACT_SHOT)},
+		})
+	}
+
+	seen := map[string]bool{}
+	for _, guard := range guards {
+		if seen[guard] {
+			continue
+		}
+		seen[guard] = true
+
+		switch guard {
+		case GuardDHCP:
+			udp := nl.IPProto(unix.IPPROTO_UDP)
+			for _, server := range []struct {
+				ethType uint16
+				port    uint16
+			}{{unix.ETH_P_IP, dhcpv4ServerPort}, {unix.ETH_P_IPV6, dhcpv6ServerPort}} {
+				filters = append(filters, &netlink.Flower{
+					FilterAttrs: flowerAttrs,
+					EthType:     server.ethType,
+					IPProto:     &udp,
+					SrcPort:     server.port,
+					Actions:     []netlink.Action{newGenericAction(netlink.TC_ACT_SHOT)},
+				})
+			}
+		case GuardRA:
+			filters = append(filters, newRAGuardFilters(linkIndex)...)
+		}
+	}
+	return filters
+}
+
+// newRAGuardFilters returns the u32 filters dropping the ICMPv6 router
+// advertisements and redirects. The offsets are relative to the IPv6 header.
+func newRAGuardFilters(linkIndex int) []netlink.Filter {
+	attrs := netlink.FilterAttrs{
+		LinkIndex: linkIndex,
+		Parent:    netlink.HANDLE_MIN_EGRESS,
+		Priority:  guardICMPv6Priority,
+		Protocol:  unix.ETH_P_IPV6,
+	}
+	drop := func(keys ...netlink.TcU32Key) *netlink.U32 {
+		return &netlink.U32{
+			FilterAttrs: attrs,
+			Sel:         &netlink.TcU32Sel{Flags: nl.TC_U32_TERMINAL, Keys: keys},
+			Actions:     []netlink.Action{newGenericAction(netlink.TC_ACT_SHOT)},
+		}
+	}
+	// next header of the IPv6 header
+	nextHeader := func(proto uint32) netlink.TcU32Key {
+		return netlink.TcU32Key{Mask: 0x0000ff00, Val: proto << 8, Off: 4}
+	}
+	// next header of the extension header following the IPv6 header
+	extensionNextHeader := func(proto uint32) netlink.TcU32Key {
+		return netlink.TcU32Key{Mask: 0xff000000, Val: proto << 24, Off: 40}
+	}
+
+	tableAttrs := attrs
+	tableAttrs.Handle = icmpv6TypeTable
+	filters := []netlink.Filter{&netlink.U32{FilterAttrs: tableAttrs, Divisor: 1}}
+
+	for _, icmpType := range []uint32{icmpv6RouterAdvertisement, icmpv6Redirect} {
+		// type of the ICMPv6 message, once past the extension header
+		typeDrop := drop(netlink.TcU32Key{Mask: 0xff000000, Val: icmpType << 24})
+		typeDrop.Hash = icmpv6TypeTable
+		filters = append(filters,
+			typeDrop,
+			drop(nextHeader(unix.IPPROTO_ICMPV6), netlink.TcU32Key{Mask: 0xff000000, Val: icmpType << 24, Off: 40}),
+		)
+	}
+
+	for _, ext := range ipv6ExtensionHeaders {
+		link := &netlink.U32{
+			FilterAttrs: attrs,
+			Link:        icmpv6TypeTable,
+			Sel: &netlink.TcU32Sel{
+				Keys: []netlink.TcU32Key{nextHeader(ext), extensionNextHeader(unix.IPPROTO_ICMPV6)},
+			},
+		}
+		if ext == unix.IPPROTO_FRAGMENT {
+			// only the first fragment has the ICMPv6 header, the fragment
+			// header is 8 octets long
+			link.Sel.Keys[1].Mask |= 0x0000fff8
+			link.Sel.Flags = nl.TC_U32_OFFSET | nl.TC_U32_EAT
+			link.Sel.Off = 48
+		} else {
+			// skip (length + 1) * 8 octets after the IPv6 header, the
+			// length being the second octet of the extension header
+			link.Sel.Flags = nl.TC_U32_VAROFFSET | nl.TC_U32_EAT
+			link.Sel.Offoff = 41
+			link.Sel.Offmask = 0xff00
+			link.Sel.Offshift = 5
+			link.Sel.Off = 48
+		}
+		filters = append(filters, link)
+
+		for _, next := range ipv6ExtensionHeaders {
+			filters = append(filters, drop(nextHeader(ext), extensionNextHeader(next)))
+		}
+	}
+
+	return filters
+}
+
+// sameGuardFilter tells whether an installed filter matches the same frames
+// as an expected one.
+func sameGuardFilter(filter netlink.Filter, expected netlink.Filter) bool {
+	if filter.Attrs().Priority != expected.Attrs().Priority || filter.Type() != expected.Type() {
+		return false
+	}
+
+	switch expected := expected.(type) {
+	case *netlink.Flower:
+		flower := filter.(*netlink.Flower)
+		return flower.EthType == expected.EthType && flower.SrcPort == expected.SrcPort
+	case *netlink.U32:
+		u32 := filter.(*netlink.U32)
+		if u32.Link != expected.Link || (expected.Hash != 0 && u32.Hash != expected.Hash) {
+			return false
+		}
+		return sameU32Selector(u32, expected)
+	}
+
+	return false
+}
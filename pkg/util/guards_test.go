@@ -0,0 +1,135 @@
+package util_test
+
+import (
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Guards", func() {
+	It("accepts the known guards", func() {
+		Expect(util.ValidateGuards(nil)).To(Succeed())
+		Expect(util.ValidateGuards([]string{util.GuardDHCP, util.GuardRA})).To(Succeed())
+	})
+
+	It("rejects unknown guards", func() {
+		Expect(util.ValidateGuards([]string{"dhcp", "arp"})).NotTo(Succeed())
+	})
+
+	Context("on an interface", func() {
+		const ifaceName = "guarded0"
+		var testNs ns.NetNS
+
+		BeforeEach(func() {
+			var err error
+			testNs, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name:      ifaceName,
+					Namespace: netlink.NsFd(int(testNs.Fd())),
+				},
+			})).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(testNs.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(testNs)).To(Succeed())
+		})
+
+		egressFilters := func() []netlink.Filter {
+			link, err := netlink.LinkByName(ifaceName)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+			Expect(err).NotTo(HaveOccurred())
+			return filters
+		}
+
+		// u32Filters returns the u32 filters whose first key matches the
+		// given next header of the IPv6 header.
+		u32Filters := func(filters []netlink.Filter, nextHeader uint32) []*netlink.U32 {
+			var matching []*netlink.U32
+			for _, filter := range filters {
+				u32, ok := filter.(*netlink.U32)
+				if ok && u32.Sel.Keys[0] == (netlink.TcU32Key{Mask: 0x0000ff00, Val: nextHeader << 8, Off: 4}) {
+					matching = append(matching, u32)
+				}
+			}
+			return matching
+		}
+
+		It("drops the VLAN tagged frames and looks through the IPv6 extension headers", func() {
+			guards := []string{util.GuardDHCP, util.GuardRA}
+
+			testNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(util.SetGuards(ifaceName, guards)).To(Succeed())
+				Expect(util.CheckGuards(ifaceName, guards)).To(Succeed())
+
+				filters := egressFilters()
+				var ethTypes []uint16
+				for _, filter := range filters {
+					if flower, ok := filter.(*netlink.Flower); ok {
+						ethTypes = append(ethTypes, flower.EthType)
+					}
+				}
+				Expect(ethTypes).To(ConsistOf(uint16(unix.ETH_P_8021Q), uint16(unix.ETH_P_8021AD), uint16(unix.ETH_P_IP), uint16(unix.ETH_P_IPV6)))
+
+				// the type of the ICMPv6 messages is matched right after
+				// the IPv6 header
+				Expect(u32Filters(filters, unix.IPPROTO_ICMPV6)).To(HaveLen(2))
+
+				// a hop-by-hop header is skipped according to its length,
+				// and followed by another extension header is dropped
+				hopByHop := u32Filters(filters, unix.IPPROTO_HOPOPTS)
+				Expect(hopByHop).To(HaveLen(5))
+				var links []*netlink.U32
+				for _, u32 := range hopByHop {
+					if u32.Link != 0 {
+						links = append(links, u32)
+					}
+				}
+				Expect(links).To(HaveLen(1))
+				Expect(links[0].Sel.Flags).To(Equal(uint8(nl.TC_U32_VAROFFSET | nl.TC_U32_EAT)))
+				Expect(links[0].Sel.Offoff).To(Equal(int16(41)))
+				Expect(links[0].Sel.Offmask).To(Equal(uint16(0xff00)))
+				Expect(links[0].Sel.Offshift).To(Equal(uint8(5)))
+				Expect(links[0].Sel.Off).To(Equal(uint16(48)))
+
+				// only the first fragment is looked into
+				fragment := u32Filters(filters, unix.IPPROTO_FRAGMENT)
+				Expect(fragment).To(HaveLen(5))
+				Expect(fragment).To(ContainElement(WithTransform(func(u32 *netlink.U32) netlink.TcU32Key {
+					return u32.Sel.Keys[len(u32.Sel.Keys)-1]
+				}, Equal(netlink.TcU32Key{Mask: 0xff00fff8, Val: unix.IPPROTO_ICMPV6 << 24, Off: 40}))))
+
+				Expect(util.CheckGuards(ifaceName, []string{util.GuardRA})).To(Succeed())
+				Expect(util.RemoveGuards(ifaceName)).To(Succeed())
+				Expect(egressFilters()).To(BeEmpty())
+				Expect(util.CheckGuards(ifaceName, guards)).NotTo(Succeed())
+
+				return nil
+			})
+		})
+
+		It("installs nothing without guards", func() {
+			testNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(util.SetGuards(ifaceName, nil)).To(Succeed())
+				Expect(util.CheckGuards(ifaceName, nil)).To(Succeed())
+				Expect(egressFilters()).To(BeEmpty())
+
+				return nil
+			})
+		})
+	})
+})
@@ -12,3 +12,10 @@ func TemporaryInterfaceName(deviceID string) string {
 	h := xxhash.Sum64String(deviceID)
 	return fmt.Sprintf("mvt%012x", h&0xffffffffffff)
 }
+
+// MirrorInterfaceName returns the deterministic name of the monitoring
+// macvlan mirroring the traffic of the interface ifName of a container.
+func MirrorInterfaceName(containerID string, ifName string) string {
+	h := xxhash.Sum64String(containerID + "/" + ifName)
+	return fmt.Sprintf("mir%012x", h&0xffffffffffff)
+}
@@ -19,3 +19,16 @@ var _ = Describe("TemporaryInterfaceName", func() {
 		Expect(len(ifaceName)).To(BeNumerically("<=", 15))
 	})
 })
+
+var _ = Describe("MirrorInterfaceName", func() {
+	It("returns a deterministic name within IFNAMSIZ, per interface", func() {
+		containerID := "a-very-long-container-id-that-would-overflow-ifname"
+
+		ifaceName := util.MirrorInterfaceName(containerID, "net1")
+
+		Expect(ifaceName).To(Equal(util.MirrorInterfaceName(containerID, "net1")))
+		Expect(ifaceName).NotTo(Equal(util.MirrorInterfaceName(containerID, "net2")))
+		Expect(ifaceName).To(HavePrefix("mir"))
+		Expect(len(ifaceName)).To(BeNumerically("<=", 15))
+	})
+})
@@ -0,0 +1,320 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Sources of the addresses learned from the traffic of a lower device.
+const (
+	LearnedFromARP  = "arp"
+	LearnedFromDHCP = "dhcp"
+	LearnedFromNDP  = "ndp"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+	dhcpMagic      = 0x63825363
+	dhcpOptPad     = 0
+	dhcpOptLease   = 51
+	dhcpOptMsgType = 53
+	dhcpOptEnd     = 255
+	dhcpAck        = 5
+
+	icmpv6NeighborSol = 135
+
+	// snifferSnapLen is the length captured of each frame, enough for the
+	// DHCP options.
+	snifferSnapLen = 1500
+)
+
+// IPObservation is an address seen in use by a MAC in the traffic of a
+// lower device.
+type IPObservation struct {
+	MAC    net.HardwareAddr
+	IP     net.IP
+	Source string
+	// Lease is the lease time granted by a DHCP server, zero if unknown.
+	Lease time.Duration
+}
+
+// ParseIPObservation returns the address a frame tells to be in use by a MAC,
+// nil if it tells none:
+//   - the sender of an ARP packet sent from the MAC,
+//   - the address granted to a client by a DHCP server acknowledgement,
+//   - the source of a neighbor solicitation, or the target of a neighbor
+//     advertisement, sent from the MAC.
+//
+// ARP packets and neighbor discovery messages are only learned from when
+// outgoing, as sent by the consumers of the lower device: any host of the
+// network could otherwise claim their addresses. Unspecified, multicast and
+// IPv6 link-local addresses are ignored.
+func ParseIPObservation(frame []byte, outgoing bool) *IPObservation {
+	if len(frame) < 14 {
+		return nil
+	}
+	src := net.HardwareAddr(frame[6:12])
+	payload := frame[14:]
+
+	var o *IPObservation
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case unix.ETH_P_ARP:
+		if outgoing {
+			o = parseARPObservation(src, payload)
+		}
+	case unix.ETH_P_IP:
+		o = parseDHCPObservation(payload)
+	case unix.ETH_P_IPV6:
+		if outgoing {
+			o = parseNDPObservation(src, payload)
+		}
+	}
+	if o == nil || o.IP.IsUnspecified() || o.IP.IsMulticast() || o.IP.IsLinkLocalUnicast() {
+		return nil
+	}
+	return o
+}
+
+func parseARPObservation(src net.HardwareAddr, arp []byte) *IPObservation {
+	if len(arp) < 28 || binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != unix.ETH_P_IP || arp[4] != 6 || arp[5] != 4 {
+		return nil
+	}
+	if !bytes.Equal(arp[8:14], src) {
+		return nil
+	}
+	return &IPObservation{
+		MAC:    copyMAC(arp[8:14]),
+		IP:     copyIP(arp[14:18]),
+		Source: LearnedFromARP,
+	}
+}
+
+func parseDHCPObservation(ip []byte) *IPObservation {
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != unix.IPPROTO_UDP {
+		return nil
+	}
+	// only the first fragment holds the UDP header
+	if binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0 {
+		return nil
+	}
+	headerLen := int(ip[0]&0x0f) * 4
+	if len(ip) < headerLen+8 {
+		return nil
+	}
+	udp := ip[headerLen:]
+	if binary.BigEndian.Uint16(udp[0:2]) != dhcpServerPort || binary.BigEndian.Uint16(udp[2:4]) != dhcpClientPort {
+		return nil
+	}
+
+	bootp := udp[8:]
+	if len(bootp) < 240 || bootp[0] != 2 || bootp[1] != 1 || bootp[2] != 6 || binary.BigEndian.Uint32(bootp[236:240]) != dhcpMagic {
+		return nil
+	}
+	o := &IPObservation{
+		MAC:    copyMAC(bootp[28:34]),
+		IP:     copyIP(bootp[16:20]),
+		Source: LearnedFromDHCP,
+	}
+
+	ack := false
+	options := bootp[240:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil
+		}
+		value := options[2 : 2+int(options[1])]
+		switch {
+		case code == dhcpOptMsgType && len(value) == 1:
+			ack = value[0] == dhcpAck
+		case code == dhcpOptLease && len(value) == 4:
+			o.Lease = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		}
+		options = options[2+len(value):]
+	}
+	if !ack {
+		return nil
+	}
+	return o
+}
+
+func parseNDPObservation(src net.HardwareAddr, ip []byte) *IPObservation {
+	// neighbor discovery messages follow the IPv6 header right away
+	if len(ip) < 40+24 || ip[0]>>4 != 6 || ip[6] != unix.IPPROTO_ICMPV6 || ip[7] != 255 {
+		return nil
+	}
+	icmp := ip[40:]
+	o := &IPObservation{MAC: copyMAC(src), Source: LearnedFromNDP}
+	switch icmp[0] {
+	case icmpv6NeighborSol:
+		o.IP = copyIP(ip[8:24])
+	case icmpv6NeighborAdv:
+		o.IP = copyIP(icmp[8:24])
+	default:
+		return nil
+	}
+	return o
+}
+
+func copyMAC(b []byte) net.HardwareAddr {
+	return append(net.HardwareAddr(nil), b...)
+}
+
+func copyIP(b []byte) net.IP {
+	return append(net.IP(nil), b...)
+}
+
+// snifferFilter is a classic BPF program letting through the frames
+// ParseIPObservation may learn from: ARP, unfragmented DHCP server replies and
+// neighbor solicitations and advertisements.
+var snifferFilter = []unix.SockFilter{
+	/* 0 */ {Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12},
+	/* 1 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.ETH_P_ARP, Jt: 17},
+	/* 2 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.ETH_P_IP, Jf: 9},
+	// IPv4 UDP from port 67 to port 68
+	/* 3 */ {Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 23},
+	/* 4 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.IPPROTO_UDP, Jf: 13},
+	/* 5 */ {Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 20},
+	/* 6 */ {Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, K: 0x1fff, Jt: 11},
+	/* 7 */ {Code: unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH, K: 14},
+	/* 8 */ {Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 14},
+	/* 9 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: dhcpServerPort, Jf: 8},
+	/* 10 */ {Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 16},
+	/* 11 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: dhcpClientPort, Jt: 7, Jf: 6},
+	// IPv6 neighbor solicitations and advertisements
+	/* 12 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.ETH_P_IPV6, Jf: 5},
+	/* 13 */ {Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 20},
+	/* 14 */ {Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.IPPROTO_ICMPV6, Jf: 3},
+	/* 15 */ {Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 54},
+	/* 16 */ {Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: icmpv6NeighborSol, Jf: 1},
+	/* 17 */ {Code: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, K: icmpv6NeighborAdv, Jf: 1},
+	/* 18 */ {Code: unix.BPF_RET | unix.BPF_K, K: 0},
+	/* 19 */ {Code: unix.BPF_RET | unix.BPF_K, K: snifferSnapLen},
+}
+
+// Sniffer captures the frames a lower device receives and sends that
+// ParseIPObservation may learn from.
+type Sniffer struct {
+	fd int
+}
+
+// OpenSniffer opens a sniffer of the named lower device of the current
+// netns. Reads time out after timeout, so that the caller can check whether
+// to carry on.
+func OpenSniffer(lowerDevice string, timeout time.Duration) (*Sniffer, error) {
+	iface, err := net.InterfaceByName(lowerDevice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup device %q: %v", lowerDevice, err)
+	}
+
+	// No protocol until bound, so that no frame is queued before the filter
+	// is attached
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+	s := &Sniffer{fd: fd}
+
+	program := &unix.SockFprog{Len: uint16(len(snifferFilter)), Filter: &snifferFilter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, program); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to attach sniffer filter: %v", err)
+	}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to set sniffer timeout: %v", err)
+	}
+	addr := &unix.SockaddrLinklayer{Ifindex: iface.Index, Protocol: nl.Swap16(unix.ETH_P_ALL)}
+	if err := unix.Bind(fd, addr); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to bind sniffer to %q: %v", lowerDevice, err)
+	}
+
+	return s, nil
+}
+
+// Next returns the next address observed, nil if the read timed out.
+func (s *Sniffer) Next() (*IPObservation, error) {
+	buf := make([]byte, snifferSnapLen)
+	for {
+		n, from, err := unix.Recvfrom(s.fd, buf, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from sniffer: %v", err)
+		}
+		addr, ok := from.(*unix.SockaddrLinklayer)
+		outgoing := ok && addr.Pkttype == unix.PACKET_OUTGOING
+		if o := ParseIPObservation(buf[:n], outgoing); o != nil {
+			return o, nil
+		}
+	}
+}
+
+// Close closes the sniffer.
+func (s *Sniffer) Close() error {
+	return unix.Close(s.fd)
+}
+
+// SetLearnedIPs sets the addresses learned for the macvtap with the given MAC
+// in the device information file at path. The file is only replaced if it
+// still exists, so that one removed along its attachment is not brought back,
+// and if it still describes a macvtap with that MAC. The file is read and
+// replaced holding the lock the plugin takes to write it, so that a file it
+// rewrites meanwhile is not replaced by a stale copy.
+func SetLearnedIPs(path string, mac string, ips []string) error {
+	unlock, err := lockDeviceInfoDir(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := LoadDeviceInfo(path)
+	if err != nil {
+		return err
+	}
+	if info.Macvtap == nil {
+		return fmt.Errorf("device info file %s does not describe a macvtap", path)
+	}
+	if info.Macvtap.MAC != mac {
+		return fmt.Errorf("device info file %s describes a macvtap with MAC %s, not %s", path, info.Macvtap.MAC, mac)
+	}
+	info.Macvtap.LearnedIPs = ips
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device info: %v", err)
+	}
+	tempPath := path + ".learned"
+	if err := os.WriteFile(tempPath, data, 0444); err != nil {
+		return fmt.Errorf("failed to write device info file %s: %v", tempPath, err)
+	}
+	defer os.Remove(tempPath)
+
+	if err := unix.Renameat2(unix.AT_FDCWD, tempPath, unix.AT_FDCWD, path, unix.RENAME_EXCHANGE); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("failed to write device info file %s: %v", path, err)
+	}
+	return nil
+}
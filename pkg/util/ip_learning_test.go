@@ -0,0 +1,123 @@
+package util_test
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+// dhcpReply returns a DHCP server reply of the given message type granting
+// ip to mac.
+func dhcpReply(mac net.HardwareAddr, ip net.IP, msgType byte) []byte {
+	bootp := make([]byte, 240)
+	bootp[0], bootp[1], bootp[2] = 2, 1, 6
+	copy(bootp[16:20], ip.To4())
+	copy(bootp[28:34], mac)
+	binary.BigEndian.PutUint32(bootp[236:240], 0x63825363)
+	bootp = append(bootp, 53, 1, msgType, 51, 4, 0, 0, 0x0e, 0x10, 255)
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 67)
+	binary.BigEndian.PutUint16(udp[2:4], 68)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(bootp)))
+
+	ipv4 := make([]byte, 20)
+	ipv4[0] = 0x45
+	binary.BigEndian.PutUint16(ipv4[2:4], uint16(20+len(udp)+len(bootp)))
+	ipv4[8] = 64
+	ipv4[9] = 17
+	copy(ipv4[12:16], net.ParseIP("10.0.0.1").To4())
+	copy(ipv4[16:20], ip.To4())
+
+	frame := make([]byte, 14)
+	copy(frame[0:6], mac)
+	copy(frame[6:12], net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe})
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+	frame = append(frame, ipv4...)
+	frame = append(frame, udp...)
+	return append(frame, bootp...)
+}
+
+var _ = Describe("IP learning", func() {
+	mac := net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x01}
+
+	It("learns the sender of ARP packets and the target of neighbor advertisements", func() {
+		frames := util.AnnouncementFrames(mac, []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")})
+
+		Expect(util.ParseIPObservation(frames[0], true)).To(Equal(&util.IPObservation{
+			MAC: mac, IP: net.ParseIP("10.0.0.5").To4(), Source: util.LearnedFromARP,
+		}))
+		Expect(util.ParseIPObservation(frames[1], true)).To(Equal(&util.IPObservation{
+			MAC: mac, IP: net.ParseIP("fd00::5"), Source: util.LearnedFromNDP,
+		}))
+	})
+
+	It("ignores the ARP packets and neighbor advertisements received or sent on behalf of another MAC", func() {
+		frames := util.AnnouncementFrames(mac, []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")})
+		for _, frame := range frames {
+			Expect(util.ParseIPObservation(frame, false)).To(BeNil())
+		}
+
+		// an ARP packet whose sender is not the MAC sending it
+		spoofed := append([]byte(nil), frames[0]...)
+		copy(spoofed[6:12], net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x02})
+		Expect(util.ParseIPObservation(spoofed, true)).To(BeNil())
+	})
+
+	It("ignores unspecified and link-local addresses", func() {
+		for _, frame := range util.AnnouncementFrames(mac, []net.IP{net.IPv4zero, net.ParseIP("fe80::1")}) {
+			Expect(util.ParseIPObservation(frame, true)).To(BeNil())
+		}
+		Expect(util.ParseIPObservation(util.AnnouncementFrames(mac, nil)[0], true)).To(BeNil())
+	})
+
+	It("learns the address granted by a DHCP acknowledgement only", func() {
+		Expect(util.ParseIPObservation(dhcpReply(mac, net.ParseIP("10.0.0.7"), 5), false)).To(Equal(&util.IPObservation{
+			MAC: mac, IP: net.ParseIP("10.0.0.7").To4(), Source: util.LearnedFromDHCP, Lease: time.Hour,
+		}))
+		// offer
+		Expect(util.ParseIPObservation(dhcpReply(mac, net.ParseIP("10.0.0.7"), 2), false)).To(BeNil())
+	})
+
+	It("publishes the learned addresses to an existing device info file only", func() {
+		dir, err := os.MkdirTemp("", "devinfo")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		info := &util.DeviceInfo{
+			Type:    util.DeviceInfoTypeMacvtap,
+			Version: util.DeviceInfoVersion,
+			Macvtap: &util.MacvtapDeviceInfo{LowerDevice: "eth0", MAC: mac.String()},
+		}
+		path := filepath.Join(dir, "dataplane-0123abcd-net1-device.json")
+		Expect(util.SaveDeviceInfo(path, info)).To(Succeed())
+
+		Expect(util.SetLearnedIPs(path, mac.String(), []string{"10.0.0.5"})).To(Succeed())
+		updated, err := util.LoadDeviceInfo(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated.Macvtap.LearnedIPs).To(Equal([]string{"10.0.0.5"}))
+
+		// the file has been rewritten for a macvtap with another MAC
+		// since the addresses were learned
+		info.Macvtap.MAC = "02:5a:00:00:00:02"
+		Expect(util.SaveDeviceInfo(path, info)).To(Succeed())
+		Expect(util.SetLearnedIPs(path, mac.String(), []string{"10.0.0.6"})).NotTo(Succeed())
+		updated, err = util.LoadDeviceInfo(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated).To(Equal(info))
+
+		Expect(util.CleanDeviceInfo(path)).To(Succeed())
+		Expect(util.SetLearnedIPs(path, mac.String(), []string{"10.0.0.5"})).NotTo(Succeed())
+		Expect(path).NotTo(BeAnExistingFile())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+})
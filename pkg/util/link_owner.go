@@ -0,0 +1,86 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	linkOwnerPrefix    = "macvtap-cni"
+	linkOwnerAllocated = "allocated"
+	linkOwnerAttached  = "attached"
+)
+
+// LinkOwner describes who a macvtap link created by this project belongs to.
+// It is recorded in the link alias so that leaked links can be told apart from
+// those still in use.
+type LinkOwner struct {
+	// AllocatedAt is the time the device plugin allocated the link. It is only
+	// meaningful while the link has not been claimed by an attachment.
+	AllocatedAt time.Time
+	// Network, ContainerID and IfName identify the attachment that claimed
+	// the link.
+	Network     string
+	ContainerID string
+	IfName      string
+}
+
+// IsAttached tells whether the link has been claimed by an attachment.
+func (o LinkOwner) IsAttached() bool {
+	return o.ContainerID != ""
+}
+
+// Alias returns the link alias recording this owner.
+func (o LinkOwner) Alias() string {
+	if o.IsAttached() {
+		return strings.Join([]string{linkOwnerPrefix, linkOwnerAttached, o.Network, o.ContainerID, o.IfName}, ":")
+	}
+	return strings.Join([]string{linkOwnerPrefix, linkOwnerAllocated, strconv.FormatInt(o.AllocatedAt.Unix(), 10)}, ":")
+}
+
+// ParseLinkOwner parses a link alias as recorded by LinkOwner.Alias. It
+// returns false if the alias does not identify a link owned by this project.
+// Colons are a safe separator as they are not valid in network names,
+// container IDs nor interface names.
+func ParseLinkOwner(alias string) (LinkOwner, bool) {
+	fields := strings.Split(alias, ":")
+	if len(fields) < 2 || fields[0] != linkOwnerPrefix {
+		return LinkOwner{}, false
+	}
+
+	switch {
+	case fields[1] == linkOwnerAllocated && len(fields) == 3:
+		seconds, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return LinkOwner{}, false
+		}
+		return LinkOwner{AllocatedAt: time.Unix(seconds, 0)}, true
+	case fields[1] == linkOwnerAttached && len(fields) == 5 && fields[3] != "":
+		return LinkOwner{Network: fields[2], ContainerID: fields[3], IfName: fields[4]}, true
+	default:
+		return LinkOwner{}, false
+	}
+}
+
+// SetLinkOwner records the owner of the named link in the current namespace.
+func SetLinkOwner(name string, owner LinkOwner) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if err := netlink.LinkSetAlias(link, owner.Alias()); err != nil {
+		return fmt.Errorf("failed to set the owner of %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// GetLinkOwner returns the owner recorded on a link, if any.
+func GetLinkOwner(link netlink.Link) (LinkOwner, bool) {
+	return ParseLinkOwner(link.Attrs().Alias)
+}
@@ -0,0 +1,39 @@
+package util_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("LinkOwner", func() {
+	It("round trips an allocated owner through the link alias", func() {
+		owner := util.LinkOwner{AllocatedAt: time.Unix(1700000000, 0)}
+
+		parsed, ok := util.ParseLinkOwner(owner.Alias())
+
+		Expect(ok).To(BeTrue())
+		Expect(parsed.IsAttached()).To(BeFalse())
+		Expect(parsed.AllocatedAt.Equal(owner.AllocatedAt)).To(BeTrue())
+	})
+
+	It("round trips an attached owner through the link alias", func() {
+		owner := util.LinkOwner{Network: "dataplane", ContainerID: "0123abcd", IfName: "net1"}
+
+		parsed, ok := util.ParseLinkOwner(owner.Alias())
+
+		Expect(ok).To(BeTrue())
+		Expect(parsed.IsAttached()).To(BeTrue())
+		Expect(parsed).To(Equal(owner))
+	})
+
+	It("does not claim links with foreign aliases", func() {
+		for _, alias := range []string{"", "uplink", "macvtap-cni", "macvtap-cni:allocated:never", "macvtap-cni:attached:net"} {
+			_, ok := util.ParseLinkOwner(alias)
+			Expect(ok).To(BeFalse(), alias)
+		}
+	})
+})
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// NetNsDirs are the directories where container runtimes pin the network
+// namespaces of pods. They are scanned to find the macvtaps that have been
+// moved out of the netns of their lower device.
+var NetNsDirs = []string{"/var/run/netns", "/run/netns"}
+
+// MACUser describes a macvlan or macvtap link using a MAC address.
+type MACUser struct {
+	Link netlink.Link
+	// NetNsPath is the netns the link is in, empty for the current one.
+	NetNsPath string
+}
+
+func (u MACUser) String() string {
+	if u.NetNsPath == "" {
+		return fmt.Sprintf("%q", u.Link.Attrs().Name)
+	}
+	return fmt.Sprintf("%q in netns %s", u.Link.Attrs().Name, u.NetNsPath)
+}
+
+// setUp sets the link of the user up or down.
+func (u MACUser) setUp(up bool) error {
+	handle := &netlink.Handle{}
+	if u.NetNsPath != "" {
+		nsHandle, err := netns.GetFromPath(u.NetNsPath)
+		if err != nil {
+			return fmt.Errorf("failed to open netns %s: %v", u.NetNsPath, err)
+		}
+		defer nsHandle.Close()
+
+		handle, err = netlink.NewHandleAt(nsHandle)
+		if err != nil {
+			return fmt.Errorf("failed to open netlink handle in netns %s: %v", u.NetNsPath, err)
+		}
+		defer handle.Close()
+	}
+
+	if up {
+		return handle.LinkSetUp(u.Link)
+	}
+	return handle.LinkSetDown(u.Link)
+}
+
+// FindMACUser looks for a macvlan or macvtap child of lowerDevice, which is in
+// the current netns, using the given MAC address. Children that have been
+// moved to the netns pinned under NetNsDirs or to one of extraNetNsPaths are
+// found as well. Children for which ignore returns true are skipped. It
+// returns nil if the MAC address is not in use.
+func FindMACUser(lowerDevice string, mac net.HardwareAddr, extraNetNsPaths []string, ignore func(netlink.Link) bool) (*MACUser, error) {
+	parent, err := netlink.LinkByName(lowerDevice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup lowerDevice %q: %v", lowerDevice, err)
+	}
+	parentIndex := parent.Attrs().Index
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().ParentIndex == parentIndex && link.Attrs().NetNsID < 0 && usesMAC(link, mac, ignore) {
+			return &MACUser{Link: link}, nil
+		}
+	}
+
+	hostNs, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the current netns: %v", err)
+	}
+	defer hostNs.Close()
+
+	for _, path := range netNsPaths(extraNetNsPaths) {
+		link, err := findMACUserIn(path, hostNs, parentIndex, mac, ignore)
+		if err != nil {
+			return nil, err
+		}
+		if link != nil {
+			return &MACUser{Link: link, NetNsPath: path}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findMACUserIn looks for a link of the netns at path using mac, whose parent
+// is the link with index parentIndex in hostNs.
+func findMACUserIn(path string, hostNs netns.NsHandle, parentIndex int, mac net.HardwareAddr, ignore func(netlink.Link) bool) (netlink.Link, error) {
+	nsHandle, err := netns.GetFromPath(path)
+	if err != nil {
+		// the netns may be gone or not be a netns at all
+		return nil, nil
+	}
+	defer nsHandle.Close()
+
+	if hostNs.Equal(nsHandle) {
+		return nil, nil
+	}
+
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle in netns %s: %v", path, err)
+	}
+	defer handle.Close()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links in netns %s: %v", path, err)
+	}
+
+	// The parent of the links is in another netns, which they refer to by the
+	// id that netns has been given in theirs. Look it up after listing the
+	// links, as listing them allocates it if needed.
+	hostNsID, err := handle.GetNetNsIdByFd(int(hostNs))
+	if err != nil || hostNsID < 0 {
+		return nil, nil
+	}
+
+	for _, link := range links {
+		if link.Attrs().ParentIndex == parentIndex && link.Attrs().NetNsID == hostNsID && usesMAC(link, mac, ignore) {
+			return link, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func usesMAC(link netlink.Link, mac net.HardwareAddr, ignore func(netlink.Link) bool) bool {
+	switch link.(type) {
+	case *netlink.Macvlan, *netlink.Macvtap:
+	default:
+		return false
+	}
+	return bytes.Equal(link.Attrs().HardwareAddr, mac) && (ignore == nil || !ignore(link))
+}
+
+// netNsPaths returns the paths of the pinned netns along with the extra ones,
+// without duplicates.
+func netNsPaths(extraNetNsPaths []string) []string {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(path string) {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for _, dir := range NetNsDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			add(filepath.Join(dir, entry.Name()))
+		}
+	}
+	for _, path := range extraNetNsPaths {
+		add(path)
+	}
+
+	return paths
+}
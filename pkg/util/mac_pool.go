@@ -0,0 +1,294 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultMACPoolDir is where the device plugin publishes the MAC pools
+	// of its devices, and where the CNI keeps the leases of their addresses.
+	DefaultMACPoolDir = "/var/lib/cni/macvtap-macpools"
+	// DefaultMACReleaseGracePeriod is how long the address of a deleted
+	// attachment stays reserved for it by default.
+	DefaultMACReleaseGracePeriod = time.Hour
+
+	macPoolDevicesDir = "devices"
+)
+
+// MACPoolConfig defines a range of MAC addresses, made of a common prefix
+// followed by a range of values of the remaining bytes.
+type MACPoolConfig struct {
+	// Prefix is the leading bytes of the addresses, e.g. an OUI. It must not
+	// be a multicast prefix.
+	Prefix string `json:"prefix"`
+	// Start and End are the first and last values of the bytes following the
+	// prefix, e.g. 00:00:01 and 00:ff:ff after a 3 byte prefix. They default
+	// to the whole range.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// ReleaseGracePeriod is how long the address of a deleted attachment
+	// stays reserved for it, as a duration such as 30m. Defaults to 1h.
+	ReleaseGracePeriod string `json:"releaseGracePeriod,omitempty"`
+}
+
+// macRange is a parsed MACPoolConfig.
+type macRange struct {
+	prefix     []byte
+	start, end uint64
+	grace      time.Duration
+}
+
+// Validate checks the pool without using it.
+func (c *MACPoolConfig) Validate() error {
+	if c == nil {
+		return nil
+	}
+	_, err := c.parse()
+	return err
+}
+
+func (c *MACPoolConfig) parse() (*macRange, error) {
+	prefix, err := parseMACBytes(c.Prefix)
+	if err != nil || len(prefix) == 0 || len(prefix) > 5 {
+		return nil, fmt.Errorf("invalid prefix %q, expected 1 to 5 bytes such as 02:5a:00", c.Prefix)
+	}
+	if prefix[0]&1 != 0 {
+		return nil, fmt.Errorf("prefix %q is a multicast prefix", c.Prefix)
+	}
+
+	r := &macRange{
+		prefix: prefix,
+		end:    1<<(8*(6-len(prefix))) - 1,
+		grace:  DefaultMACReleaseGracePeriod,
+	}
+	for _, bound := range []struct {
+		value string
+		set   *uint64
+	}{{c.Start, &r.start}, {c.End, &r.end}} {
+		if bound.value == "" {
+			continue
+		}
+		b, err := parseMACBytes(bound.value)
+		if err != nil || len(b)+len(prefix) != 6 {
+			return nil, fmt.Errorf("invalid range bound %q, expected %d bytes", bound.value, 6-len(prefix))
+		}
+		*bound.set = 0
+		for _, v := range b {
+			*bound.set = *bound.set<<8 | uint64(v)
+		}
+	}
+	if r.start > r.end {
+		return nil, fmt.Errorf("range start %q is after its end %q", c.Start, c.End)
+	}
+
+	if c.ReleaseGracePeriod != "" {
+		r.grace, err = time.ParseDuration(c.ReleaseGracePeriod)
+		if err != nil || r.grace < 0 {
+			return nil, fmt.Errorf("invalid release grace period %q", c.ReleaseGracePeriod)
+		}
+	}
+
+	return r, nil
+}
+
+// mac returns the address of the range with the given value after the prefix.
+func (r *macRange) mac(value uint64) net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, r.prefix)
+	for i := 5; i >= len(r.prefix); i-- {
+		mac[i] = byte(value)
+		value >>= 8
+	}
+	return mac
+}
+
+// parseMACBytes parses colon separated hexadecimal bytes.
+func parseMACBytes(s string) ([]byte, error) {
+	var b []byte
+	for _, field := range strings.Split(s, ":") {
+		v, err := strconv.ParseUint(field, 16, 8)
+		if err != nil || len(field) != 2 {
+			return nil, fmt.Errorf("invalid byte %q", field)
+		}
+		b = append(b, byte(v))
+	}
+	return b, nil
+}
+
+// MACPool is the MAC pool of a device plugin resource, as published for the
+// devices it allocates.
+type MACPool struct {
+	// Name identifies the pool, the resource it belongs to.
+	Name string `json:"name"`
+	MACPoolConfig
+}
+
+// macLease records the address allocated to a key.
+type macLease struct {
+	MAC         string `json:"mac"`
+	ContainerID string `json:"containerID"`
+	// ReleasedAt is when the attachment was deleted, nil while in use.
+	ReleasedAt *time.Time `json:"releasedAt,omitempty"`
+}
+
+// SaveDeviceMACPool publishes the MAC pool of a device allocated by the device
+// plugin in dir, replacing any previous one. A nil pool removes it.
+func SaveDeviceMACPool(dir string, deviceID string, pool *MACPool) error {
+	path := filepath.Join(dir, macPoolDevicesDir, deviceID+".json")
+	if pool == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove MAC pool file %s: %v", path, err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(pool)
+	if err != nil {
+		return fmt.Errorf("failed to marshal MAC pool: %v", err)
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// LoadDeviceMACPool returns the MAC pool of a device published in dir, nil if
+// there is none.
+func LoadDeviceMACPool(dir string, deviceID string) (*MACPool, error) {
+	path := filepath.Join(dir, macPoolDevicesDir, deviceID+".json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MAC pool file %s: %v", path, err)
+	}
+
+	pool := &MACPool{}
+	if err := json.Unmarshal(data, pool); err != nil {
+		return nil, fmt.Errorf("failed to parse MAC pool file %s: %v", path, err)
+	}
+	return pool, nil
+}
+
+// Allocate returns the address of the pool leased to key, kept in dir, for
+// the given container. A key keeps its address while it is in use or within
+// the grace period after its release. Otherwise, the addresses are searched
+// from one derived from the key, so that it is likely to get the same one
+// back even after its lease expired.
+func (p *MACPool) Allocate(dir string, key string, containerID string) (net.HardwareAddr, error) {
+	r, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC pool %q: %v", p.Name, err)
+	}
+
+	var mac net.HardwareAddr
+	err = p.updateLeases(dir, func(leases map[string]*macLease) error {
+		now := time.Now()
+		used := map[string]bool{}
+		for k, lease := range leases {
+			if lease.ReleasedAt != nil && now.Sub(*lease.ReleasedAt) >= r.grace {
+				delete(leases, k)
+				continue
+			}
+			used[lease.MAC] = true
+		}
+
+		if lease, ok := leases[key]; ok {
+			lease.ContainerID = containerID
+			lease.ReleasedAt = nil
+			mac, err = net.ParseMAC(lease.MAC)
+			return err
+		}
+
+		size := r.end - r.start + 1
+		offset := xxhash.Sum64String(key) % size
+		for i := uint64(0); i < size && i <= uint64(len(used)); i++ {
+			candidate := r.mac(r.start + (offset+i)%size)
+			if !used[candidate.String()] {
+				mac = candidate
+				leases[key] = &macLease{MAC: mac.String(), ContainerID: containerID}
+				return nil
+			}
+		}
+		return fmt.Errorf("MAC pool %q is exhausted", p.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mac, nil
+}
+
+// Release starts the grace period of the address leased to key in dir, if it
+// is still leased for the given container: a newer container of the same key
+// may already have taken it over.
+func (p *MACPool) Release(dir string, key string, containerID string) error {
+	r, err := p.parse()
+	if err != nil {
+		return fmt.Errorf("invalid MAC pool %q: %v", p.Name, err)
+	}
+
+	return p.updateLeases(dir, func(leases map[string]*macLease) error {
+		lease, ok := leases[key]
+		if !ok || lease.ContainerID != containerID || lease.ReleasedAt != nil {
+			return nil
+		}
+		if r.grace == 0 {
+			delete(leases, key)
+			return nil
+		}
+		now := time.Now()
+		lease.ReleasedAt = &now
+		return nil
+	})
+}
+
+// updateLeases applies update to the leases of the pool kept in dir, holding
+// a lock so that concurrent plugin invocations don't allocate the same
+// address.
+func (p *MACPool) updateLeases(dir string, update func(map[string]*macLease) error) error {
+	name := strings.ReplaceAll(p.Name, "/", "-")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create MAC pool directory: %v", err)
+	}
+
+	lockPath := filepath.Join(dir, name+".lock")
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open MAC pool lock %s: %v", lockPath, err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock MAC pool %q: %v", p.Name, err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	path := filepath.Join(dir, name+".leases.json")
+	leases := map[string]*macLease{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read MAC leases %s: %v", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &leases); err != nil {
+			return fmt.Errorf("failed to parse MAC leases %s: %v", path, err)
+		}
+	}
+
+	if err := update(leases); err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(leases)
+	if err != nil {
+		return fmt.Errorf("failed to marshal MAC leases: %v", err)
+	}
+	return writeFileAtomic(path, data, 0600)
+}
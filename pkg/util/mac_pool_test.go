@@ -0,0 +1,100 @@
+package util_test
+
+import (
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("MAC pool", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "macpools")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newPool := func(start, end, grace string) *util.MACPool {
+		return &util.MACPool{
+			Name: "macvtap.network.kubevirt.io/dataplane",
+			MACPoolConfig: util.MACPoolConfig{
+				Prefix:             "02:5a:00",
+				Start:              start,
+				End:                end,
+				ReleaseGracePeriod: grace,
+			},
+		}
+	}
+
+	It("accepts a prefix along a range", func() {
+		Expect(newPool("", "", "").Validate()).To(Succeed())
+		Expect(newPool("00:00:01", "00:ff:ff", "10m").Validate()).To(Succeed())
+	})
+
+	It("rejects invalid pools", func() {
+		Expect((&util.MACPoolConfig{Prefix: "03:5a:00"}).Validate()).NotTo(Succeed())
+		Expect((&util.MACPoolConfig{Prefix: "02:5a:00:00:00:00"}).Validate()).NotTo(Succeed())
+		Expect(newPool("00:00", "", "").Validate()).NotTo(Succeed())
+		Expect(newPool("00:00:10", "00:00:01", "").Validate()).NotTo(Succeed())
+		Expect(newPool("", "", "soon").Validate()).NotTo(Succeed())
+	})
+
+	It("round trips the pool of a device", func() {
+		pool := newPool("00:00:01", "00:00:ff", "")
+		Expect(util.SaveDeviceMACPool(dir, "dataplaneMvp0", pool)).To(Succeed())
+		Expect(util.LoadDeviceMACPool(dir, "dataplaneMvp0")).To(Equal(pool))
+
+		Expect(util.SaveDeviceMACPool(dir, "dataplaneMvp0", nil)).To(Succeed())
+		Expect(util.LoadDeviceMACPool(dir, "dataplaneMvp0")).To(BeNil())
+	})
+
+	It("allocates addresses within the range, the same one to the same key", func() {
+		pool := newPool("00:00:01", "00:00:02", "")
+
+		mac, err := pool.Allocate(dir, "default/vm/net1", "c1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac.String()).To(HavePrefix("02:5a:00:00:00:0"))
+		Expect(pool.Allocate(dir, "default/vm/net1", "c2")).To(Equal(mac))
+
+		other, err := pool.Allocate(dir, "default/other/net1", "c3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other).NotTo(Equal(mac))
+
+		_, err = pool.Allocate(dir, "default/third/net1", "c4")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps a released address for its key during the grace period", func() {
+		pool := newPool("00:00:01", "00:00:01", "1h")
+
+		mac, err := pool.Allocate(dir, "default/vm/net1", "c1")
+		Expect(err).NotTo(HaveOccurred())
+
+		// only the container holding the lease releases it
+		Expect(pool.Release(dir, "default/vm/net1", "c0")).To(Succeed())
+		Expect(pool.Release(dir, "default/vm/net1", "c1")).To(Succeed())
+
+		_, err = pool.Allocate(dir, "default/other/net1", "c2")
+		Expect(err).To(HaveOccurred())
+		Expect(pool.Allocate(dir, "default/vm/net1", "c3")).To(Equal(mac))
+	})
+
+	It("frees a released address right away without grace period", func() {
+		pool := newPool("00:00:01", "00:00:01", "0s")
+
+		_, err := pool.Allocate(dir, "default/vm/net1", "c1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.Release(dir, "default/vm/net1", "c1")).To(Succeed())
+
+		Expect(pool.Allocate(dir, "default/other/net1", "c2")).To(Equal(net.HardwareAddr{0x02, 0x5a, 0x00, 0x00, 0x00, 0x01}))
+	})
+})
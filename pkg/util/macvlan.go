@@ -0,0 +1,149 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// macvlanFlagNoPromisc keeps a macvtap in passthru mode from setting its lower
+// device in promiscuous mode.
+const macvlanFlagNoPromisc uint16 = 1
+
+// MacvlanSettings holds settings of the macvlan driver backing a macvtap,
+// which are set on creation.
+type MacvlanSettings struct {
+	// BCQueueLen is the length of the queue of broadcast frames the macvtap
+	// requests. The lower device uses the largest one requested.
+	BCQueueLen uint32 `json:"bcQueueLen,omitempty"`
+	// BCCutoff is the number of macvtaps of the lower device receiving a
+	// multicast address above which the frames sent to it are queued rather
+	// than delivered right away. Negative values disable queueing. It applies
+	// to the whole lower device.
+	BCCutoff *int32 `json:"bcCutoff,omitempty"`
+	// NoPromisc keeps a macvtap in passthru mode from forcing its lower device
+	// into promiscuous mode.
+	NoPromisc bool `json:"noPromisc,omitempty"`
+}
+
+// Validate checks the settings of a macvtap in the given mode, without
+// applying them.
+func (s *MacvlanSettings) Validate(mode string) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.NoPromisc && mode != "passthru" {
+		return fmt.Errorf("noPromisc only applies to passthru mode")
+	}
+
+	return nil
+}
+
+func (s *MacvlanSettings) isEmpty() bool {
+	return s == nil || (s.BCQueueLen == 0 && s.BCCutoff == nil && !s.NoPromisc)
+}
+
+// apply sets the settings on a macvtap of the current netns, which must be
+// down, and checks that the kernel supports them.
+func (s *MacvlanSettings) apply(link netlink.Link) error {
+	if s.isEmpty() {
+		return nil
+	}
+	name := link.Attrs().Name
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(link.Type()))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	if s.NoPromisc {
+		data.AddRtAttr(unix.IFLA_MACVLAN_FLAGS, nl.Uint16Attr(macvlanFlagNoPromisc))
+	}
+	if s.BCQueueLen > 0 {
+		data.AddRtAttr(unix.IFLA_MACVLAN_BC_QUEUE_LEN, nl.Uint32Attr(s.BCQueueLen))
+	}
+	if s.BCCutoff != nil {
+		data.AddRtAttr(unix.IFLA_MACVLAN_BC_CUTOFF, nl.Uint32Attr(uint32(*s.BCCutoff)))
+	}
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set the macvlan settings of %q: %v", name, err)
+	}
+
+	// Kernels ignore the attributes they don't know about, and don't report
+	// them either.
+	attrs, err := macvlanData(link.Attrs().Index)
+	if err != nil {
+		return fmt.Errorf("failed to get the macvlan settings of %q: %v", name, err)
+	}
+	if s.NoPromisc {
+		if value, ok := attrs[unix.IFLA_MACVLAN_FLAGS]; !ok || len(value) < 2 || nl.NativeEndian().Uint16(value)&macvlanFlagNoPromisc == 0 {
+			return fmt.Errorf("noPromisc is not supported by the kernel")
+		}
+	}
+	if s.BCQueueLen > 0 {
+		if value, ok := attrs[unix.IFLA_MACVLAN_BC_QUEUE_LEN]; !ok || len(value) < 4 || nl.NativeEndian().Uint32(value) != s.BCQueueLen {
+			return fmt.Errorf("bcQueueLen is not supported by the kernel")
+		}
+	}
+	if s.BCCutoff != nil {
+		if value, ok := attrs[unix.IFLA_MACVLAN_BC_CUTOFF]; !ok || len(value) < 4 || int32(nl.NativeEndian().Uint32(value)) != *s.BCCutoff {
+			return fmt.Errorf("bcCutoff is not supported by the kernel")
+		}
+	}
+
+	return nil
+}
+
+// macvlanData returns the macvlan attributes of the link with the given index
+// in the current netns, as reported by the kernel.
+func macvlanData(index int) (map[uint16][]byte, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 || len(msgs[0]) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("no link with index %d", index)
+	}
+
+	data := map[uint16][]byte{}
+	attrs, err := nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type&nl.NLA_TYPE_MASK != unix.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type&nl.NLA_TYPE_MASK != nl.IFLA_INFO_DATA {
+				continue
+			}
+			macvlanAttrs, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, macvlanAttr := range macvlanAttrs {
+				data[macvlanAttr.Attr.Type&nl.NLA_TYPE_MASK] = macvlanAttr.Value
+			}
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,37 @@
+package util_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("MacvlanSettings", func() {
+	It("accepts no settings", func() {
+		var settings *util.MacvlanSettings
+
+		Expect(settings.Validate("bridge")).To(Succeed())
+	})
+
+	It("accepts broadcast settings in any mode", func() {
+		bcCutoff := int32(-1)
+		settings := &util.MacvlanSettings{BCQueueLen: 10000, BCCutoff: &bcCutoff}
+
+		for _, mode := range []string{"bridge", "vepa", "private", "passthru", "source"} {
+			Expect(settings.Validate(mode)).To(Succeed(), mode)
+		}
+	})
+
+	It("accepts noPromisc in passthru mode", func() {
+		settings := &util.MacvlanSettings{NoPromisc: true}
+
+		Expect(settings.Validate("passthru")).To(Succeed())
+	})
+
+	It("rejects noPromisc in other modes", func() {
+		settings := &util.MacvlanSettings{NoPromisc: true}
+
+		Expect(settings.Validate("bridge")).NotTo(Succeed())
+	})
+})
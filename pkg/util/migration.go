@@ -0,0 +1,249 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// Standby modes of the macvtap of the target of a live migration, which must
+// not take the traffic of the VM away from the source until switchover.
+const (
+	// StandbyDown leaves the macvtap administratively down.
+	StandbyDown = "down"
+	// StandbySource empties the allowlist of a macvtap in source mode, so
+	// that it receives nothing.
+	StandbySource = "source"
+)
+
+// DefaultStandbyDir is where the macvtaps on standby are recorded for the
+// device plugin to activate them.
+const DefaultStandbyDir = "/var/run/macvtap-cni/standby"
+
+// ValidateStandby checks a standby mode, empty for none.
+func ValidateStandby(mode string) error {
+	switch mode {
+	case "", StandbyDown, StandbySource:
+		return nil
+	}
+	return fmt.Errorf("unknown standby mode %q, expected %q or %q", mode, StandbyDown, StandbySource)
+}
+
+// StandbyAttachment records the macvtap of an attachment on standby, with
+// what it takes to activate it.
+type StandbyAttachment struct {
+	Network     string `json:"network"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	// PodNamespace and PodName identify the pod, when the runtime tells.
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	NetNsPath    string `json:"netns"`
+	Mode         string `json:"mode"`
+	// MAC and IPs are the addresses announced on activation.
+	MAC string   `json:"mac"`
+	IPs []string `json:"ips,omitempty"`
+	// SourceMACs is the allowlist restored on activation in source mode.
+	SourceMACs []string `json:"sourceMACs,omitempty"`
+}
+
+func standbyPath(dir string, containerID string, ifName string) string {
+	return filepath.Join(dir, strings.Join([]string{containerID, ifName}, "-")+".json")
+}
+
+// SaveStandby records the attachment on standby in dir, replacing any
+// previous record.
+func SaveStandby(dir string, s *StandbyAttachment) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal standby attachment: %v", err)
+	}
+	return writeFileAtomic(standbyPath(dir, s.ContainerID, s.IfName), data, 0600)
+}
+
+// LoadStandby returns the record of the attachment in dir, nil if there is
+// none.
+func LoadStandby(dir string, containerID string, ifName string) (*StandbyAttachment, error) {
+	return loadStandby(standbyPath(dir, containerID, ifName))
+}
+
+func loadStandby(path string) (*StandbyAttachment, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read standby record %s: %v", path, err)
+	}
+
+	s := &StandbyAttachment{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse standby record %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// DeleteStandby removes the record of the attachment from dir, if any.
+func DeleteStandby(dir string, containerID string, ifName string) error {
+	path := standbyPath(dir, containerID, ifName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove standby record %s: %v", path, err)
+	}
+	return nil
+}
+
+// ListStandby returns the attachments on standby recorded in dir.
+func ListStandby(dir string) ([]*StandbyAttachment, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list standby records: %v", err)
+	}
+
+	var standby []*StandbyAttachment
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		s, err := loadStandby(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// nil when activated or deleted meanwhile
+		if s != nil {
+			standby = append(standby, s)
+		}
+	}
+	return standby, nil
+}
+
+// GetSourceMACs returns the allowlist of the named macvtap in source mode of
+// the current netns.
+func GetSourceMACs(name string) ([]net.HardwareAddr, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok || macvtap.Mode != netlink.MACVLAN_MODE_SOURCE {
+		return nil, fmt.Errorf("device %q is not a macvtap in source mode", name)
+	}
+	return macvtap.MACAddrs, nil
+}
+
+// flushSourceMACs empties the allowlist of a macvtap in source mode, which
+// then receives nothing.
+func flushSourceMACs(link netlink.Link) error {
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok || macvtap.Mode != netlink.MACVLAN_MODE_SOURCE {
+		return fmt.Errorf("the source standby mode requires a macvtap in source mode")
+	}
+
+	if err := netlink.MacvlanMACAddrFlush(link); err != nil {
+		return fmt.Errorf("failed to flush the source MACs of %q: %v", link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// takeOverMAC gives mac to the macvtap of an attachment on standby, which
+// could not claim it on ADD as the source of the migration was using it on the
+// same lower device of the netns at hostNsPath. The source is set down first,
+// since a lower device only lets one of its children up with a given MAC, and
+// set back up if the MAC can't be taken over after all.
+func takeOverMAC(hostNsPath string, link netlink.Link, mac net.HardwareAddr) error {
+	var source *MACUser
+	err := ns.WithNetNSPath(hostNsPath, func(_ ns.NetNS) error {
+		parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+		if err != nil {
+			return fmt.Errorf("failed to lookup the lower device of %q: %v", link.Attrs().Name, err)
+		}
+		// only a child that is up holds the MAC
+		isDown := func(l netlink.Link) bool { return l.Attrs().Flags&net.FlagUp == 0 }
+		source, err = FindMACUser(parent.Attrs().Name, mac, nil, isDown)
+		if err != nil || source == nil {
+			return err
+		}
+		if err := source.setUp(false); err != nil {
+			return fmt.Errorf("failed to set the source %s down: %v", source, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		if source != nil {
+			ns.WithNetNSPath(hostNsPath, func(_ ns.NetNS) error {
+				return source.setUp(true)
+			})
+		}
+		return fmt.Errorf("failed to set MAC %s on %q: %v", mac, link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// Activate brings the macvtap of an attachment on standby into service, and
+// announces its addresses so that the network forwards their traffic to it
+// rather than to the source of the migration. A source still using the MAC on
+// the same lower device, in the netns at hostNsPath, is set down. The macvtap
+// must still be owned by the attachment.
+func Activate(s *StandbyAttachment, hostNsPath string) error {
+	mac, err := net.ParseMAC(s.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid recorded MAC %q: %v", s.MAC, err)
+	}
+	var ips []net.IP
+	for _, addr := range s.IPs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	sourceMACs, err := ParseSourceMACs(s.SourceMACs)
+	if err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(s.NetNsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(s.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup device %q: %v", s.IfName, err)
+		}
+		owner, ok := GetLinkOwner(link)
+		if !ok || owner.Network != s.Network || owner.ContainerID != s.ContainerID || owner.IfName != s.IfName {
+			return fmt.Errorf("device %q is not owned by the attachment", s.IfName)
+		}
+
+		if !bytes.Equal(link.Attrs().HardwareAddr, mac) {
+			if err := takeOverMAC(hostNsPath, link, mac); err != nil {
+				return err
+			}
+		}
+
+		switch s.Mode {
+		case StandbyDown:
+			if err := netlink.LinkSetUp(link); err != nil {
+				return fmt.Errorf("failed to set %q UP: %v", s.IfName, err)
+			}
+		case StandbySource:
+			if err := setSourceMACs(link, sourceMACs); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown standby mode %q", s.Mode)
+		}
+
+		return Announce(s.IfName, mac, ips)
+	})
+}
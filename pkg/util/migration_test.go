@@ -0,0 +1,53 @@
+package util_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Standby attachments", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "standby")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("accepts the known standby modes only", func() {
+		Expect(util.ValidateStandby("")).To(Succeed())
+		Expect(util.ValidateStandby(util.StandbyDown)).To(Succeed())
+		Expect(util.ValidateStandby(util.StandbySource)).To(Succeed())
+		Expect(util.ValidateStandby("paused")).NotTo(Succeed())
+	})
+
+	It("records and lists the attachments on standby", func() {
+		standby := &util.StandbyAttachment{
+			Network:     "dataplane",
+			ContainerID: "c1",
+			IfName:      "net1",
+			NetNsPath:   "/var/run/netns/c1",
+			Mode:        util.StandbySource,
+			MAC:         "02:5a:00:00:00:01",
+			IPs:         []string{"10.0.0.5"},
+			SourceMACs:  []string{"02:5a:00:00:00:01"},
+		}
+		Expect(util.SaveStandby(dir, standby)).To(Succeed())
+
+		Expect(util.LoadStandby(dir, "c1", "net1")).To(Equal(standby))
+		Expect(util.ListStandby(dir)).To(ConsistOf(standby))
+
+		Expect(util.DeleteStandby(dir, "c1", "net1")).To(Succeed())
+		Expect(util.LoadStandby(dir, "c1", "net1")).To(BeNil())
+		Expect(util.ListStandby(dir)).To(BeEmpty())
+		Expect(util.DeleteStandby(dir, "c1", "net1")).To(Succeed())
+	})
+})
@@ -0,0 +1,481 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Directions of the traffic of a macvtap interface that is mirrored, from the
+// point of view of its consumer.
+const (
+	MirrorIngress = "ingress"
+	MirrorEgress  = "egress"
+	MirrorBoth    = "both"
+)
+
+// gactProbRandom picks the frames a gact action applies its probability
+// action to at random.
+const gactProbRandom = 1
+
+// Mirror holds where and what traffic of a macvtap interface is mirrored to.
+type Mirror struct {
+	// Device is the host interface the traffic is mirrored toward. As the
+	// macvtap is in the pod netns, the mirrored frames are sent through a
+	// monitoring macvlan of it, created in the pod netns along the macvtap,
+	// unless mirrored from the lower device.
+	Device string `json:"device"`
+	// Direction is the mirrored traffic, what the consumer receives, sends
+	// or both. Defaults to both.
+	Direction string `json:"direction,omitempty"`
+	// SampleRate mirrors one out of SampleRate frames on average, picked at
+	// random. Zero or one mirror every frame.
+	SampleRate uint16 `json:"sampleRate,omitempty"`
+	// FromLowerDevice mirrors the traffic from the lower device of the
+	// macvtap, in the host netns, straight to Device rather than through a
+	// monitoring macvlan. The frames are told apart by the MAC of the
+	// macvtap, so that only the unicast frames it receives are mirrored,
+	// and none of those exchanged with other macvlans of the lower device.
+	FromLowerDevice bool `json:"fromLowerDevice,omitempty"`
+}
+
+// Validate checks the mirror without setting it.
+func (m *Mirror) Validate() error {
+	if m == nil {
+		return nil
+	}
+
+	if m.Device == "" {
+		return fmt.Errorf("device is required")
+	}
+	switch m.Direction {
+	case "", MirrorIngress, MirrorEgress, MirrorBoth:
+	default:
+		return fmt.Errorf("unknown direction %q, expected %q, %q or %q", m.Direction, MirrorIngress, MirrorEgress, MirrorBoth)
+	}
+
+	return nil
+}
+
+// hooks returns the clsact hooks of the macvtap interface, or of its lower
+// device, the mirrored traffic goes through.
+func (m *Mirror) hooks() []uint32 {
+	switch m.Direction {
+	case MirrorIngress:
+		return []uint32{netlink.HANDLE_MIN_INGRESS}
+	case MirrorEgress:
+		return []uint32{netlink.HANDLE_MIN_EGRESS}
+	}
+	return []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS}
+}
+
+// mirrorPlacement returns the priority of the mirror filters on a clsact hook
+// of the macvtap interface and the chains they are in. The spoof check lets
+// the frames it allows through to a chain of their own, so the egress mirror
+// is in both chains.
+func mirrorPlacement(hook uint32) (uint16, []uint32) {
+	if hook == netlink.HANDLE_MIN_INGRESS {
+		return mirrorIngressPriority, []uint32{0}
+	}
+	return mirrorEgressPriority, []uint32{0, spoofCheckAllowedChain}
+}
+
+// SetMirror mirrors the traffic of the named macvtap interface in netns
+// toward the host interface of the mirror, replacing any previous mirror. The
+// monitoring macvlan is created in netns with the given mirror name and
+// owner, in private mode so that the mirrored frames are not delivered to the
+// other macvlans of the host interface. It is called from the host netns.
+func SetMirror(name string, mirrorName string, owner LinkOwner, m *Mirror, netns ns.NetNS) error {
+	if err := netns.Do(func(_ ns.NetNS) error {
+		return RemoveMirror(name, mirrorName)
+	}); err != nil {
+		return err
+	}
+
+	device, err := netlink.LinkByName(m.Device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup mirror device %q: %v", m.Device, err)
+	}
+
+	mv := &netlink.Macvlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        mirrorName,
+			ParentIndex: device.Attrs().Index,
+			Namespace:   netlink.NsFd(int(netns.Fd())),
+			Alias:       owner.Alias(),
+		},
+		Mode: netlink.MACVLAN_MODE_PRIVATE,
+	}
+	if err := netlink.LinkAdd(mv); err != nil {
+		return fmt.Errorf("failed to create monitoring macvlan of %q: %v", m.Device, err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		err := setMirror(name, mirrorName, m)
+		if err != nil {
+			LinkDelete(mirrorName)
+		}
+		return err
+	})
+}
+
+// setMirror sets up the monitoring macvlan and mirrors the traffic of the
+// macvtap interface to it, in the current netns.
+func setMirror(name string, mirrorName string, m *Mirror) error {
+	mirror, err := netlink.LinkByName(mirrorName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", mirrorName, err)
+	}
+
+	// The monitoring macvlan only sends the mirrored frames: no ARP nor
+	// IPv6 neighbor discovery of its own.
+	if err := netlink.LinkSetARPOff(mirror); err != nil {
+		return fmt.Errorf("failed to set %q NOARP: %v", mirrorName, err)
+	}
+	ipv6Sysctl := fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6", mirrorName)
+	if _, err := sysctl.Sysctl(ipv6Sysctl, "1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to disable IPv6 on %q: %v", mirrorName, err)
+	}
+	if err := netlink.LinkSetUp(mirror); err != nil {
+		return fmt.Errorf("failed to set %q UP: %v", mirrorName, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	for _, hook := range m.hooks() {
+		priority, chains := mirrorPlacement(hook)
+		for _, chain := range chains {
+			if err := addMirrorFilter(link.Attrs().Index, hook, chain, priority, nil, 0, mirror.Attrs().Index, m.SampleRate); err != nil {
+				return fmt.Errorf("failed to add mirror filter to %q: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addMirrorFilter adds a filter mirroring the frames going through the given
+// hook of a link to the egress of the mirror link: a matchall filter in the
+// given chain, or a u32 filter matching sel and tagged with classID if any.
+// The filter is built by hand, as the netlink library can't set the
+// probability of a gact action. Both actions continue the classification, so
+// that the next filters see every frame.
+func addMirrorFilter(linkIndex int, hook uint32, chain uint32, priority uint16, sel *netlink.TcU32Sel, classID uint32, mirrorIndex int, sampleRate uint16) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWTFILTER, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(linkIndex),
+		Parent:  hook,
+		Info:    netlink.MakeHandle(priority, nl.Swap16(unix.ETH_P_ALL)),
+	})
+	if chain != 0 {
+		req.AddData(nl.NewRtAttr(nl.TCA_CHAIN, nl.Uint32Attr(chain)))
+	}
+
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	var actions *nl.RtAttr
+	if sel == nil {
+		req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("matchall")))
+		actions = options.AddRtAttr(nl.TCA_MATCHALL_ACT, nil)
+	} else {
+		req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("u32")))
+		// the keys are in network byte order
+		wire := *sel
+		wire.Nkeys = uint8(len(sel.Keys))
+		wire.Keys = make([]netlink.TcU32Key, len(sel.Keys))
+		for i, key := range sel.Keys {
+			wire.Keys[i] = key
+			wire.Keys[i].Mask = networkOrder(key.Mask)
+			wire.Keys[i].Val = networkOrder(key.Val)
+		}
+		options.AddRtAttr(nl.TCA_U32_SEL, wire.Serialize())
+		options.AddRtAttr(nl.TCA_U32_CLASSID, nl.Uint32Attr(classID))
+		actions = options.AddRtAttr(nl.TCA_U32_ACT, nil)
+	}
+	tab := nl.TCA_ACT_TAB
+	if sampleRate > 1 {
+		// the frames not sampled skip the mirred action
+		gact := actions.AddRtAttr(tab, nil)
+		tab++
+		gact.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("gact"))
+		gactOptions := gact.AddRtAttr(nl.TCA_ACT_OPTIONS, nil)
+		gen := nl.TcGen{Action: int32(netlink.TC_ACT_UNSPEC)}
+		gactOptions.AddRtAttr(nl.TCA_GACT_PARMS, gen.Serialize())
+		// struct tc_gact_p
+		prob := make([]byte, 8)
+		nl.NativeEndian().PutUint16(prob[0:2], gactProbRandom)
+		nl.NativeEndian().PutUint16(prob[2:4], sampleRate)
+		nl.NativeEndian().PutUint32(prob[4:8], uint32(netlink.TC_ACT_PIPE))
+		gactOptions.AddRtAttr(nl.TCA_GACT_PROB, prob)
+	}
+	mirred := actions.AddRtAttr(tab, nil)
+	mirred.AddRtAttr(nl.TCA_ACT_KIND, nl.ZeroTerminated("mirred"))
+	mirredOptions := mirred.AddRtAttr(nl.TCA_ACT_OPTIONS, nil)
+	parms := nl.TcMirred{
+		TcGen:   nl.TcGen{Action: int32(netlink.TC_ACT_UNSPEC)},
+		Eaction: int32(netlink.TCA_EGRESS_MIRROR),
+		Ifindex: uint32(mirrorIndex),
+	}
+	mirredOptions.AddRtAttr(nl.TCA_MIRRED_PARMS, parms.Serialize())
+	req.AddData(options)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// networkOrder returns the value that serializes in native byte order as v
+// in network byte order.
+func networkOrder(v uint32) uint32 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return nl.NativeEndian().Uint32(b)
+}
+
+// RemoveMirror removes the mirror of the named interface in the current
+// netns along its monitoring macvlan, if any.
+func RemoveMirror(name string, mirrorName string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return LinkDelete(mirrorName)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", name, err)
+	}
+	if hasClsact(qdiscs) {
+		for _, hook := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+			priority, _ := mirrorPlacement(hook)
+			if err := deleteFilters(link, hook, priority); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := LinkDelete(mirrorName); err != nil {
+		return fmt.Errorf("failed to delete monitoring macvlan %q: %v", mirrorName, err)
+	}
+	return nil
+}
+
+// CheckMirror verifies that the traffic of the named interface in the current
+// netns is mirrored as expected.
+func CheckMirror(name string, mirrorName string, m *Mirror) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+	mirror, err := netlink.LinkByName(mirrorName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup monitoring macvlan %q: %v", mirrorName, err)
+	}
+	if mirror.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("monitoring macvlan %q is down", mirrorName)
+	}
+
+	for _, hook := range m.hooks() {
+		priority, chains := mirrorPlacement(hook)
+		for _, chain := range chains {
+			filter, err := findChainFilter(link, hook, chain, priority)
+			if err != nil {
+				return err
+			}
+			matchAll, ok := filter.(*netlink.MatchAll)
+			if !ok || !isMirrorActions(matchAll.Actions, mirror.Attrs().Index, m.SampleRate > 1) {
+				return fmt.Errorf("mirror filter of %q in chain %d not found", name, chain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isMirrorActions tells whether the actions of an installed filter mirror the
+// frames to the link with the given index, sampled or not.
+func isMirrorActions(actions []netlink.Action, mirrorIndex int, sampled bool) bool {
+	if sampled {
+		if len(actions) == 0 {
+			return false
+		}
+		if _, ok := actions[0].(*netlink.GenericAction); !ok {
+			return false
+		}
+		actions = actions[1:]
+	}
+	if len(actions) != 1 {
+		return false
+	}
+	mirred, ok := actions[0].(*netlink.MirredAction)
+	return ok && mirred.MirredAction == netlink.TCA_EGRESS_MIRROR && mirred.Ifindex == mirrorIndex
+}
+
+// SetLowerDeviceMirror mirrors the traffic of the macvtap interface with the
+// given MAC toward the host interface of the mirror from its lower device, in
+// the current netns, replacing any previous mirror with the same name. The
+// name only tells the filters of the mirror apart from those of the other
+// macvtaps of the lower device, no monitoring macvlan is created.
+func SetLowerDeviceMirror(lowerDevice string, mirrorName string, mac net.HardwareAddr, m *Mirror) error {
+	if m.Device == lowerDevice {
+		return fmt.Errorf("can't mirror lower device %q to itself", lowerDevice)
+	}
+
+	if err := RemoveLowerDeviceMirror(lowerDevice, mirrorName); err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(lowerDevice)
+	if err != nil {
+		return fmt.Errorf("failed to lookup lower device %q: %v", lowerDevice, err)
+	}
+	device, err := netlink.LinkByName(m.Device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup mirror device %q: %v", m.Device, err)
+	}
+
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+	for _, hook := range m.hooks() {
+		err := addMirrorFilter(link.Attrs().Index, hook, 0, lowerDeviceMirrorPriority(hook), newLowerDeviceMirrorSelector(hook, mac), mirrorClassID(mirrorName), device.Attrs().Index, m.SampleRate)
+		if err != nil {
+			removeLowerDeviceMirror(link, mirrorName)
+			return fmt.Errorf("failed to add mirror filter to %q: %v", lowerDevice, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveLowerDeviceMirror removes the named mirror from the lower device in
+// the current netns, if any.
+func RemoveLowerDeviceMirror(lowerDevice string, mirrorName string) error {
+	link, err := netlink.LinkByName(lowerDevice)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup lower device %q: %v", lowerDevice, err)
+	}
+
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", lowerDevice, err)
+	}
+	if !hasClsact(qdiscs) {
+		return nil
+	}
+
+	return removeLowerDeviceMirror(link, mirrorName)
+}
+
+func removeLowerDeviceMirror(link netlink.Link, mirrorName string) error {
+	for _, hook := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := lowerDeviceMirrorFilters(link, hook, mirrorName)
+		if err != nil {
+			return err
+		}
+		for _, filter := range filters {
+			if err := netlink.FilterDel(filter); err != nil && !errors.Is(err, unix.ENOENT) {
+				return fmt.Errorf("failed to delete mirror filter of %q: %v", link.Attrs().Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckLowerDeviceMirror verifies that the traffic of the macvtap interface
+// with the given MAC is mirrored as expected from its lower device in the
+// current netns.
+func CheckLowerDeviceMirror(lowerDevice string, mirrorName string, mac net.HardwareAddr, m *Mirror) error {
+	link, err := netlink.LinkByName(lowerDevice)
+	if err != nil {
+		return fmt.Errorf("failed to lookup lower device %q: %v", lowerDevice, err)
+	}
+	device, err := netlink.LinkByName(m.Device)
+	if err != nil {
+		return fmt.Errorf("failed to lookup mirror device %q: %v", m.Device, err)
+	}
+
+	for _, hook := range m.hooks() {
+		filters, err := lowerDeviceMirrorFilters(link, hook, mirrorName)
+		if err != nil {
+			return err
+		}
+		expected := &netlink.U32{Sel: newLowerDeviceMirrorSelector(hook, mac)}
+		if len(filters) != 1 || !sameU32Selector(filters[0], expected) || !isMirrorActions(filters[0].Actions, device.Attrs().Index, m.SampleRate > 1) {
+			return fmt.Errorf("mirror filter of %q not found on lower device %q", mirrorName, lowerDevice)
+		}
+	}
+
+	return nil
+}
+
+// lowerDeviceMirrorFilters returns the filters of the named mirror on the
+// given clsact hook of the lower device.
+func lowerDeviceMirrorFilters(link netlink.Link, hook uint32, mirrorName string) ([]*netlink.U32, error) {
+	filters, err := netlink.FilterList(link, hook)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters of %q: %v", link.Attrs().Name, err)
+	}
+
+	var mirrorFilters []*netlink.U32
+	for _, filter := range filters {
+		u32, ok := filter.(*netlink.U32)
+		if ok && u32.Priority == lowerDeviceMirrorPriority(hook) && u32.ClassId == mirrorClassID(mirrorName) {
+			mirrorFilters = append(mirrorFilters, u32)
+		}
+	}
+	return mirrorFilters, nil
+}
+
+// lowerDeviceMirrorPriority returns the priority of the mirror filters on a
+// clsact hook of the lower device.
+func lowerDeviceMirrorPriority(hook uint32) uint16 {
+	if hook == netlink.HANDLE_MIN_INGRESS {
+		return lowerDeviceMirrorIngressPriority
+	}
+	return lowerDeviceMirrorEgressPriority
+}
+
+// newLowerDeviceMirrorSelector returns the u32 selector matching the frames
+// to the given MAC on the ingress hook of the lower device, from it on the
+// egress hook. The offsets are relative to the end of the Ethernet header.
+func newLowerDeviceMirrorSelector(hook uint32, mac net.HardwareAddr) *netlink.TcU32Sel {
+	// destination MAC
+	off := int32(-14)
+	if hook == netlink.HANDLE_MIN_EGRESS {
+		// source MAC
+		off = -8
+	}
+	return &netlink.TcU32Sel{
+		Flags: nl.TC_U32_TERMINAL,
+		Keys: []netlink.TcU32Key{
+			{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(mac[0:4]), Off: off},
+			{Mask: 0xffff0000, Val: uint32(binary.BigEndian.Uint16(mac[4:6])) << 16, Off: off + 4},
+		},
+	}
+}
+
+// mirrorClassID returns the class ID the filters of the named mirror are
+// tagged with on the lower device.
+func mirrorClassID(mirrorName string) uint32 {
+	return uint32(xxhash.Sum64String(mirrorName))
+}
@@ -0,0 +1,168 @@
+package util_test
+
+import (
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Mirror", func() {
+	It("accepts a device with a known direction", func() {
+		var mirror *util.Mirror
+		Expect(mirror.Validate()).To(Succeed())
+
+		Expect((&util.Mirror{Device: "mon0"}).Validate()).To(Succeed())
+		Expect((&util.Mirror{Device: "mon0", Direction: util.MirrorIngress, SampleRate: 100}).Validate()).To(Succeed())
+		Expect((&util.Mirror{Device: "mon0", FromLowerDevice: true}).Validate()).To(Succeed())
+	})
+
+	It("rejects a mirror without device", func() {
+		Expect((&util.Mirror{Direction: util.MirrorBoth}).Validate()).NotTo(Succeed())
+	})
+
+	It("rejects unknown directions", func() {
+		Expect((&util.Mirror{Device: "mon0", Direction: "inbound"}).Validate()).NotTo(Succeed())
+	})
+
+	Context("on an interface", func() {
+		const (
+			ifaceName    = "mirrored0"
+			mirrorDevice = "mon0"
+			mirrorName   = "mir0"
+		)
+		var testNs ns.NetNS
+		var mac net.HardwareAddr
+
+		BeforeEach(func() {
+			var err error
+			testNs, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			mac, err = net.ParseMAC("02:5a:00:00:00:02")
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, name := range []string{ifaceName, mirrorDevice} {
+				Expect(netlink.LinkAdd(&netlink.Dummy{
+					LinkAttrs: netlink.LinkAttrs{
+						Name:         name,
+						HardwareAddr: mac,
+						Namespace:    netlink.NsFd(int(testNs.Fd())),
+					},
+				})).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			Expect(testNs.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(testNs)).To(Succeed())
+		})
+
+		filters := func(hook uint32) []netlink.Filter {
+			link, err := netlink.LinkByName(ifaceName)
+			Expect(err).NotTo(HaveOccurred())
+			filters, err := netlink.FilterList(link, hook)
+			Expect(err).NotTo(HaveOccurred())
+			return filters
+		}
+
+		It("mirrors the egress traffic once through the spoof check, in the chain of the allowed frames", func() {
+			m := &util.Mirror{Device: mirrorDevice, Direction: util.MirrorEgress}
+			sc := &util.SpoofCheck{MAC: mac}
+
+			testNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(util.SetSpoofCheck(ifaceName, sc)).To(Succeed())
+				Expect(util.SetMirror(ifaceName, mirrorName, util.LinkOwner{Network: "mynet", ContainerID: "dummy", IfName: ifaceName}, m, testNs)).To(Succeed())
+				Expect(util.CheckMirror(ifaceName, mirrorName, m)).To(Succeed())
+
+				// the spoof check goes on to the chain of the allowed
+				// frames, where the egress mirror comes after it
+				isMirror := func(filter netlink.Filter) bool {
+					matchAll, ok := filter.(*netlink.MatchAll)
+					if !ok || len(matchAll.Actions) != 1 {
+						return false
+					}
+					_, ok = matchAll.Actions[0].(*netlink.MirredAction)
+					return ok
+				}
+				var spoofCheckPriorities []uint16
+				mirrorChains := map[uint32]uint16{}
+				for _, filter := range filters(netlink.HANDLE_MIN_EGRESS) {
+					if isMirror(filter) {
+						mirrorChains[*filter.Attrs().Chain] = filter.Attrs().Priority
+						continue
+					}
+					Expect(*filter.Attrs().Chain).To(BeZero())
+					spoofCheckPriorities = append(spoofCheckPriorities, filter.Attrs().Priority)
+					if flower, ok := filter.(*netlink.Flower); ok && flower.SrcMac != nil {
+						Expect(flower.Actions).To(HaveLen(1))
+						Expect(flower.Actions[0].Attrs().Action).To(Equal(netlink.TcAct(0x20000001)))
+					}
+				}
+				Expect(mirrorChains).To(HaveLen(2))
+				Expect(mirrorChains).To(HaveKey(uint32(0)))
+				Expect(mirrorChains).To(HaveKey(uint32(1)))
+				for _, priority := range spoofCheckPriorities {
+					Expect(mirrorChains[0]).To(BeNumerically(">", priority))
+				}
+
+				Expect(util.RemoveMirror(ifaceName, mirrorName)).To(Succeed())
+				Expect(util.CheckMirror(ifaceName, mirrorName, m)).NotTo(Succeed())
+				Expect(util.CheckSpoofCheck(ifaceName, sc)).To(Succeed())
+				Expect(filters(netlink.HANDLE_MIN_EGRESS)).To(HaveLen(len(spoofCheckPriorities)))
+
+				return nil
+			})
+		})
+
+		It("mirrors the traffic of a MAC from the lower device without a monitoring macvlan", func() {
+			m := &util.Mirror{Device: mirrorDevice, FromLowerDevice: true}
+			otherMAC, err := net.ParseMAC("02:5a:00:00:00:03")
+			Expect(err).NotTo(HaveOccurred())
+
+			testNs.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				Expect(util.SetLowerDeviceMirror(ifaceName, mirrorName, mac, m)).To(Succeed())
+				Expect(util.SetLowerDeviceMirror(ifaceName, "mir1", otherMAC, m)).To(Succeed())
+				Expect(util.CheckLowerDeviceMirror(ifaceName, mirrorName, mac, m)).To(Succeed())
+				Expect(util.CheckLowerDeviceMirror(ifaceName, mirrorName, otherMAC, m)).NotTo(Succeed())
+
+				exists, err := util.LinkExists(mirrorName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+
+				// the frames to the MAC on ingress, from it on egress
+				for hook, off := range map[uint32]int32{netlink.HANDLE_MIN_INGRESS: -14, netlink.HANDLE_MIN_EGRESS: -8} {
+					var keys [][]netlink.TcU32Key
+					for _, filter := range filters(hook) {
+						if u32, ok := filter.(*netlink.U32); ok && u32.Sel != nil && len(u32.Sel.Keys) > 0 {
+							keys = append(keys, u32.Sel.Keys)
+						}
+					}
+					Expect(keys).To(ContainElement([]netlink.TcU32Key{
+						{Mask: 0xffffffff, Val: 0x025a0000, Off: off},
+						{Mask: 0xffff0000, Val: 0x00020000, Off: off + 4},
+					}))
+				}
+
+				// replacing or removing a mirror leaves the others alone
+				Expect(util.SetLowerDeviceMirror(ifaceName, mirrorName, mac, m)).To(Succeed())
+				Expect(util.RemoveLowerDeviceMirror(ifaceName, mirrorName)).To(Succeed())
+				Expect(util.CheckLowerDeviceMirror(ifaceName, mirrorName, mac, m)).NotTo(Succeed())
+				Expect(util.CheckLowerDeviceMirror(ifaceName, "mir1", otherMAC, m)).To(Succeed())
+
+				Expect(util.SetLowerDeviceMirror(mirrorDevice, mirrorName, mac, m)).NotTo(Succeed())
+
+				return nil
+			})
+		})
+	})
+})
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -9,8 +10,11 @@ import (
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 
-	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/kubevirt/macvtap-cni/pkg/logging"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -24,25 +28,114 @@ func ModeFromString(s string) (netlink.MacvlanMode, error) {
 		return netlink.MACVLAN_MODE_PRIVATE, nil
 	case "vepa":
 		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	case "source":
+		return netlink.MACVLAN_MODE_SOURCE, nil
 	default:
 		return 0, fmt.Errorf("unknown macvtap mode: %q", s)
 	}
 }
 
-func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
-	ifindex := 0
+// ModeToString returns the name of a macvtap mode, as accepted by
+// ModeFromString.
+func ModeToString(mode netlink.MacvlanMode) string {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge"
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private"
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa"
+	case netlink.MACVLAN_MODE_PASSTHRU:
+		return "passthru"
+	case netlink.MACVLAN_MODE_SOURCE:
+		return "source"
+	default:
+		return fmt.Sprintf("unknown(%d)", mode)
+	}
+}
+
+// GetLowerDevice returns the name of the lower device of the named macvtap
+// interface, both being in the current netns.
+func GetLowerDevice(name string) (string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	parent, err := netlink.LinkByIndex(link.Attrs().ParentIndex)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup the lower device of %q: %v", name, err)
+	}
+
+	return parent.Attrs().Name, nil
+}
+
+// ParseSourceMACs parses the allowlist of source MAC addresses of a macvtap in
+// source mode.
+func ParseSourceMACs(macs []string) ([]net.HardwareAddr, error) {
+	var addrs []net.HardwareAddr
+	for _, mac := range macs {
+		addr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source MAC %q: %v", mac, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
 
+// ValidateSourceMACs checks that an allowlist of source MAC addresses is only
+// requested along the source mode.
+func ValidateSourceMACs(mode string, sourceMACs []net.HardwareAddr) error {
+	nlmode, err := ModeFromString(mode)
+	if err != nil {
+		return err
+	}
+	if len(sourceMACs) > 0 && nlmode != netlink.MACVLAN_MODE_SOURCE {
+		return fmt.Errorf("source MACs can only be set in source mode, not in %s mode", ModeToString(nlmode))
+	}
+	return nil
+}
+
+// setSourceMACs replaces the allowlist of source MAC addresses of a macvtap
+// in source mode, which only receives the frames sent from those addresses.
+func setSourceMACs(link netlink.Link, sourceMACs []net.HardwareAddr) error {
+	macvtap, ok := link.(*netlink.Macvtap)
+	if !ok || macvtap.Mode != netlink.MACVLAN_MODE_SOURCE {
+		return fmt.Errorf("source MACs can only be set on a macvtap in source mode")
+	}
+
+	if err := netlink.MacvlanMACAddrSet(link, sourceMACs); err != nil {
+		return fmt.Errorf("failed to set the source MACs of %q: %v", link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// newMacvtap builds the macvtap link to be created on top of lowerDevice,
+// which is looked up in the current netns.
+func newMacvtap(name string, lowerDevice string, mode string, sourceMACs []net.HardwareAddr, settings *MacvlanSettings) (*netlink.Macvtap, error) {
 	m, err := netlink.LinkByName(lowerDevice)
 	if err != nil {
-		return ifindex, fmt.Errorf("failed to lookup lowerDevice %q: %v", lowerDevice, err)
+		return nil, fmt.Errorf("failed to lookup lowerDevice %q: %v", lowerDevice, err)
+	}
+
+	if err := ValidateSourceMACs(mode, sourceMACs); err != nil {
+		return nil, err
+	}
+
+	if err := settings.Validate(mode); err != nil {
+		return nil, err
 	}
 
 	nlmode, err := ModeFromString(mode)
 	if err != nil {
-		return ifindex, err
+		return nil, err
 	}
 
-	mv := &netlink.Macvtap{
+	return &netlink.Macvtap{
 		Macvlan: netlink.Macvlan{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:        name,
@@ -52,12 +145,37 @@ func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
 			},
 			Mode: nlmode,
 		},
+	}, nil
+}
+
+// CreateMacvtap creates a macvtap on top of lowerDevice in the current netns
+// and returns its index. In source mode, only the frames sent from sourceMACs
+// reach the macvtap. The macvlan settings, if any, are set before it is set
+// up.
+func CreateMacvtap(name string, lowerDevice string, mode string, sourceMACs []net.HardwareAddr, settings *MacvlanSettings) (int, error) {
+	ifindex := 0
+
+	mv, err := newMacvtap(name, lowerDevice, mode, sourceMACs, settings)
+	if err != nil {
+		return ifindex, err
 	}
 
 	if err := netlink.LinkAdd(mv); err != nil {
 		return ifindex, fmt.Errorf("failed to create macvtap: %v", err)
 	}
 
+	if len(sourceMACs) > 0 {
+		if err := setSourceMACs(mv, sourceMACs); err != nil {
+			LinkDelete(name)
+			return ifindex, err
+		}
+	}
+
+	if err := settings.apply(mv); err != nil {
+		LinkDelete(name)
+		return ifindex, err
+	}
+
 	if err := netlink.LinkSetUp(mv); err != nil {
 		return ifindex, fmt.Errorf("failed to set %q UP: %v", name, err)
 	}
@@ -66,12 +184,12 @@ func CreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
 	return ifindex, nil
 }
 
-func RecreateMacvtap(name string, lowerDevice string, mode string) (int, error) {
+func RecreateMacvtap(name string, lowerDevice string, mode string, sourceMACs []net.HardwareAddr, settings *MacvlanSettings) (int, error) {
 	err := LinkDelete(name)
 	if err != nil {
 		return 0, err
 	}
-	return CreateMacvtap(name, lowerDevice, mode)
+	return CreateMacvtap(name, lowerDevice, mode, sourceMACs, settings)
 }
 
 func LinkExists(link string) (bool, error) {
@@ -226,56 +344,190 @@ func onLinkEvent(match func(netlink.Link) bool, nsPath string, do func(), stop <
 }
 
 // Move an existing macvtap interface from the current netns to the target netns, and rename it..
-// Optionally configure the MAC address of the interface and the link's MTU.
-func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, owner int, group int, netns ns.NetNS) (*current.Interface, error) {
-	var err error
-
+// Optionally configure the MAC address of the interface, the link's MTU, the
+// source MACs of an interface in source mode and further tuning settings, and
+// grant access to its tap device. The interface is set up unless it is to be
+// left on standby, in one of the standby modes.
+func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, access *TapAccess, sourceMACs []net.HardwareAddr, tuning *Tuning, standby string, netns ns.NetNS) (*current.Interface, error) {
 	macvtapIface, err := netlink.LinkByName(currentIfaceName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to lookup device %q: %v", currentIfaceName, err)
 	}
 
 	// move the macvtap interface to the pod's netns
-	if err = netlink.LinkSetNsFd(macvtapIface, int(netns.Fd())); err != nil {
+	start := time.Now()
+	err = netlink.LinkSetNsFd(macvtapIface, int(netns.Fd()))
+	logging.Step("move macvtap", start, err, "name", currentIfaceName, "netns", netns.Path())
+	if err != nil {
 		return nil, fmt.Errorf("failed to move iface %s to the netns %d because: %v", macvtapIface, netns.Fd(), err)
 	}
 
+	return configureInterface(currentIfaceName, newIfaceName, macAddr, mtu, promisc, access, sourceMACs, tuning, standby, netns)
+}
+
+// ReconcileInterface configures a macvtap interface that is already in the
+// target netns under its final name, the same way ConfigureInterface does, so
+// that a retried ADD converges to the requested configuration.
+func ReconcileInterface(ifaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, access *TapAccess, sourceMACs []net.HardwareAddr, tuning *Tuning, standby string, netns ns.NetNS) (*current.Interface, error) {
+	return configureInterface(ifaceName, ifaceName, macAddr, mtu, promisc, access, sourceMACs, tuning, standby, netns)
+}
+
+// CreateInterface creates a macvtap interface on top of a lower device of the
+// current netns directly in the target netns, and then configures it the same
+// way ConfigureInterface does.
+func CreateInterface(lowerDevice string, mode string, settings *MacvlanSettings, newIfaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, access *TapAccess, sourceMACs []net.HardwareAddr, tuning *Tuning, standby string, netns ns.NetNS) (*current.Interface, error) {
+	// the interface is created with a temporary name so that it doesn't
+	// clash with an existing one until it's configured and renamed
+	tempIfaceName := TemporaryInterfaceName(newIfaceName)
+
+	mv, err := newMacvtap(tempIfaceName, lowerDevice, mode, sourceMACs, settings)
+	if err != nil {
+		return nil, err
+	}
+	mv.Namespace = netlink.NsFd(int(netns.Fd()))
+
+	start := time.Now()
+	err = netlink.LinkAdd(mv)
+	logging.Step("create macvtap", start, err, "name", tempIfaceName, "lowerDevice", lowerDevice, "mode", mode, "netns", netns.Path())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create macvtap: %v", err)
+	}
+
+	if !settings.isEmpty() {
+		start = time.Now()
+		err = netns.Do(func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(tempIfaceName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup device %q: %v", tempIfaceName, err)
+			}
+			if err := settings.apply(link); err != nil {
+				LinkDelete(tempIfaceName)
+				return err
+			}
+			return nil
+		})
+		logging.Step("set macvlan settings", start, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return configureInterface(tempIfaceName, newIfaceName, macAddr, mtu, promisc, access, sourceMACs, tuning, standby, netns)
+}
+
+// configureInterface configures and renames a macvtap interface that is
+// already in the target netns. The interface is deleted on failure.
+func configureInterface(currentIfaceName string, newIfaceName string, macAddr *net.HardwareAddr, mtu int, promisc bool, access *TapAccess, sourceMACs []net.HardwareAddr, tuning *Tuning, standby string, netns ns.NetNS) (*current.Interface, error) {
 	var macvtap *current.Interface = nil
 
 	// configure the macvtap iface
-	err = netns.Do(func(_ ns.NetNS) error {
+	err := netns.Do(func(_ ns.NetNS) (err error) {
+		// Until renamed, an interface with the new name is not the
+		// macvtap, as when the rename collides with one of the pod
+		renamed := false
 		defer func() {
 			if err != nil {
-				LinkDelete(currentIfaceName)
-				LinkDelete(newIfaceName)
+				name := currentIfaceName
+				if renamed {
+					name = newIfaceName
+				}
+				start := time.Now()
+				rollbackErr := LinkDelete(name)
+				logging.Step("roll back macvtap", start, rollbackErr, "name", name, "netns", netns.Path())
 			}
 		}()
 
+		start := time.Now()
+		macvtapIface, err := netlink.LinkByName(currentIfaceName)
+		logging.Step("look up macvtap", start, err, "name", currentIfaceName, "netns", netns.Path())
+		if err != nil {
+			return fmt.Errorf("failed to lookup device %q: %v", currentIfaceName, err)
+		}
+
 		if mtu != 0 {
-			if err := netlink.LinkSetMTU(macvtapIface, mtu); err != nil {
+			start = time.Now()
+			err = netlink.LinkSetMTU(macvtapIface, mtu)
+			logging.Step("set MTU", start, err, "mtu", mtu)
+			if err != nil {
 				return fmt.Errorf("failed to set the macvtap MTU for %s: %v", currentIfaceName, err)
 			}
 		}
 
+		// On standby, the source of the migration may still be using the
+		// MAC on the same lower device, which only lets one of its
+		// children up with a given MAC: the MAC is then taken over on
+		// activation.
+		macPending := false
 		if macAddr != nil {
-			if err := netlink.LinkSetHardwareAddr(macvtapIface, *macAddr); err != nil {
+			start = time.Now()
+			err = netlink.LinkSetHardwareAddr(macvtapIface, *macAddr)
+			logging.Step("set MAC", start, err, "mac", macAddr.String())
+			if standby != "" && errors.Is(err, unix.EADDRINUSE) {
+				macPending, err = true, nil
+			}
+			if err != nil {
 				return fmt.Errorf("failed to add hardware addr to %q: %v", currentIfaceName, err)
 			}
 		}
 
 		if promisc {
-			if err := netlink.SetPromiscOn(macvtapIface); err != nil {
+			start = time.Now()
+			err = netlink.SetPromiscOn(macvtapIface)
+			logging.Step("enable promiscuous mode", start, err)
+			if err != nil {
 				return fmt.Errorf("failed to enable promiscous mode on %q: %v", currentIfaceName, err)
 			}
 		}
 
+		// On standby in source mode, the allowlist is only set on
+		// activation
+		if standby == StandbySource {
+			start = time.Now()
+			err = flushSourceMACs(macvtapIface)
+			logging.Step("flush source MACs", start, err)
+			if err != nil {
+				return err
+			}
+		} else if len(sourceMACs) > 0 {
+			start = time.Now()
+			err = setSourceMACs(macvtapIface, sourceMACs)
+			logging.Step("set source MACs", start, err, "count", len(sourceMACs))
+			if err != nil {
+				return err
+			}
+		}
+
+		start = time.Now()
 		renamedMacvtapIface, err := renameInterface(macvtapIface, newIfaceName)
+		logging.Step("rename macvtap", start, err, "from", currentIfaceName, "to", newIfaceName)
 		if err != nil {
 			return err
 		}
+		renamed = true
 
-		if err := netlink.LinkSetUp(renamedMacvtapIface); err != nil {
-			return fmt.Errorf("failed to set macvtap iface up: %v", err)
+		if tuning != nil {
+			start = time.Now()
+			err = tuning.apply(renamedMacvtapIface)
+			logging.Step("apply tuning", start, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A reconciled macvtap may have been set up by a previous ADD
+		start = time.Now()
+		if standby == StandbyDown {
+			err = netlink.LinkSetDown(renamedMacvtapIface)
+			logging.Step("set macvtap down", start, err)
+			if err != nil {
+				return fmt.Errorf("failed to set macvtap iface down: %v", err)
+			}
+		} else {
+			err = netlink.LinkSetUp(renamedMacvtapIface)
+			logging.Step("set macvtap up", start, err)
+			if err != nil {
+				return fmt.Errorf("failed to set macvtap iface up: %v", err)
+			}
 		}
 
 		// Re-fetch macvtap to get all properties/attributes
@@ -286,17 +538,24 @@ func ConfigureInterface(currentIfaceName string, newIfaceName string, macAddr *n
 			return err
 		}
 
-		// set ownership of /dev/tapX
-		pathToTap := filepath.Join("/dev", fmt.Sprintf("tap%d", macvtapIface.Attrs().Index))
-		if err := os.Chown(pathToTap, owner, group); err != nil {
-			return fmt.Errorf("failed to change ownership of tap device %s for iface %s to %d:%d because: %v", pathToTap, newIfaceName, owner, group, err)
+		// grant access to /dev/tapX
+		start = time.Now()
+		pathToTap := TapDevicePath(macvtapIface.Attrs().Index)
+		err = access.Apply(pathToTap)
+		logging.Step("grant tap device access", start, err, "path", pathToTap, "uid", access.UID, "gid", access.GID)
+		if err != nil {
+			return fmt.Errorf("failed to grant access to the tap device of iface %s: %v", newIfaceName, err)
 		}
 
 		macvtap = &current.Interface{
 			Name:    newIfaceName,
 			Mac:     macvtapIface.Attrs().HardwareAddr.String(),
+			Mtu:     macvtapIface.Attrs().MTU,
 			Sandbox: netns.Path(),
 		}
+		if macPending {
+			macvtap.Mac = macAddr.String()
+		}
 
 		return nil
 	})
@@ -316,6 +575,49 @@ func renameInterface(currentIface netlink.Link, newIfaceName string) (netlink.Li
 	return renamedMacvtapIface, nil
 }
 
+// FlushAddresses removes the global addresses and the routes of the named
+// interface in the current netns, so that they can be configured anew.
+func FlushAddresses(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", name, err)
+	}
+	for _, route := range routes {
+		if route.Protocol == unix.RTPROT_KERNEL {
+			continue
+		}
+		if err := netlink.RouteDel(&route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("failed to delete route %s of %q: %v", route, name, err)
+		}
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %q: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if addr.Scope != unix.RT_SCOPE_UNIVERSE {
+			continue
+		}
+		if err := netlink.AddrDel(link, &addr); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+			return fmt.Errorf("failed to delete address %s of %q: %v", addr.IPNet, name, err)
+		}
+	}
+
+	return nil
+}
+
+// TapDevicePath returns the path of the tap character device backing the
+// macvtap interface with the given index.
+func TapDevicePath(ifindex int) string {
+	return filepath.Join("/dev", fmt.Sprintf("tap%d", ifindex))
+}
+
 // GetMainThreadNetNsPath returns the path of the main thread's namespace
 func GetMainThreadNetNsPath() string {
 	return fmt.Sprintf("/proc/%d/ns/net", os.Getpid())
@@ -0,0 +1,45 @@
+package util_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("macvtap modes", func() {
+	It("round trips every mode through its name", func() {
+		for _, name := range []string{"bridge", "private", "vepa", "passthru", "source"} {
+			mode, err := util.ModeFromString(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(util.ModeToString(mode)).To(Equal(name))
+		}
+	})
+
+	It("defaults to bridge mode", func() {
+		Expect(util.ModeFromString("")).To(Equal(netlink.MACVLAN_MODE_BRIDGE))
+	})
+
+	It("rejects unknown modes", func() {
+		_, err := util.ModeFromString("bridged")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("source MACs", func() {
+	It("are only accepted in source mode", func() {
+		sourceMACs, err := util.ParseSourceMACs([]string{"02:00:00:00:00:01", "02:00:00:00:00:02"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sourceMACs).To(HaveLen(2))
+
+		Expect(util.ValidateSourceMACs("source", sourceMACs)).To(Succeed())
+		Expect(util.ValidateSourceMACs("source", nil)).To(Succeed())
+		Expect(util.ValidateSourceMACs("bridge", sourceMACs)).NotTo(Succeed())
+	})
+
+	It("rejects invalid addresses", func() {
+		_, err := util.ParseSourceMACs([]string{"02:00:00:00:00"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,247 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// SpoofCheck holds the source addresses the consumer of a macvtap interface
+// is allowed to send frames from.
+type SpoofCheck struct {
+	MAC net.HardwareAddr
+	// IPs are the source addresses allowed in IP packets, which are not
+	// checked when empty.
+	IPs []net.IP
+}
+
+// Source addresses of IP packets sent before an address is configured, for
+// DHCP, duplicate address detection and neighbor discovery.
+var unconfiguredSources = []net.IPNet{
+	{IP: net.IPv4zero, Mask: net.CIDRMask(32, 32)},
+	{IP: net.IPv6unspecified, Mask: net.CIDRMask(128, 128)},
+	{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)},
+}
+
+// SetSpoofCheck drops the frames the consumer of the named macvtap interface
+// in the current netns sends from another MAC address than the allowed one,
+// and, if any IPs are allowed, the IP packets sent from other addresses,
+// replacing any previous check. The frames it sends go through the egress hook
+// of the interface.
+func SetSpoofCheck(name string, sc *SpoofCheck) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	if err := removeSpoofCheck(link); err != nil {
+		return err
+	}
+
+	if err := ensureClsact(link); err != nil {
+		return err
+	}
+
+	for _, filter := range newSpoofCheckFilters(link.Attrs().Index, sc) {
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add spoof check %s filter to %q: %v", filter.Type(), name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveSpoofCheck removes the spoof check from the named interface in the
+// current netns, if any.
+func RemoveSpoofCheck(name string) error {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	return removeSpoofCheck(link)
+}
+
+func removeSpoofCheck(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return fmt.Errorf("failed to list qdiscs of %q: %v", link.Attrs().Name, err)
+	}
+	if !hasClsact(qdiscs) {
+		return nil
+	}
+
+	for _, priority := range []uint16{spoofCheckAllowIPPriority, spoofCheckAllowARPPriority, spoofCheckDropIPPriority, spoofCheckAllowMACPriority, spoofCheckDropPriority} {
+		if err := deleteFilters(link, netlink.HANDLE_MIN_EGRESS, priority); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckSpoofCheck verifies that the named interface in the current netns is
+// spoof checked as expected.
+func CheckSpoofCheck(name string, sc *SpoofCheck) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup device %q: %v", name, err)
+	}
+
+	filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+	if err != nil {
+		return fmt.Errorf("failed to list filters of %q: %v", name, err)
+	}
+
+	for _, expected := range newSpoofCheckFilters(link.Attrs().Index, sc) {
+		found := false
+		for _, filter := range filters {
+			if sameSpoofCheckFilter(filter, expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("spoof check %s filter with priority %d of %q not found", expected.Type(), expected.Attrs().Priority, name)
+		}
+	}
+
+	return nil
+}
+
+// newSpoofCheckFilters returns the filters of a spoof check, in the order
+// they are evaluated: the allowed IP packets and ARP packets are let through,
+// the other IP and ARP packets dropped along with the VLAN tagged frames,
+// whose content is not checked, the remaining frames from the allowed MAC let
+// through and everything else dropped. The frames let through go on to the
+// chain of the allowed frames, where the egress mirror is.
+func newSpoofCheckFilters(linkIndex int, sc *SpoofCheck) []netlink.Filter {
+	attrs := func(priority uint16) netlink.FilterAttrs {
+		return netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Priority:  priority,
+			Protocol:  unix.ETH_P_ALL,
+		}
+	}
+	flower := func(priority uint16, mac net.HardwareAddr, ipNet *net.IPNet, action netlink.TcAct) *netlink.Flower {
+		filter := &netlink.Flower{
+			FilterAttrs: attrs(priority),
+			SrcMac:      mac,
+			Actions:     []netlink.Action{newGenericAction(action)},
+		}
+		if ipNet != nil {
+			filter.EthType = unix.ETH_P_IP
+			if ipNet.IP.To4() == nil {
+				filter.EthType = unix.ETH_P_IPV6
+			}
+			filter.SrcIP = ipNet.IP
+			filter.SrcIPMask = ipNet.Mask
+		}
+		return filter
+	}
+
+	var filters []netlink.Filter
+	if len(sc.IPs) > 0 {
+		allowed := append([]net.IPNet{}, unconfiguredSources...)
+		for _, ip := range sc.IPs {
+			allowed = append(allowed, hostIPNet(ip))
+		}
+		for i := range allowed {
+			filters = append(filters, flower(spoofCheckAllowIPPriority, sc.MAC, &allowed[i], allowAction))
+		}
+		for i := range allowed {
+			if ip4 := allowed[i].IP.To4(); ip4 != nil {
+				filters = append(filters, newAllowARPFilter(attrs(spoofCheckAllowARPPriority), sc.MAC, ip4))
+			}
+		}
+
+		for _, ethType := range []uint16{unix.ETH_P_IP, unix.ETH_P_IPV6, unix.ETH_P_ARP, unix.ETH_P_8021Q, unix.ETH_P_8021AD} {
+			drop := flower(spoofCheckDropIPPriority, nil, nil, netlink.TC_ACT_SHOT)
+			drop.EthType = ethType
+			filters = append(filters, drop)
+		}
+	}
+
+	filters = append(filters,
+		flower(spoofCheckAllowMACPriority, sc.MAC, nil, allowAction),
+		&netlink.MatchAll{
+			FilterAttrs: attrs(spoofCheckDropPriority),
+			Actions:     []netlink.Action{newGenericAction(netlink.TC_ACT_SHOT)},
+		},
+	)
+
+	return filters
+}
+
+// newAllowARPFilter returns the u32 filter letting through the ARP packets
+// sent from mac with ip as sender address, as flower can't match the ARP
+// fields. The offsets are relative to the ARP header, preceded by the source
+// MAC and the EtherType at the end of the Ethernet header.
+func newAllowARPFilter(attrs netlink.FilterAttrs, mac net.HardwareAddr, ip net.IP) *netlink.U32 {
+	attrs.Protocol = unix.ETH_P_ARP
+	return &netlink.U32{
+		FilterAttrs: attrs,
+		Sel: &netlink.TcU32Sel{
+			Flags: nl.TC_U32_TERMINAL,
+			Keys: []netlink.TcU32Key{
+				// source MAC of the Ethernet header
+				{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(mac[0:4]), Off: -8},
+				{Mask: 0xffff0000, Val: uint32(binary.BigEndian.Uint16(mac[4:6])) << 16, Off: -4},
+				// sender protocol address, after the sender hardware address
+				{Mask: 0x0000ffff, Val: uint32(binary.BigEndian.Uint16(ip[0:2])), Off: 12},
+				{Mask: 0xffff0000, Val: uint32(binary.BigEndian.Uint16(ip[2:4])) << 16, Off: 16},
+			},
+		},
+		Actions: []netlink.Action{newGenericAction(allowAction)},
+	}
+}
+
+// allowAction lets the frames allowed by the spoof check through, to the
+// filters of their own chain.
+const allowAction = netlink.TcAct(tcActGotoChain | spoofCheckAllowedChain)
+
+func newGenericAction(action netlink.TcAct) *netlink.GenericAction {
+	return &netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: action}}
+}
+
+// hostIPNet returns the network made of the single address ip.
+func hostIPNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// sameSpoofCheckFilter tells whether an installed filter matches the same
+// frames as an expected one.
+func sameSpoofCheckFilter(filter netlink.Filter, expected netlink.Filter) bool {
+	if filter.Attrs().Priority != expected.Attrs().Priority || filter.Type() != expected.Type() {
+		return false
+	}
+
+	switch expected := expected.(type) {
+	case *netlink.U32:
+		return sameU32Selector(filter.(*netlink.U32), expected)
+	case *netlink.MatchAll:
+		return true
+	}
+
+	expectedFlower := expected.(*netlink.Flower)
+	flower := filter.(*netlink.Flower)
+	if !bytes.Equal(flower.SrcMac, expectedFlower.SrcMac) || flower.EthType != expectedFlower.EthType {
+		return false
+	}
+	if expectedFlower.SrcIP == nil {
+		return flower.SrcIP == nil
+	}
+	return expectedFlower.SrcIP.Equal(flower.SrcIP) && bytes.Equal(flower.SrcIPMask, expectedFlower.SrcIPMask)
+}
@@ -0,0 +1,124 @@
+package util_test
+
+import (
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Spoof check", func() {
+	const ifaceName = "spoofchk0"
+	var testNs ns.NetNS
+	var mac net.HardwareAddr
+
+	BeforeEach(func() {
+		var err error
+		testNs, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		mac, err = net.ParseMAC("02:5a:00:00:00:01")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(netlink.LinkAdd(&netlink.Dummy{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:         ifaceName,
+				HardwareAddr: mac,
+				Namespace:    netlink.NsFd(int(testNs.Fd())),
+			},
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(testNs.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(testNs)).To(Succeed())
+	})
+
+	egressFilters := func() []netlink.Filter {
+		link, err := netlink.LinkByName(ifaceName)
+		Expect(err).NotTo(HaveOccurred())
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+		Expect(err).NotTo(HaveOccurred())
+		return filters
+	}
+
+	droppedEthTypes := func(filters []netlink.Filter) []uint16 {
+		var ethTypes []uint16
+		for _, filter := range filters {
+			flower, ok := filter.(*netlink.Flower)
+			if ok && flower.SrcMac == nil && flower.EthType != 0 {
+				ethTypes = append(ethTypes, flower.EthType)
+			}
+		}
+		return ethTypes
+	}
+
+	It("drops the VLAN tagged frames and the ARP packets from other addresses when checking IPs", func() {
+		sc := &util.SpoofCheck{MAC: mac, IPs: []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")}}
+
+		testNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(util.SetSpoofCheck(ifaceName, sc)).To(Succeed())
+			Expect(util.CheckSpoofCheck(ifaceName, sc)).To(Succeed())
+
+			filters := egressFilters()
+			Expect(droppedEthTypes(filters)).To(ConsistOf(
+				uint16(unix.ETH_P_IP), uint16(unix.ETH_P_IPV6), uint16(unix.ETH_P_ARP), uint16(unix.ETH_P_8021Q), uint16(unix.ETH_P_8021AD),
+			))
+
+			// the ARP packets are let through from the MAC of the interface
+			// with 0.0.0.0 or 10.0.0.5 as sender address
+			var senders []netlink.TcU32Key
+			for _, filter := range filters {
+				u32, ok := filter.(*netlink.U32)
+				if !ok {
+					continue
+				}
+				Expect(u32.Protocol).To(Equal(uint16(unix.ETH_P_ARP)))
+				Expect(u32.Sel.Keys).To(HaveLen(4))
+				Expect(u32.Sel.Keys[0]).To(Equal(netlink.TcU32Key{Mask: 0xffffffff, Val: 0x025a0000, Off: -8}))
+				Expect(u32.Sel.Keys[1]).To(Equal(netlink.TcU32Key{Mask: 0xffff0000, Val: 0x00010000, Off: -4}))
+				senders = append(senders, u32.Sel.Keys[2], u32.Sel.Keys[3])
+			}
+			Expect(senders).To(ConsistOf(
+				netlink.TcU32Key{Mask: 0x0000ffff, Val: 0x00000000, Off: 12},
+				netlink.TcU32Key{Mask: 0xffff0000, Val: 0x00000000, Off: 16},
+				netlink.TcU32Key{Mask: 0x0000ffff, Val: 0x00000a00, Off: 12},
+				netlink.TcU32Key{Mask: 0xffff0000, Val: 0x00050000, Off: 16},
+			))
+
+			otherIPs := &util.SpoofCheck{MAC: mac, IPs: []net.IP{net.ParseIP("10.0.0.6"), net.ParseIP("fd00::5")}}
+			Expect(util.CheckSpoofCheck(ifaceName, otherIPs)).NotTo(Succeed())
+
+			Expect(util.RemoveSpoofCheck(ifaceName)).To(Succeed())
+			Expect(egressFilters()).To(BeEmpty())
+			Expect(util.CheckSpoofCheck(ifaceName, sc)).NotTo(Succeed())
+
+			return nil
+		})
+	})
+
+	It("only checks the MAC when not checking IPs", func() {
+		sc := &util.SpoofCheck{MAC: mac}
+
+		testNs.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(util.SetSpoofCheck(ifaceName, sc)).To(Succeed())
+			Expect(util.CheckSpoofCheck(ifaceName, sc)).To(Succeed())
+
+			filters := egressFilters()
+			Expect(filters).To(HaveLen(2))
+			Expect(droppedEthTypes(filters)).To(BeEmpty())
+
+			return nil
+		})
+	})
+})
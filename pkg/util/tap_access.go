@@ -0,0 +1,399 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	aclXattr     = "system.posix_acl_access"
+	selinuxXattr = "security.selinux"
+	aclVersion   = 2
+)
+
+// POSIX ACL entry tags, as stored in the access ACL extended attribute.
+const (
+	aclUserObj  uint16 = 0x01
+	aclUser     uint16 = 0x02
+	aclGroupObj uint16 = 0x04
+	aclGroup    uint16 = 0x08
+	aclMask     uint16 = 0x10
+	aclOther    uint16 = 0x20
+)
+
+// TapAccessConfig holds how access to the tap device of a macvtap interface
+// is granted, as configured.
+type TapAccessConfig struct {
+	// User and Group are names or numeric ids of the owner of the tap device.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Mode is the octal file mode of the tap device, e.g. 0660.
+	Mode string `json:"mode,omitempty"`
+	// ACL are POSIX ACL entries granting access to further users and groups,
+	// in the setfacl short form, e.g. u:qemu:rw or g:kvm:rw.
+	ACL []string `json:"acl,omitempty"`
+	// SELinuxLabel is the SELinux file context of the tap device.
+	SELinuxLabel string `json:"seLinuxLabel,omitempty"`
+	// AccountsRoot is the root of the etc/passwd and etc/group files the
+	// names are resolved against, e.g. the mount point of the host root.
+	AccountsRoot string `json:"accountsRoot,omitempty"`
+}
+
+// TapAccess holds how access to the tap device of a macvtap interface is
+// granted, with names resolved to ids.
+type TapAccess struct {
+	UID          int
+	GID          int
+	Mode         *os.FileMode
+	ACL          []ACLEntry
+	SELinuxLabel string
+}
+
+// ACLEntry is a POSIX ACL entry granting permissions to a user or group.
+type ACLEntry struct {
+	Tag  uint16
+	ID   uint32
+	Perm uint16
+}
+
+// Resolve validates the configuration and resolves the names it refers to.
+// The tap device is owned by defaultUID and defaultGID unless configured
+// otherwise.
+func (c *TapAccessConfig) Resolve(defaultUID int, defaultGID int) (*TapAccess, error) {
+	access := &TapAccess{UID: defaultUID, GID: defaultGID}
+	if c == nil {
+		return access, nil
+	}
+
+	root := c.AccountsRoot
+	if root == "" {
+		root = "/"
+	}
+
+	var err error
+	if c.User != "" {
+		if access.UID, err = lookupID(filepath.Join(root, "etc/passwd"), c.User); err != nil {
+			return nil, fmt.Errorf("failed to resolve user %q: %v", c.User, err)
+		}
+	}
+	if c.Group != "" {
+		if access.GID, err = lookupID(filepath.Join(root, "etc/group"), c.Group); err != nil {
+			return nil, fmt.Errorf("failed to resolve group %q: %v", c.Group, err)
+		}
+	}
+
+	if c.Mode != "" {
+		mode, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid mode %q, expected octal permissions such as 0660", c.Mode)
+		}
+		fileMode := os.FileMode(mode)
+		access.Mode = &fileMode
+	}
+
+	// the kernel refuses an ACL with several entries for the same user or
+	// group
+	seen := map[ACLEntry]string{}
+	for _, entry := range c.ACL {
+		aclEntry, err := parseACLEntry(root, entry)
+		if err != nil {
+			return nil, err
+		}
+		key := ACLEntry{Tag: aclEntry.Tag, ID: aclEntry.ID}
+		if previous, ok := seen[key]; ok {
+			return nil, fmt.Errorf("ACL entries %q and %q are for the same user or group", previous, entry)
+		}
+		seen[key] = entry
+		access.ACL = append(access.ACL, aclEntry)
+	}
+
+	if c.SELinuxLabel != "" {
+		// user:role:type, optionally followed by the level
+		if fields := strings.SplitN(c.SELinuxLabel, ":", 4); len(fields) < 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return nil, fmt.Errorf("invalid SELinux label %q, expected user:role:type[:level]", c.SELinuxLabel)
+		}
+		access.SELinuxLabel = c.SELinuxLabel
+	}
+
+	return access, nil
+}
+
+// lookupID returns the id of the named entry of a passwd or group file. Numeric
+// names are taken as ids as is.
+func lookupID(path string, name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// name:password:id:...
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid id %q in %s", fields[2], path)
+		}
+		return int(id), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("not found in %s", path)
+}
+
+func parseACLEntry(root string, entry string) (ACLEntry, error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) != 3 || fields[1] == "" {
+		return ACLEntry{}, fmt.Errorf("invalid ACL entry %q, expected u:<user>:<perms> or g:<group>:<perms>", entry)
+	}
+
+	var aclEntry ACLEntry
+	var err error
+	var id int
+	switch fields[0] {
+	case "u", "user":
+		aclEntry.Tag = aclUser
+		id, err = lookupID(filepath.Join(root, "etc/passwd"), fields[1])
+	case "g", "group":
+		aclEntry.Tag = aclGroup
+		id, err = lookupID(filepath.Join(root, "etc/group"), fields[1])
+	default:
+		return ACLEntry{}, fmt.Errorf("invalid ACL entry %q, expected u:<user>:<perms> or g:<group>:<perms>", entry)
+	}
+	if err != nil {
+		return ACLEntry{}, fmt.Errorf("failed to resolve %q of ACL entry %q: %v", fields[1], entry, err)
+	}
+	aclEntry.ID = uint32(id)
+
+	for _, p := range fields[2] {
+		switch p {
+		case 'r':
+			aclEntry.Perm |= 4
+		case 'w':
+			aclEntry.Perm |= 2
+		case 'x':
+			aclEntry.Perm |= 1
+		case '-':
+		default:
+			return ACLEntry{}, fmt.Errorf("invalid permissions %q of ACL entry %q", fields[2], entry)
+		}
+	}
+
+	return aclEntry, nil
+}
+
+// Apply grants access to the tap device at path.
+func (a *TapAccess) Apply(path string) error {
+	if err := os.Chown(path, a.UID, a.GID); err != nil {
+		return fmt.Errorf("failed to change ownership of tap device %s to %d:%d: %v", path, a.UID, a.GID, err)
+	}
+
+	if a.Mode != nil {
+		if err := os.Chmod(path, *a.Mode); err != nil {
+			return fmt.Errorf("failed to change mode of tap device %s to %#o: %v", path, *a.Mode, err)
+		}
+	}
+
+	if len(a.ACL) > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat tap device %s: %v", path, err)
+		}
+		if err := unix.Setxattr(path, aclXattr, a.encodeACL(info.Mode().Perm()), 0); err != nil {
+			return fmt.Errorf("failed to set ACL of tap device %s: %v", path, err)
+		}
+	}
+
+	if a.SELinuxLabel != "" {
+		if err := unix.Setxattr(path, selinuxXattr, append([]byte(a.SELinuxLabel), 0), 0); err != nil {
+			return fmt.Errorf("failed to set SELinux label of tap device %s to %q: %v", path, a.SELinuxLabel, err)
+		}
+	}
+
+	return nil
+}
+
+// Check verifies that access to the tap device at path is granted as
+// expected.
+func (a *TapAccess) Check(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat tap device %s: %v", path, err)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to read ownership of tap device %s", path)
+	}
+	if int(stat.Uid) != a.UID || int(stat.Gid) != a.GID {
+		return fmt.Errorf("tap device %s is owned by %d:%d, expected %d:%d", path, stat.Uid, stat.Gid, a.UID, a.GID)
+	}
+
+	// with an ACL, the group permissions hold the ACL mask instead, the mode
+	// is checked against the ACL
+	if len(a.ACL) > 0 {
+		if err := a.checkACL(path); err != nil {
+			return err
+		}
+	} else if a.Mode != nil && info.Mode().Perm() != *a.Mode {
+		return fmt.Errorf("tap device %s has mode %#o, expected %#o", path, info.Mode().Perm(), *a.Mode)
+	}
+
+	if a.SELinuxLabel != "" {
+		label := make([]byte, 256)
+		n, err := unix.Getxattr(path, selinuxXattr, label)
+		if err != nil {
+			return fmt.Errorf("failed to get SELinux label of tap device %s: %v", path, err)
+		}
+		if got := strings.TrimRight(string(label[:n]), "\x00"); got != a.SELinuxLabel {
+			return fmt.Errorf("tap device %s has SELinux label %q, expected %q", path, got, a.SELinuxLabel)
+		}
+	}
+
+	return nil
+}
+
+// checkACL verifies that the access ACL of the tap device at path holds the
+// named entries, and the mode if any, with their permissions in effect.
+func (a *TapAccess) checkACL(path string) error {
+	data := make([]byte, 4+8*(len(a.ACL)+4))
+	n, err := unix.Getxattr(path, aclXattr, data)
+	if err == unix.ERANGE {
+		// more entries than expected
+		if n, err = unix.Getxattr(path, aclXattr, nil); err == nil {
+			data = make([]byte, n)
+			n, err = unix.Getxattr(path, aclXattr, data)
+		}
+	}
+	if err == unix.ENODATA {
+		return fmt.Errorf("tap device %s has no ACL", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ACL of tap device %s: %v", path, err)
+	}
+	entries, err := decodeACL(data[:n])
+	if err != nil {
+		return fmt.Errorf("invalid ACL of tap device %s: %v", path, err)
+	}
+
+	named := map[ACLEntry]uint16{}
+	perms := map[uint16]uint16{}
+	for _, entry := range entries {
+		if entry.Tag == aclUser || entry.Tag == aclGroup {
+			named[ACLEntry{Tag: entry.Tag, ID: entry.ID}] = entry.Perm
+		} else {
+			perms[entry.Tag] = entry.Perm
+		}
+	}
+
+	if len(named) != len(a.ACL) {
+		return fmt.Errorf("tap device %s has %d named ACL entries, expected %d", path, len(named), len(a.ACL))
+	}
+	for _, expected := range a.ACL {
+		perm, ok := named[ACLEntry{Tag: expected.Tag, ID: expected.ID}]
+		if !ok || perm != expected.Perm {
+			return fmt.Errorf("tap device %s does not grant %s to %d in its ACL", path, formatPerm(expected.Perm), expected.ID)
+		}
+		if mask := perms[aclMask]; mask&perm != perm {
+			return fmt.Errorf("tap device %s ACL mask %s does not let %s through", path, formatPerm(mask), formatPerm(perm))
+		}
+	}
+
+	if a.Mode != nil {
+		mode := os.FileMode(perms[aclUserObj])<<6 | os.FileMode(perms[aclGroupObj])<<3 | os.FileMode(perms[aclOther])
+		if mode != *a.Mode {
+			return fmt.Errorf("tap device %s has mode %#o, expected %#o", path, mode, *a.Mode)
+		}
+	}
+
+	return nil
+}
+
+// decodeACL decodes the entries of an access ACL, in the format of the
+// extended attribute.
+func decodeACL(data []byte) ([]ACLEntry, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return nil, fmt.Errorf("unexpected length %d", len(data))
+	}
+	if version := binary.LittleEndian.Uint32(data); version != aclVersion {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	var entries []ACLEntry
+	for data = data[4:]; len(data) > 0; data = data[8:] {
+		entries = append(entries, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data[0:2]),
+			Perm: binary.LittleEndian.Uint16(data[2:4]),
+			ID:   binary.LittleEndian.Uint32(data[4:8]),
+		})
+	}
+	return entries, nil
+}
+
+// formatPerm formats permissions as in the setfacl short form.
+func formatPerm(perm uint16) string {
+	b := []byte("---")
+	for i, p := range "rwx" {
+		if perm&(4>>i) != 0 {
+			b[i] = byte(p)
+		}
+	}
+	return string(b)
+}
+
+// encodeACL encodes the access ACL made of the named entries and of the
+// entries mirroring the file mode, in the format of the extended attribute.
+func (a *TapAccess) encodeACL(mode os.FileMode) []byte {
+	mask := uint16(mode>>3) & 7
+	entries := []ACLEntry{
+		{Tag: aclUserObj, Perm: uint16(mode>>6) & 7},
+		{Tag: aclGroupObj, Perm: mask},
+		{Tag: aclOther, Perm: uint16(mode) & 7},
+	}
+	for _, entry := range a.ACL {
+		entries = append(entries, entry)
+		mask |= entry.Perm
+	}
+	entries = append(entries, ACLEntry{Tag: aclMask, Perm: mask})
+
+	// the kernel expects the entries sorted by tag and then id
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Tag != entries[j].Tag {
+			return entries[i].Tag < entries[j].Tag
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	data := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(data, aclVersion)
+	for _, entry := range entries {
+		id := entry.ID
+		if entry.Tag != aclUser && entry.Tag != aclGroup {
+			id = 0xffffffff
+		}
+		data = binary.LittleEndian.AppendUint16(data, entry.Tag)
+		data = binary.LittleEndian.AppendUint16(data, entry.Perm)
+		data = binary.LittleEndian.AppendUint32(data, id)
+	}
+
+	return data
+}
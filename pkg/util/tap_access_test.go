@@ -0,0 +1,113 @@
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("TapAccessConfig", func() {
+	var root string
+
+	BeforeEach(func() {
+		var err error
+		root, err = os.MkdirTemp("", "accounts")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.MkdirAll(filepath.Join(root, "etc"), 0755)).To(Succeed())
+		passwd := "root:x:0:0:root:/root:/bin/bash\nqemu:x:107:107:qemu user:/:/sbin/nologin\nhypervisor:x:1001:1001::/:/sbin/nologin\n"
+		Expect(os.WriteFile(filepath.Join(root, "etc/passwd"), []byte(passwd), 0644)).To(Succeed())
+		group := "root:x:0:\nkvm:x:36:qemu\nhypervisor:x:1001:\n"
+		Expect(os.WriteFile(filepath.Join(root, "etc/group"), []byte(group), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("defaults to the given owner", func() {
+		var config *util.TapAccessConfig
+		access, err := config.Resolve(107, 107)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(access).To(Equal(&util.TapAccess{UID: 107, GID: 107}))
+	})
+
+	It("resolves names against the accounts root", func() {
+		config := &util.TapAccessConfig{
+			User:         "hypervisor",
+			Group:        "kvm",
+			Mode:         "0660",
+			ACL:          []string{"u:qemu:rw", "group:1002:r-"},
+			SELinuxLabel: "system_u:object_r:svirt_tap_t:s0",
+			AccountsRoot: root,
+		}
+
+		access, err := config.Resolve(107, 107)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(access.UID).To(Equal(1001))
+		Expect(access.GID).To(Equal(36))
+		Expect(*access.Mode).To(Equal(os.FileMode(0660)))
+		Expect(access.ACL).To(HaveLen(2))
+		Expect(access.ACL[0].ID).To(Equal(uint32(107)))
+		Expect(access.ACL[0].Perm).To(Equal(uint16(6)))
+		Expect(access.ACL[1].ID).To(Equal(uint32(1002)))
+		Expect(access.ACL[1].Perm).To(Equal(uint16(4)))
+		Expect(access.SELinuxLabel).To(Equal(config.SELinuxLabel))
+	})
+
+	It("rejects invalid settings", func() {
+		for _, config := range []util.TapAccessConfig{
+			{User: "nobody-here"},
+			{Group: "nobody-here"},
+			{Mode: "rw-rw----"},
+			{Mode: "01777"},
+			{ACL: []string{"o::rw"}},
+			{ACL: []string{"u:qemu:rwz"}},
+			{ACL: []string{"u:qemu:rw", "user:107:r"}},
+			{SELinuxLabel: "svirt_tap_t"},
+		} {
+			config.AccountsRoot = root
+			_, err := config.Resolve(107, 107)
+			Expect(err).To(HaveOccurred(), "%+v", config)
+		}
+	})
+
+	It("grants access to a device", func() {
+		path := filepath.Join(root, "tap")
+		Expect(os.WriteFile(path, nil, 0600)).To(Succeed())
+
+		mode := os.FileMode(0640)
+		access := &util.TapAccess{UID: os.Getuid(), GID: os.Getgid(), Mode: &mode}
+		Expect(access.Apply(path)).To(Succeed())
+		Expect(access.Check(path)).To(Succeed())
+
+		otherMode := os.FileMode(0600)
+		Expect((&util.TapAccess{UID: os.Getuid(), GID: os.Getgid(), Mode: &otherMode}).Check(path)).NotTo(Succeed())
+	})
+
+	It("grants access to a device through its ACL", func() {
+		path := filepath.Join(root, "tap")
+		Expect(os.WriteFile(path, nil, 0600)).To(Succeed())
+
+		mode := os.FileMode(0640)
+		config := &util.TapAccessConfig{ACL: []string{"u:qemu:rw", "g:kvm:r"}, AccountsRoot: root}
+		access, err := config.Resolve(os.Getuid(), os.Getgid())
+		Expect(err).NotTo(HaveOccurred())
+		access.Mode = &mode
+		Expect(access.Apply(path)).To(Succeed())
+		Expect(access.Check(path)).To(Succeed())
+
+		otherMode := os.FileMode(0600)
+		Expect((&util.TapAccess{UID: access.UID, GID: access.GID, Mode: &otherMode, ACL: access.ACL}).Check(path)).NotTo(Succeed())
+		Expect((&util.TapAccess{UID: access.UID, GID: access.GID, ACL: access.ACL[:1]}).Check(path)).NotTo(Succeed())
+
+		// an ACL stripped off the device
+		Expect(unix.Removexattr(path, "system.posix_acl_access")).To(Succeed())
+		Expect(access.Check(path)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,162 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Priorities of the tc filters installed on the clsact hooks of a macvtap
+// interface. The ingress hook sees the traffic towards the consumer of the
+// macvtap, the egress hook the traffic it sends.
+const (
+	bandwidthFilterPriority = 1
+
+	// The traffic received is mirrored before any filter drops it, except
+	// for the policer. The traffic sent is mirrored once through the guards,
+	// BPF programs and spoof check, for the mirrored frames to be those
+	// actually sent.
+	mirrorIngressPriority = 2
+	mirrorEgressPriority  = 15
+
+	guardDHCPPriority   = 5
+	guardICMPv6Priority = 6
+
+	// BPF programs are attached to both hooks.
+	bpfFilterPriority = 8
+
+	// The spoof check lets frames through once they are known to be allowed,
+	// so it comes last on the egress hook. Filters of different kinds need
+	// priorities of their own.
+	spoofCheckAllowIPPriority  = 10
+	spoofCheckAllowARPPriority = 11
+	spoofCheckDropIPPriority   = 12
+	spoofCheckAllowMACPriority = 13
+	spoofCheckDropPriority     = 14
+
+	// The mirror filters on the lower device of a macvtap share it with
+	// those of the other macvtaps and of other tools, so they get arbitrary
+	// priorities unlikely to be in use there. The u32 filters of both hooks
+	// of a clsact qdisc are dumped together when they have the same priority,
+	// hence one per hook.
+	lowerDeviceMirrorIngressPriority = 0x4d56
+	lowerDeviceMirrorEgressPriority  = 0x4d57
+)
+
+// The spoof check lets the allowed frames through by going to a chain of
+// their own rather than accepting them, for the egress mirror to see them.
+const spoofCheckAllowedChain = 1
+
+// tcActGotoChain is the control action continuing the classification at the
+// chain in its low bits.
+const tcActGotoChain = 0x20000000
+
+// ensureClsact adds a clsact qdisc to the link, unless already present.
+func ensureClsact(link netlink.Link) error {
+	qdisc := &netlink.Clsact{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+	}
+
+	err := netlink.QdiscAdd(qdisc)
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to add clsact qdisc to %q: %v", link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// hasClsact tells whether a clsact qdisc is among the given qdiscs.
+func hasClsact(qdiscs []netlink.Qdisc) bool {
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Clsact); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findFilter returns the filter with the given priority on the given clsact
+// hook of the link, nil if none.
+func findFilter(link netlink.Link, parent uint32, priority uint16) (netlink.Filter, error) {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters of %q: %v", link.Attrs().Name, err)
+	}
+
+	for _, filter := range filters {
+		if filter.Attrs().Priority == priority {
+			return filter, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findChainFilter returns the filter with the given priority in the given
+// chain of a clsact hook of the link, nil if none.
+func findChainFilter(link netlink.Link, parent uint32, chain uint32, priority uint16) (netlink.Filter, error) {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filters of %q: %v", link.Attrs().Name, err)
+	}
+
+	for _, filter := range filters {
+		if filter.Attrs().Priority == priority && filterChain(filter) == chain {
+			return filter, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// filterChain returns the chain of an installed filter.
+func filterChain(filter netlink.Filter) uint32 {
+	if chain := filter.Attrs().Chain; chain != nil {
+		return *chain
+	}
+	return 0
+}
+
+// deleteFilters deletes the filters with the given priority from the given
+// clsact hook of the link, in any chain, if any.
+func deleteFilters(link netlink.Link, parent uint32, priority uint16) error {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list filters of %q: %v", link.Attrs().Name, err)
+	}
+
+	for _, filter := range filters {
+		if filter.Attrs().Priority != priority {
+			continue
+		}
+		if err := netlink.FilterDel(filter); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete %s filter of %q: %v", filter.Type(), link.Attrs().Name, err)
+		}
+	}
+
+	return nil
+}
+
+// sameU32Selector tells whether two u32 filters match the same keys, at the
+// same offsets.
+func sameU32Selector(filter *netlink.U32, expected *netlink.U32) bool {
+	if filter.Sel == nil || expected.Sel == nil || len(filter.Sel.Keys) != len(expected.Sel.Keys) {
+		return false
+	}
+	if filter.Sel.Flags != expected.Sel.Flags || filter.Sel.Off != expected.Sel.Off || filter.Sel.Offoff != expected.Sel.Offoff ||
+		filter.Sel.Offmask != expected.Sel.Offmask || filter.Sel.Offshift != expected.Sel.Offshift {
+		return false
+	}
+	for i, key := range expected.Sel.Keys {
+		if filter.Sel.Keys[i].Mask != key.Mask || filter.Sel.Keys[i].Val != key.Val || filter.Sel.Keys[i].Off != key.Off {
+			return false
+		}
+	}
+	return true
+}
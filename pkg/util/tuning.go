@@ -0,0 +1,177 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+)
+
+// ifNamePlaceholder stands for the name of the macvtap interface in the
+// per-interface sysctls of a Tuning.
+const ifNamePlaceholder = "IFNAME"
+
+// offloadFeatures maps each offload to the ethtool features toggling it, the
+// same way `ethtool -K` does.
+var offloadFeatures = map[string][]string{
+	"gro": {"rx-gro"},
+	"gso": {"tx-generic-segmentation"},
+	"tso": {"tx-tcp-segmentation", "tx-tcp-ecn-segmentation", "tx-tcp-mangleid-segmentation", "tx-tcp6-segmentation"},
+	"rx":  {"rx-checksum"},
+	"tx":  {"tx-checksum-ipv4", "tx-checksum-ip-generic", "tx-checksum-ipv6", "tx-checksum-fcoe-crc", "tx-checksum-sctp"},
+}
+
+// addrGenModes maps the IPv6 address generation modes to their sysctl value.
+var addrGenModes = map[string]string{
+	"eui64":          "0",
+	"none":           "1",
+	"stable_privacy": "2",
+	"random":         "3",
+}
+
+// Offloads holds the offloads to enable or disable on a macvtap interface.
+// Offloads left unset are not changed.
+type Offloads struct {
+	GRO        *bool `json:"gro,omitempty"`
+	GSO        *bool `json:"gso,omitempty"`
+	TSO        *bool `json:"tso,omitempty"`
+	RxChecksum *bool `json:"rxChecksum,omitempty"`
+	TxChecksum *bool `json:"txChecksum,omitempty"`
+}
+
+func (o Offloads) toMap() map[string]*bool {
+	return map[string]*bool{
+		"gro": o.GRO,
+		"gso": o.GSO,
+		"tso": o.TSO,
+		"rx":  o.RxChecksum,
+		"tx":  o.TxChecksum,
+	}
+}
+
+// Tuning holds link settings applied to a macvtap interface in the target
+// netns before it is set up.
+type Tuning struct {
+	TxQueueLen  *int     `json:"txQueueLen,omitempty"`
+	Offloads    Offloads `json:"offloads,omitempty"`
+	AddrGenMode string   `json:"addrGenMode,omitempty"`
+	// Sysctls are per-interface sysctls, where IFNAME stands for the name of
+	// the interface, as in net.ipv6.conf.IFNAME.accept_ra
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+}
+
+// Validate checks the tuning settings without applying them.
+func (t *Tuning) Validate() error {
+	if t == nil {
+		return nil
+	}
+
+	if t.TxQueueLen != nil && *t.TxQueueLen < 0 {
+		return fmt.Errorf("invalid txQueueLen %d", *t.TxQueueLen)
+	}
+
+	if _, ok := addrGenModes[t.AddrGenMode]; t.AddrGenMode != "" && !ok {
+		return fmt.Errorf("unknown addrGenMode %q", t.AddrGenMode)
+	}
+
+	for name := range t.Sysctls {
+		if !isInterfaceSysctl(name) {
+			return fmt.Errorf("sysctl %q is not a per-interface sysctl of the form net.<protocol>.<conf|neigh>.%s.<setting>", name, ifNamePlaceholder)
+		}
+	}
+
+	return nil
+}
+
+func isInterfaceSysctl(name string) bool {
+	fields := strings.Split(name, ".")
+	return len(fields) == 5 &&
+		fields[0] == "net" &&
+		(fields[2] == "conf" || fields[2] == "neigh") &&
+		fields[3] == ifNamePlaceholder &&
+		fields[4] != ""
+}
+
+// apply applies the tuning settings to the link, which is expected to be in
+// the current netns.
+func (t *Tuning) apply(link netlink.Link) error {
+	if t == nil {
+		return nil
+	}
+
+	ifName := link.Attrs().Name
+
+	if t.TxQueueLen != nil {
+		if err := netlink.LinkSetTxQLen(link, *t.TxQueueLen); err != nil {
+			return fmt.Errorf("failed to set txqueuelen of %q: %v", ifName, err)
+		}
+	}
+
+	if err := t.Offloads.apply(ifName); err != nil {
+		return err
+	}
+
+	if t.AddrGenMode != "" {
+		name := fmt.Sprintf("net.ipv6.conf.%s.addr_gen_mode", ifName)
+		if _, err := sysctl.Sysctl(name, addrGenModes[t.AddrGenMode]); err != nil {
+			return fmt.Errorf("failed to set addr_gen_mode of %q: %v", ifName, err)
+		}
+	}
+
+	// apply in a stable order so that failures are reproducible
+	names := make([]string, 0, len(t.Sysctls))
+	for name := range t.Sysctls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ifSysctl := strings.Replace(name, ifNamePlaceholder, ifName, 1)
+		if _, err := sysctl.Sysctl(ifSysctl, t.Sysctls[name]); err != nil {
+			return fmt.Errorf("failed to set sysctl %q: %v", ifSysctl, err)
+		}
+	}
+
+	return nil
+}
+
+func (o Offloads) apply(ifName string) error {
+	requested := map[string]bool{}
+	for offload, enabled := range o.toMap() {
+		if enabled == nil {
+			continue
+		}
+		for _, feature := range offloadFeatures[offload] {
+			requested[feature] = *enabled
+		}
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+
+	e, err := ethtool.NewEthtool()
+	if err != nil {
+		return fmt.Errorf("failed to initialize ethtool: %v", err)
+	}
+	defer e.Close()
+
+	// only request the features known to the device
+	supported, err := e.FeatureNames(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to list features of %q: %v", ifName, err)
+	}
+	features := map[string]bool{}
+	for feature, enabled := range requested {
+		if _, ok := supported[feature]; ok {
+			features[feature] = enabled
+		}
+	}
+
+	if err := e.Change(ifName, features); err != nil {
+		return fmt.Errorf("failed to change offloads of %q: %v", ifName, err)
+	}
+
+	return nil
+}
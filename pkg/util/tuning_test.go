@@ -0,0 +1,44 @@
+package util_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubevirt/macvtap-cni/pkg/util"
+)
+
+var _ = Describe("Tuning", func() {
+	It("accepts valid settings", func() {
+		txQueueLen := 1000
+		tuning := &util.Tuning{
+			TxQueueLen:  &txQueueLen,
+			AddrGenMode: "none",
+			Sysctls: map[string]string{
+				"net.ipv6.conf.IFNAME.accept_ra":      "0",
+				"net.ipv4.neigh.IFNAME.gc_stale_time": "60",
+			},
+		}
+
+		Expect(tuning.Validate()).To(Succeed())
+	})
+
+	It("accepts no settings", func() {
+		var tuning *util.Tuning
+
+		Expect(tuning.Validate()).To(Succeed())
+	})
+
+	It("rejects an unknown addrGenMode", func() {
+		tuning := &util.Tuning{AddrGenMode: "eui48"}
+
+		Expect(tuning.Validate()).NotTo(Succeed())
+	})
+
+	It("rejects sysctls that are not per-interface", func() {
+		for _, name := range []string{"net.core.somaxconn", "kernel.pid_max", "net.ipv6.conf.all.forwarding", "net.ipv6.conf.IFNAME"} {
+			tuning := &util.Tuning{Sysctls: map[string]string{name: "1"}}
+
+			Expect(tuning.Validate()).NotTo(Succeed(), name)
+		}
+	})
+})
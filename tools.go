@@ -4,5 +4,6 @@ package tools
 
 import (
 	_ "github.com/aktau/github-release"
+	_ "github.com/containernetworking/plugins/plugins/ipam/static"
 	_ "golang.org/x/tools/cmd/goimports"
 )